@@ -1,135 +1,332 @@
 package shoveler
 
 import (
+	"context"
 	"errors"
 	"math/rand"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/streadway/amqp"
 )
 
-// This should run in a new go co-routine.
-func StartAMQP(config *Config, queue *ConfirmationQueue) {
+// Failures to publish repeat for every message while the server is unavailable
+var (
+	amqpPushErrors    = NewRateLimitedLog(errorLogInterval)
+	amqpConnectErrors = NewRateLimitedLog(errorLogInterval)
+	// The token is checked every tokenCheckInterval while it is about to expire
+	tokenExpiryWarnings = NewRateLimitedLog(time.Hour)
+)
+
+// amqpExchange holds the session and the credentials used to publish to
+// a single exchange.  Each exchange may be authorized by a different token.
+type amqpExchange struct {
+	name          string
+	tokenLocation string
+	urlMutex      sync.Mutex // Guards url, updated by checkTokenFile when the token changes
+	url           url.URL
+	session       *Session
+	refreshCmd    []string      // Command refreshing the token, disabled if empty
+	refreshBefore time.Duration // How long before the token expires to refresh it
+	expiryWarning time.Duration // How long before the token expires to log warnings
+	tokenExpiry   time.Time     // Expiry of the token in use, zero if unknown
+}
 
-	// Get the configuration URL
-	amqpURL := config.AmqpURL
-	tokenStat, err := os.Stat(config.AmqpToken)
+// newAmqpExchange reads the token for the exchange, connects to the server,
+// and starts watching the token file for changes until the context is done.
+func newAmqpExchange(ctx context.Context, config *Config, name string, triggerReconnect chan<- *amqpExchange) *amqpExchange {
+	exchange := &amqpExchange{
+		name:          name,
+		tokenLocation: config.TokenLocation(name),
+		url:           *config.AmqpURL,
+		refreshCmd:    config.TokenRefreshCmd,
+		refreshBefore: config.TokenRefreshBefore,
+		expiryWarning: config.TokenExpiryWarning,
+	}
+	tokenStat, err := os.Stat(exchange.tokenLocation)
 	if err != nil {
 		log.Fatalln("Failed to stat token file:", err)
 	}
 	tokenAge := tokenStat.ModTime()
-	tokenContents, err := readToken(config.AmqpToken)
+	tokenContents, err := readToken(exchange.tokenLocation)
 	if err != nil {
 		log.Fatalln("Failed to read token, cannot recover")
 	}
-	// Set the username/password
-	amqpURL.User = url.UserPassword("shoveler", tokenContents)
-	amqpQueue := New(*amqpURL)
+	exchange.setToken(tokenContents)
+	exchange.updateTokenExpiry(tokenContents)
+	exchange.session = newSession(exchange.currentURL(), name, config, name == config.AmqpExchange)
+
+	go exchange.checkTokenFile(ctx, tokenAge, config.TokenGracePeriod, triggerReconnect)
+	return exchange
+}
+
+// setToken sets the token as the password of the exchange's URL
+func (exchange *amqpExchange) setToken(tokenContents string) {
+	exchange.urlMutex.Lock()
+	defer exchange.urlMutex.Unlock()
+	exchange.url.User = url.UserPassword("shoveler", tokenContents)
+}
+
+// currentURL returns the exchange's URL, with the latest token
+func (exchange *amqpExchange) currentURL() url.URL {
+	exchange.urlMutex.Lock()
+	defer exchange.urlMutex.Unlock()
+	return exchange.url
+}
+
+// This should run in a new go co-routine.  It returns once the context
+// is done and the connections to the server are closed.
+func StartAMQP(ctx context.Context, config *Config, queue *ConfirmationQueue) {
 
 	// Constantly check for new messages
 	messagesQueue := make(chan []byte)
-	triggerReconnect := make(chan bool)
-	go readMsg(messagesQueue, queue)
-
-	go CheckTokenFile(config, tokenAge, triggerReconnect)
+	triggerReconnect := make(chan *amqpExchange)
+	readerDone := make(chan struct{})
+	go func() {
+		readMsg(ctx, messagesQueue, queue)
+		close(readerDone)
+	}()
+
+	// Sessions for each exchange, created when first published to
+	exchanges := make(map[string]*amqpExchange)
+	getExchange := func(name string) *amqpExchange {
+		if exchange, ok := exchanges[name]; ok {
+			return exchange
+		}
+		exchange := newAmqpExchange(ctx, config, name, triggerReconnect)
+		exchanges[name] = exchange
+		return exchange
+	}
+	getExchange(config.AmqpExchange)
 
 	// Listen to the channel for messages
 	for {
 		select {
-		case <-triggerReconnect:
-			log.Debugln("Triggering reconnect")
-			amqpQueue, err = reconnectAmqp(amqpURL, amqpQueue)
-			if err != nil {
-				log.Errorln("Failed to reconnect to AMQP:", err)
+		case <-ctx.Done():
+			<-readerDone
+			for _, exchange := range exchanges {
+				exchange.session.Close()
 			}
+			return
+		case exchange := <-triggerReconnect:
+			log.Debugln("Triggering reconnect for exchange", exchange.name)
+			exchange.reconnect(config)
 		case msg := <-messagesQueue:
 			// Handle a new message to put on the message queue
+			exchangeName := config.AmqpExchange
+			if config.SummaryExchange != "" && IsSummaryMessage(msg) {
+				exchangeName = config.SummaryExchange
+			}
+			exchange := getExchange(exchangeName)
 		TryPush:
 			for {
-				err = amqpQueue.Push(config.AmqpExchange, msg)
-				if err != nil {
+				err := exchange.session.Push(exchange.name, msg)
+				if err == errBlocked {
+					// Wait for the server to unblock the connection, the next messages stay in the queue
+					select {
+					case <-ctx.Done():
+						// Put the message back, before the message read next
+						<-readerDone
+						queue.Requeue(msg)
+						break TryPush
+					case changed := <-triggerReconnect:
+						changed.reconnect(config)
+					case <-exchange.session.Unblocked():
+					}
+					continue TryPush
+				} else if err != nil {
 					// How to handle a failure to push?
 					// The UnsafePush function already should have tried to reconnect
-					log.Errorln("Failed to push message:", err)
+					amqpPushErrors.Errorln("Failed to push message:", err)
 					// Try again in 1 second
 					// Sleep for random amount between 1 and 5 seconds
 					// Watch for new token files
 					randSleep := rand.Intn(4000) + 1000
 					log.Debugln("Sleeping for", randSleep/1000, "seconds")
 					select {
-					case <-triggerReconnect:
-						log.Debugln("Triggering reconnect from within failure")
-						amqpQueue, err = reconnectAmqp(amqpURL, amqpQueue)
-						if err != nil {
-							log.Errorln("Failed to reconnect to AMQP:", err)
-						}
+					case <-ctx.Done():
+						// Put the message back, before the message read next
+						<-readerDone
+						queue.Requeue(msg)
+						break TryPush
+					case changed := <-triggerReconnect:
+						log.Debugln("Triggering reconnect from within failure for exchange", changed.name)
+						changed.reconnect(config)
 					case <-time.After(time.Duration(randSleep) * time.Millisecond):
 						continue TryPush
 					}
 
 				}
+				JournalMessage(exchange.name, "", msg)
 				break TryPush
 			}
 		}
 	}
 }
 
-// reconnectAmqp reconnects to AMQP if something fails or if the token changes.
+// reconnect reconnects to AMQP if something fails or if the token changes.
 // This is safer than just reconnecting, as it will ensure that
 // resources from the previous connection are cleaned up.
-func reconnectAmqp(amqpURL *url.URL, curSession *Session) (*Session, error) {
+func (exchange *amqpExchange) reconnect(config *Config) {
 	// close the current session
-	curSession.Close()
+	AmqpReconnects.WithLabelValues(exchange.name, "token_rotated").Inc()
+	exchange.session.Close()
 
-	// Create a new session and return it
-	newSession := New(*amqpURL)
-	return newSession, nil
+	// Create a new session
+	exchange.session = newSession(exchange.currentURL(), exchange.name, config, exchange.name == config.AmqpExchange)
 }
 
-// Listen to the channel for messages
-func CheckTokenFile(config *Config, tokenAge time.Time, triggerReconnect chan<- bool) {
-	// Create a timer to check for changes in the token file ever 10 seconds
-	amqpURL := config.AmqpURL
-	checkTokenFile := time.NewTicker(10 * time.Second)
+// checkTokenFile watches the token file of the exchange, and triggers
+// a reconnect of the exchange when the token changes.  With a refresh command,
+// the command is run when the token is about to expire.  The token file may be
+// missing or unreadable for a short time, for example while it is replaced,
+// so failures are retried with a backoff and the shoveler only exits once
+// the token could not be read for longer than the grace period.
+func (exchange *amqpExchange) checkTokenFile(ctx context.Context, tokenAge time.Time, gracePeriod time.Duration, triggerReconnect chan<- *amqpExchange) {
+	var firstFailure, lastRefresh time.Time
+	retryDelay := tokenRetryDelay
+	nextCheck := tokenCheckInterval
 	for {
-		<-checkTokenFile.C
-		log.Debugln("Checking the age of the token file...")
-		// Recheck the age of the token file
-		tokenStat, err := os.Stat(config.AmqpToken)
-		if err != nil {
-			log.Fatalln("Failed to stat token file", config.AmqpToken, "error:", err)
+		select {
+		case <-time.After(nextCheck):
+		case <-ctx.Done():
+			return
 		}
-		newTokenAge := tokenStat.ModTime()
-		if newTokenAge.After(tokenAge) {
-			tokenAge = newTokenAge
-			log.Debugln("Token file was updated, recreating AMQP connection...")
-			// New Token, reload the connection
-			tokenContents, err := readToken(config.AmqpToken)
-			if err != nil {
-				log.Fatalln("Failed to read token, cannot recover")
+		if len(exchange.refreshCmd) > 0 && time.Since(lastRefresh) >= tokenRefreshRetry &&
+			tokenNeedsRefresh(exchange.tokenLocation, exchange.refreshBefore) {
+			lastRefresh = time.Now()
+			exchange.refreshToken(ctx)
+		}
+		exchange.warnTokenExpiry()
+		log.Debugln("Checking the age of the token file", exchange.tokenLocation)
+		tokenContents, newTokenAge, err := exchange.readUpdatedToken(tokenAge)
+		if err != nil {
+			TokenRotations.WithLabelValues("failure").Inc()
+			if firstFailure.IsZero() {
+				firstFailure = time.Now()
+				EmitEvent(EventTokenReadFailure, SeverityError, map[string]interface{}{"token_location": exchange.tokenLocation, "error": err.Error()})
 			}
+			if time.Since(firstFailure) > gracePeriod {
+				log.Fatalln("Failed to read token file", exchange.tokenLocation, "for longer than", gracePeriod, "error:", err)
+			}
+			log.Warningln("Failed to read token file", exchange.tokenLocation, "retrying in", retryDelay, "error:", err)
+			nextCheck = retryDelay
+			retryDelay *= 2
+			if retryDelay > tokenCheckInterval {
+				retryDelay = tokenCheckInterval
+			}
+			continue
+		}
+		firstFailure = time.Time{}
+		retryDelay = tokenRetryDelay
+		nextCheck = tokenCheckInterval
+		if !newTokenAge.After(tokenAge) {
+			continue
+		}
+		tokenAge = newTokenAge
+		TokenRotations.WithLabelValues("success").Inc()
+		log.Debugln("Token file was updated, recreating AMQP connection for exchange", exchange.name)
 
-			// Set the username/password
-			amqpURL.User = url.UserPassword("shoveler", tokenContents)
-			triggerReconnect <- true
-
+		exchange.setToken(tokenContents)
+		exchange.updateTokenExpiry(tokenContents)
+		EmitEvent(EventTokenRotated, SeverityInfo, map[string]interface{}{"token_location": exchange.tokenLocation, "exchange": exchange.name})
+		select {
+		case triggerReconnect <- exchange:
+		case <-ctx.Done():
+			return
 		}
+	}
+}
 
+// updateTokenExpiry exports the expiry of the token now used by the exchange
+func (exchange *amqpExchange) updateTokenExpiry(tokenContents string) {
+	expiry, err := tokenContentsExpiry(tokenContents)
+	if err != nil {
+		log.Warningln("Unable to read the expiry of token", exchange.tokenLocation+":", err)
+		exchange.tokenExpiry = time.Time{}
+		AmqpTokenExpiry.DeleteLabelValues(exchange.name)
+		return
+	}
+	exchange.tokenExpiry = expiry
+	AmqpTokenExpiry.WithLabelValues(exchange.name).Set(float64(expiry.Unix()))
+	exchange.warnTokenExpiry()
+}
+
+// warnTokenExpiry logs a warning when the token in use expires within the warning period
+func (exchange *amqpExchange) warnTokenExpiry() {
+	if exchange.tokenExpiry.IsZero() || time.Until(exchange.tokenExpiry) > exchange.expiryWarning {
+		return
+	}
+	if time.Now().After(exchange.tokenExpiry) {
+		tokenExpiryWarnings.Warningln("Token", exchange.tokenLocation, "for exchange", exchange.name, "expired at", exchange.tokenExpiry.Format(time.RFC3339))
+		return
+	}
+	tokenExpiryWarnings.Warningln("Token", exchange.tokenLocation, "for exchange", exchange.name, "expires at", exchange.tokenExpiry.Format(time.RFC3339))
+}
+
+// refreshToken runs the refresh command of the exchange.  The new token is
+// picked up by checkTokenFile like any other change of the token file.
+func (exchange *amqpExchange) refreshToken(ctx context.Context) {
+	log.Infoln("Refreshing token", exchange.tokenLocation, "with", exchange.refreshCmd)
+	refreshCtx, cancel := context.WithTimeout(ctx, tokenRefreshTimeout)
+	defer cancel()
+	if err := RefreshToken(refreshCtx, exchange.refreshCmd, exchange.tokenLocation); err != nil {
+		TokenRefreshes.WithLabelValues("failure").Inc()
+		log.Errorln("Failed to refresh token", exchange.tokenLocation+", retrying in", tokenRefreshRetry, "error:", err)
+		return
+	}
+	TokenRefreshes.WithLabelValues("success").Inc()
+}
+
+// readUpdatedToken returns the modification time of the token file, and its
+// contents if it was modified after tokenAge
+func (exchange *amqpExchange) readUpdatedToken(tokenAge time.Time) (string, time.Time, error) {
+	tokenStat, err := os.Stat(exchange.tokenLocation)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	newTokenAge := tokenStat.ModTime()
+	if !newTokenAge.After(tokenAge) {
+		return "", newTokenAge, nil
+	}
+	tokenContents, err := readToken(exchange.tokenLocation)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if tokenContents == "" {
+		return "", time.Time{}, errors.New("token file is empty")
 	}
+	return tokenContents, newTokenAge, nil
 }
 
-// Read a message from the queue
-func readMsg(messagesQueue chan<- []byte, queue *ConfirmationQueue) {
+// Read a message from the queue, until the context is done
+func readMsg(ctx context.Context, messagesQueue chan<- []byte, queue *ConfirmationQueue) {
 	for {
-		msg, err := queue.Dequeue()
+		msg, err := queue.DequeueContext(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			log.Errorln("Failed to read from queue:", err)
 			continue
 		}
-		messagesQueue <- msg
+		if delay := delayPublishFault(); delay != nil {
+			select {
+			case <-delay:
+			case <-ctx.Done():
+			}
+		}
+		select {
+		case messagesQueue <- msg:
+		case <-ctx.Done():
+			// Put the message back, it will be kept on disk until the next start
+			queue.Requeue(msg)
+			return
+		}
 	}
 }
 
@@ -156,21 +353,60 @@ type Session struct {
 	notifyConnClose chan *amqp.Error
 	notifyChanClose chan *amqp.Error
 	notifyConfirm   chan amqp.Confirmation
-	isReady         bool
+	isReady         atomic.Bool // Set by handleReconnect, read by the publisher and the self-test
+	output          bool        // Report the readiness of the output, for the session of the publisher's main exchange
+	strictOrder     bool        // Wait for a confirm of every message before returning from Push
+	exchange        string      // Exchange published to, which the stream is bound to
+	stream          string      // Stream queue declared on every new channel, disabled if empty
+	streamBinding   string
+	streamArgs      amqp.Table
+	channelMutex    sync.Mutex       // Protects the channel, its confirms and its delivery tag
+	deliveryTag     uint64           // Delivery tag of the last message published on the current channel
+	routingKey      string           // Routing key of the messages published, empty except for the self-test
+	returns         chan amqp.Return // Latest message returned by the server, as it could not be routed
+	closeOnce       sync.Once
+	blockedMutex    sync.Mutex
+	unblocked       chan struct{} // Closed when the server unblocks the connection, nil while it is not blocked
+
+	reconnectDelay time.Duration // Base delay between the attempts to connect
+	reInitDelay    time.Duration // Base delay between the attempts to set up the channel
+	resendDelay    time.Duration // Base delay between the attempts to push, and how long to wait for a confirm
+	maxDelay       time.Duration // Maximum delay between the attempts, as they back off
 }
 
 var (
 	errNotConnected  = errors.New("not connected to a server")
 	errAlreadyClosed = errors.New("already closed: not connected to the server")
 	errShutdown      = errors.New("session is shutting down")
+	errBlocked       = errors.New("the server blocked publishing")
 )
 
-// New creates a new consumer state instance, and automatically
-// attempts to connect to the server.
-func New(url url.URL) *Session {
+// New creates a new consumer state instance for the exchange, and automatically
+// attempts to connect to the server.  The stream is only declared by the session
+// of the main exchange, which it is bound to.
+func New(url url.URL, exchange string, config *Config) *Session {
+	return newSession(url, exchange, config, false)
+}
+
+// newSession creates a new session, which reports the readiness of the output
+// if it is the publisher's
+func newSession(url url.URL, exchange string, config *Config, output bool) *Session {
 	session := Session{
-		url:  url,
-		done: make(chan bool),
+		url:            url,
+		output:         output,
+		returns:        make(chan amqp.Return, 1),
+		done:           make(chan bool),
+		strictOrder:    config.StrictOrder,
+		exchange:       exchange,
+		reconnectDelay: durationOr(config.AmqpReconnectDelay, reconnectDelay),
+		reInitDelay:    durationOr(config.AmqpReInitDelay, reInitDelay),
+		resendDelay:    durationOr(config.AmqpResendDelay, resendDelay),
+		maxDelay:       durationOr(config.AmqpMaxDelay, maxRetryDelay),
+	}
+	if exchange == config.AmqpExchange {
+		session.stream = config.AmqpStream
+		session.streamArgs = streamArguments(config)
+		session.streamBinding = config.AmqpStreamBinding
 	}
 	go session.handleReconnect()
 	return &session
@@ -179,22 +415,25 @@ func New(url url.URL) *Session {
 // handleReconnect will wait for a connection error on
 // notifyConnClose, and then continuously attempt to reconnect.
 func (session *Session) handleReconnect() {
+	retry := newBackoff(session.reconnectDelay, session.maxDelay)
 	for {
-		session.isReady = false
+		session.setReady(false)
 		log.Debugln("Attempting to connect")
 
 		conn, err := session.connect()
 		RabbitmqReconnects.Inc()
 		if err != nil {
-			log.Warningln("Failed to connect. Retrying:", err.Error())
+			AmqpReconnects.WithLabelValues(session.exchange, "connect_failed").Inc()
+			amqpConnectErrors.Warningln("Failed to connect. Retrying:", err.Error())
 
 			select {
 			case <-session.done:
 				return
-			case <-time.After(reconnectDelay):
+			case <-time.After(retry.next()):
 			}
 			continue
 		}
+		retry.reset()
 
 		if done := session.handleReInit(conn); done {
 			break
@@ -219,30 +458,36 @@ func (session *Session) connect() (*amqp.Connection, error) {
 // handleReconnect will wait for a channel error
 // and then continuously attempt to re-initialize both channels
 func (session *Session) handleReInit(conn *amqp.Connection) bool {
+	retry := newBackoff(session.reInitDelay, session.maxDelay)
 	for {
-		session.isReady = false
+		session.setReady(false)
 
 		err := session.init(conn)
 
 		if err != nil {
 			log.Warningln("Failed to initialize channel. Retrying...")
+			AmqpChannelErrors.WithLabelValues(session.exchange, amqpErrorReason(err)).Inc()
 
 			select {
 			case <-session.done:
 				return true
-			case <-time.After(reInitDelay):
+			case <-time.After(retry.next()):
 			}
 			continue
 		}
+		retry.reset()
 
 		select {
 		case <-session.done:
 			return true
 		case err := <-session.notifyConnClose:
 			log.Warningln("Connection closed. Reconnecting...", err)
+			AmqpReconnects.WithLabelValues(session.exchange, "connection_closed").Inc()
+			EmitEvent(EventMQDisconnected, SeverityWarning, map[string]interface{}{"mq": "amqp", "error": amqpErrorString(err)})
 			return false
 		case err := <-session.notifyChanClose:
 			log.Warningln("Channel closed. Re-running init...", err)
+			AmqpChannelErrors.WithLabelValues(session.exchange, amqpErrorReason(err)).Inc()
 		}
 	}
 }
@@ -255,57 +500,287 @@ func (session *Session) init(conn *amqp.Connection) error {
 		return err
 	}
 
+	// Put the channel into confirm mode, required to receive publisher confirms
 	err = ch.Confirm(false)
 
 	if err != nil {
 		return err
 	}
 
+	if session.stream != "" {
+		if err = session.declareStream(ch); err != nil {
+			log.Warningln("Failed to declare the stream", session.stream+":", err)
+			return err
+		}
+	}
+
 	session.changeChannel(ch)
-	session.isReady = true
+	session.setReady(true)
+	EmitEvent(EventMQConnected, SeverityInfo, map[string]interface{}{"mq": "amqp", "host": session.url.Host})
 	log.Debugln("Setup!")
 
 	return nil
 }
 
+// setReady records whether the session can publish
+func (session *Session) setReady(ready bool) {
+	session.isReady.Store(ready)
+	if session.output {
+		setOutputReady(ready)
+	}
+}
+
+// streamArguments returns the arguments declaring the RabbitMQ stream queue
+func streamArguments(config *Config) amqp.Table {
+	args := amqp.Table{"x-queue-type": "stream"}
+	if config.AmqpStreamMaxBytes > 0 {
+		args["x-max-length-bytes"] = config.AmqpStreamMaxBytes
+	}
+	if config.AmqpStreamMaxAge != "" {
+		args["x-max-age"] = config.AmqpStreamMaxAge
+	}
+	return args
+}
+
+// declareStream declares the stream queue, and binds it to the exchange, so the
+// messages published to the exchange are kept in the stream for consumers
+// reading from an offset.  Declaring an existing stream with the same arguments
+// does nothing.
+func (session *Session) declareStream(ch *amqp.Channel) error {
+	_, err := ch.QueueDeclare(
+		session.stream,     // Name
+		true,               // Durable, required for streams
+		false,              // Auto delete
+		false,              // Exclusive
+		false,              // No wait
+		session.streamArgs, // Arguments
+	)
+	if err != nil {
+		return err
+	}
+	return ch.QueueBind(session.stream, session.streamBinding, session.exchange, false, nil)
+}
+
+// amqpErrorString describes the reason of a close notification, which is nil on a clean close
+func amqpErrorString(err *amqp.Error) string {
+	if err == nil {
+		return "closed"
+	}
+	return err.Error()
+}
+
+// amqpErrorReason maps an error to one of a bounded set of reasons, usable as a metric label
+func amqpErrorReason(err error) string {
+	if err == nil {
+		return "closed"
+	}
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) {
+		return "other"
+	}
+	// A clean close notifies a nil *amqp.Error
+	if amqpErr == nil {
+		return "closed"
+	}
+	switch amqpErr.Code {
+	case amqp.ConnectionForced:
+		return "connection_forced"
+	case amqp.AccessRefused:
+		return "access_refused"
+	case amqp.NotFound:
+		return "not_found"
+	case amqp.ResourceLocked:
+		return "resource_locked"
+	case amqp.PreconditionFailed:
+		return "precondition_failed"
+	case amqp.ChannelError:
+		return "channel_error"
+	case amqp.ResourceError:
+		return "resource_error"
+	case amqp.NotAllowed:
+		return "not_allowed"
+	case amqp.InternalError:
+		return "internal_error"
+	}
+	return "other"
+}
+
+// amqpReturnReason maps the reply code of a returned message to a bounded reason
+func amqpReturnReason(replyCode uint16) string {
+	switch replyCode {
+	case amqp.NoRoute:
+		return "no_route"
+	case amqp.NoConsumers:
+		return "no_consumers"
+	}
+	return "other"
+}
+
+// countReturns counts the messages returned by the server, until the channel
+// is closed, and keeps the latest one in the session's returns
+func (session *Session) countReturns(returns <-chan amqp.Return) {
+	for ret := range returns {
+		AmqpReturns.WithLabelValues(ret.Exchange, amqpReturnReason(ret.ReplyCode)).Inc()
+		select {
+		case <-session.returns:
+		default:
+		}
+		select {
+		case session.returns <- ret:
+		default:
+		}
+	}
+}
+
 // changeConnection takes a new connection to the queue,
 // and updates the close listener to reflect this.
 func (session *Session) changeConnection(connection *amqp.Connection) {
 	session.connection = connection
 	session.notifyConnClose = make(chan *amqp.Error)
 	session.connection.NotifyClose(session.notifyConnClose)
+	go session.watchBlocked(session.connection.NotifyBlocked(make(chan amqp.Blocking, 1)))
+}
+
+// watchBlocked follows the connection.blocked and connection.unblocked
+// notifications of the server, until the connection is closed
+func (session *Session) watchBlocked(blockings <-chan amqp.Blocking) {
+	for blocking := range blockings {
+		session.setBlocked(blocking.Active, blocking.Reason)
+	}
+	// A new connection starts unblocked
+	session.setBlocked(false, "")
+}
+
+// setBlocked records whether the server blocks publishing, and releases the
+// pushes waiting for the connection to be unblocked
+func (session *Session) setBlocked(active bool, reason string) {
+	session.blockedMutex.Lock()
+	defer session.blockedMutex.Unlock()
+	if active && session.unblocked == nil {
+		session.unblocked = make(chan struct{})
+		AmqpBlocked.WithLabelValues(session.exchange).Set(1)
+		log.Warningln("The server blocked publishing, pausing:", reason)
+		EmitEvent(EventMQBlocked, SeverityWarning, map[string]interface{}{"mq": "amqp", "reason": reason})
+	} else if !active && session.unblocked != nil {
+		close(session.unblocked)
+		session.unblocked = nil
+		AmqpBlocked.WithLabelValues(session.exchange).Set(0)
+		log.Infoln("The server unblocked publishing, resuming")
+		EmitEvent(EventMQUnblocked, SeverityInfo, map[string]interface{}{"mq": "amqp"})
+	}
+}
+
+// Unblocked returns a channel closed once the server unblocks the
+// connection, already closed if it is not blocked
+func (session *Session) Unblocked() <-chan struct{} {
+	session.blockedMutex.Lock()
+	defer session.blockedMutex.Unlock()
+	if session.unblocked != nil {
+		return session.unblocked
+	}
+	unblocked := make(chan struct{})
+	close(unblocked)
+	return unblocked
 }
 
 // changeChannel takes a new channel to the queue,
 // and updates the channel listeners to reflect this.
 func (session *Session) changeChannel(channel *amqp.Channel) {
+	session.channelMutex.Lock()
+	defer session.channelMutex.Unlock()
 	session.channel = channel
 	session.notifyChanClose = make(chan *amqp.Error)
 	session.notifyConfirm = make(chan amqp.Confirmation, 1)
+	session.deliveryTag = 0
 	session.channel.NotifyClose(session.notifyChanClose)
+	// Messages are published as mandatory, so the unroutable ones are returned and counted
+	go session.countReturns(session.channel.NotifyReturn(make(chan amqp.Return, 1)))
+	// Only listen for confirms when they are consumed by Push, an unread
+	// confirm channel would block the connection
+	if session.strictOrder {
+		session.channel.NotifyPublish(session.notifyConfirm)
+	}
 }
 
-// Push will push data onto the queue, and wait for a confirm.
-// If no confirms are received until within the resendTimeout,
-// it continuously re-sends messages until a confirm is received.
-// This will block until the server sends a confirm. Errors are
-// only returned if the push action itself fails, see UnsafePush.
+// Push will push data onto the queue.  With strict ordering enabled, it
+// will also wait for a confirm, and if no confirm is received within the
+// resendDelay, it continuously re-sends the message until a confirm is
+// received.  This guarantees a message is accepted by the server before
+// the next one is sent by this session.  Errors are only returned if the push
+// action itself fails, see UnsafePush, or with errBlocked while the server
+// blocks the connection.
 func (session *Session) Push(exchange string, data []byte) error {
-	if !session.isReady {
+	if !session.isReady.Load() {
 		return errors.New("failed to push push: not connected")
 	}
+	retry := newBackoff(session.resendDelay, session.maxDelay)
 	for {
-		err := session.UnsafePush(exchange, data)
+		select {
+		case <-session.Unblocked():
+		default:
+			return errBlocked
+		}
+		if injectFault(FaultForceReconnect) && session.isReady.Load() {
+			_ = session.connection.Close()
+		}
+		deliveryTag, notifyConfirm, err := session.publish(exchange, data)
 		if err != nil {
-			log.Warningln("Push failed. Retrying...")
+			AmqpPublishes.WithLabelValues(exchange, "failed").Inc()
+			amqpPushErrors.Warningln("Push failed. Retrying:", err)
 			select {
 			case <-session.done:
 				return errShutdown
-			case <-time.After(resendDelay):
+			case <-time.After(retry.next()):
 			}
 			continue
 		}
-		return nil
+		AmqpPublishes.WithLabelValues(exchange, "published").Inc()
+		if !session.strictOrder {
+			return nil
+		}
+		result := session.waitConfirm(notifyConfirm, deliveryTag)
+		AmqpConfirms.WithLabelValues(exchange, result).Inc()
+		if result == "ack" {
+			return nil
+		}
+		select {
+		case <-session.done:
+			return errShutdown
+		default:
+		}
+		if !session.isReady.Load() {
+			return errNotConnected
+		}
+	}
+}
+
+// waitConfirm waits for the confirm of the message with the given delivery tag.
+// Returns "ack" if the server acknowledged the message, otherwise the reason it
+// should be resent: "nack", "timeout", or "closed".
+func (session *Session) waitConfirm(notifyConfirm <-chan amqp.Confirmation, deliveryTag uint64) string {
+	timeout := time.After(session.resendDelay)
+	for {
+		select {
+		case confirm, ok := <-notifyConfirm:
+			if !ok {
+				log.Warningln("Channel closed before the push was confirmed. Retrying...")
+				return "closed"
+			}
+			if confirm.DeliveryTag < deliveryTag {
+				// Late confirm of a message that was already resent
+				continue
+			}
+			if !confirm.Ack {
+				log.Warningln("Push was not acknowledged by the server. Retrying...")
+				return "nack"
+			}
+			return "ack"
+		case <-session.done:
+			return "closed"
+		case <-timeout:
+			log.Warningln("Push didn't confirm. Retrying...")
+			return "timeout"
+		}
 	}
 }
 
@@ -314,28 +789,48 @@ func (session *Session) Push(exchange string, data []byte) error {
 // No guarantees are provided for whether the server will
 // recieve the message.
 func (session *Session) UnsafePush(exchange string, data []byte) error {
-	if !session.isReady {
-		return errNotConnected
-	}
-	return session.channel.Publish(
-		exchange, // Exchange
-		"",       // Routing key
-		false,    // Mandatory
-		false,    // Immediate
+	_, _, err := session.publish(exchange, data)
+	return err
+}
+
+// publish publishes the message on the current channel.  Returns the delivery
+// tag of the message, and the confirms of the channel it was published on, as
+// the reconnect goroutine may change the channel at any time.
+func (session *Session) publish(exchange string, data []byte) (uint64, <-chan amqp.Confirmation, error) {
+	session.channelMutex.Lock()
+	defer session.channelMutex.Unlock()
+	if !session.isReady.Load() {
+		return 0, nil, errNotConnected
+	}
+	err := session.channel.Publish(
+		exchange,           // Exchange
+		session.routingKey, // Routing key
+		true,               // Mandatory, unroutable messages are returned and counted
+		false,              // Immediate
 		amqp.Publishing{
 			ContentType: "text/plain",
 			Body:        data,
 		},
 	)
+	if err != nil {
+		return 0, nil, err
+	}
+	// The channel is in confirm mode, every message published on it has the next delivery tag
+	session.deliveryTag++
+	return session.deliveryTag, session.notifyConfirm, nil
 }
 
 // Close will cleanly shutdown the channel and connection.
 func (session *Session) Close() error {
-	if !session.isReady {
+	// Always stop the reconnect loop, even if it is not connected
+	session.closeOnce.Do(func() { close(session.done) })
+	if !session.isReady.Load() {
 		return errAlreadyClosed
 	}
-	close(session.done)
-	err := session.channel.Close()
+	session.channelMutex.Lock()
+	channel := session.channel
+	session.channelMutex.Unlock()
+	err := channel.Close()
 	if err != nil {
 		return err
 	}
@@ -343,6 +838,6 @@ func (session *Session) Close() error {
 	if err != nil {
 		return err
 	}
-	session.isReady = false
+	session.setReady(false)
 	return nil
 }
@@ -0,0 +1,149 @@
+package shoveler
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestReadUpdatedToken makes sure a token file being replaced is reported as an error, not a new token
+func TestReadUpdatedToken(t *testing.T) {
+	tokenLocation := path.Join(t.TempDir(), "token")
+	exchange := amqpExchange{name: "shoveled-xrd", tokenLocation: tokenLocation}
+
+	// Missing token file, as during an atomic replacement
+	_, _, err := exchange.readUpdatedToken(time.Time{})
+	assert.Error(t, err)
+
+	// Empty token file, as while the token is written
+	assert.NoError(t, os.WriteFile(tokenLocation, []byte{}, 0600))
+	_, _, err = exchange.readUpdatedToken(time.Time{})
+	assert.Error(t, err)
+
+	assert.NoError(t, os.WriteFile(tokenLocation, []byte("token1\n"), 0600))
+	token, tokenAge, err := exchange.readUpdatedToken(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, "token1", token)
+
+	// Unchanged token file
+	token, newTokenAge, err := exchange.readUpdatedToken(tokenAge)
+	assert.NoError(t, err)
+	assert.Equal(t, "", token)
+	assert.True(t, tokenAge.Equal(newTokenAge))
+}
+
+// TestExchangeToken makes sure the token set by the token file watcher is in
+// the URL read by the publisher, run with -race to check they are synchronized
+func TestExchangeToken(t *testing.T) {
+	exchange := amqpExchange{name: "shoveled-xrd", url: url.URL{Scheme: "amqp", Host: "localhost"}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			exchange.setToken("token" + strconv.Itoa(i))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_ = exchange.currentURL()
+	}
+	<-done
+	current := exchange.currentURL()
+	password, _ := current.User.Password()
+	assert.Equal(t, "token99", password)
+}
+
+// TestStreamArguments makes sure only the configured stream limits are declared
+func TestStreamArguments(t *testing.T) {
+	args := streamArguments(&Config{AmqpStream: "shoveled-xrd-stream"})
+	assert.Equal(t, amqp.Table{"x-queue-type": "stream"}, args)
+
+	args = streamArguments(&Config{AmqpStream: "shoveled-xrd-stream", AmqpStreamMaxBytes: 1 << 30, AmqpStreamMaxAge: "7D"})
+	assert.Equal(t, amqp.Table{"x-queue-type": "stream", "x-max-length-bytes": int64(1 << 30), "x-max-age": "7D"}, args)
+}
+
+// TestNewSessionStream makes sure only the session of the main exchange declares the stream
+func TestNewSessionStream(t *testing.T) {
+	config := Config{AmqpExchange: "shoveled-xrd", SummaryExchange: "shoveled-xrd-summary", AmqpStream: "shoveled-xrd-stream"}
+	amqpUrl := url.URL{Scheme: "amqp", Host: "127.0.0.1:1"}
+
+	// Stop the reconnect loop, the server is never reached
+	stop := func(session *Session) { session.closeOnce.Do(func() { close(session.done) }) }
+	session := New(amqpUrl, config.AmqpExchange, &config)
+	stop(session)
+	assert.Equal(t, "shoveled-xrd", session.exchange)
+	assert.Equal(t, "shoveled-xrd-stream", session.stream)
+
+	session = New(amqpUrl, config.SummaryExchange, &config)
+	stop(session)
+	assert.Equal(t, "shoveled-xrd-summary", session.exchange)
+	assert.Empty(t, session.stream)
+}
+
+// TestAmqpErrorReason makes sure the metric labels come from a bounded set
+func TestAmqpErrorReason(t *testing.T) {
+	var cleanClose *amqp.Error
+	assert.Equal(t, "closed", amqpErrorReason(cleanClose))
+	assert.Equal(t, "closed", amqpErrorReason(nil))
+	assert.Equal(t, "access_refused", amqpErrorReason(amqp.ErrCredentials))
+	assert.Equal(t, "not_found", amqpErrorReason(&amqp.Error{Code: amqp.NotFound, Reason: "no exchange 'shoveled-xrd'"}))
+	assert.Equal(t, "other", amqpErrorReason(&amqp.Error{Code: 999}))
+	assert.Equal(t, "other", amqpErrorReason(errors.New("dial tcp: connection refused")))
+
+	assert.Equal(t, "no_route", amqpReturnReason(amqp.NoRoute))
+	assert.Equal(t, "other", amqpReturnReason(0))
+}
+
+// TestUpdateTokenExpiry makes sure the expiry of the token in use is exported
+func TestUpdateTokenExpiry(t *testing.T) {
+	exchange := amqpExchange{name: "test-expiry", tokenLocation: "token", expiryWarning: time.Hour}
+	expiry := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": expiry.Unix()}).SignedString([]byte("key"))
+	assert.NoError(t, err)
+
+	exchange.updateTokenExpiry(token)
+	assert.True(t, expiry.Equal(exchange.tokenExpiry))
+	assert.Equal(t, float64(expiry.Unix()), testutil.ToFloat64(AmqpTokenExpiry.WithLabelValues("test-expiry")))
+
+	// A token without an expiry removes the metric
+	exchange.updateTokenExpiry("not a jwt")
+	assert.True(t, exchange.tokenExpiry.IsZero())
+	assert.Equal(t, 0, testutil.CollectAndCount(AmqpTokenExpiry))
+}
+
+// TestSessionBlocked makes sure pushes are refused while the server blocks the
+// connection, and resume once it is unblocked or closed
+func TestSessionBlocked(t *testing.T) {
+	session := Session{exchange: "blocked-xrd", done: make(chan bool)}
+	session.isReady.Store(true)
+
+	session.setBlocked(true, "low on memory")
+	assert.ErrorIs(t, session.Push("blocked-xrd", []byte("test")), errBlocked)
+	assert.Equal(t, 1.0, testutil.ToFloat64(AmqpBlocked.WithLabelValues("blocked-xrd")))
+	unblocked := session.Unblocked()
+	select {
+	case <-unblocked:
+		t.Fatal("The connection should still be blocked")
+	default:
+	}
+
+	session.setBlocked(false, "")
+	<-unblocked
+	assert.Equal(t, 0.0, testutil.ToFloat64(AmqpBlocked.WithLabelValues("blocked-xrd")))
+
+	// Closing the connection unblocks the session
+	blockings := make(chan amqp.Blocking)
+	session.setBlocked(true, "low on disk")
+	unblocked = session.Unblocked()
+	go session.watchBlocked(blockings)
+	close(blockings)
+	<-unblocked
+}
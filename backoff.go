@@ -0,0 +1,50 @@
+package shoveler
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes the delays between the attempts of a failing operation.
+// The delay doubles after each failure, from the base delay up to the
+// maximum, and is jittered so a fleet of shovelers does not retry in step,
+// such as after a broker restart.
+type backoff struct {
+	base     time.Duration
+	max      time.Duration
+	failures int
+}
+
+func newBackoff(base time.Duration, max time.Duration) *backoff {
+	if max < base {
+		max = base
+	}
+	return &backoff{base: base, max: max}
+}
+
+// next returns the delay before the next attempt, between half and all of
+// the exponential delay
+func (b *backoff) next() time.Duration {
+	delay := b.max
+	if b.failures < 32 && b.base<<b.failures < b.max {
+		delay = b.base << b.failures
+	}
+	b.failures++
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// reset starts again from the base delay, after a success
+func (b *backoff) reset() {
+	b.failures = 0
+}
+
+// durationOr returns the value, or the fallback if the value is not set
+func durationOr(value time.Duration, fallback time.Duration) time.Duration {
+	if value > 0 {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,33 @@
+package shoveler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	retry := newBackoff(time.Second, 10*time.Second)
+	for _, delay := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		next := retry.next()
+		assert.GreaterOrEqual(t, next, delay*time.Second/2)
+		assert.LessOrEqual(t, next, delay*time.Second)
+	}
+
+	// Back to the base delay after a success
+	retry.reset()
+	next := retry.next()
+	assert.GreaterOrEqual(t, next, time.Second/2)
+	assert.LessOrEqual(t, next, time.Second)
+
+	// Still capped after many failures
+	for i := 0; i < 100; i++ {
+		assert.LessOrEqual(t, retry.next(), 10*time.Second)
+	}
+}
+
+func TestDurationOr(t *testing.T) {
+	assert.Equal(t, time.Second, durationOr(time.Second, resendDelay))
+	assert.Equal(t, resendDelay, durationOr(0, resendDelay))
+}
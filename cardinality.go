@@ -0,0 +1,124 @@
+package shoveler
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+const (
+	// hllPrecision is the number of bits of the hash used to select a register.
+	// 2^10 registers give a standard error of about 3%.
+	hllPrecision = 10
+	hllRegisters = 1 << hllPrecision
+)
+
+// hyperLogLog is a cardinality estimator that uses one byte per register
+type hyperLogLog [hllRegisters]uint8
+
+// add records the hash of an item in the estimator
+func (h *hyperLogLog) add(hash uint64) {
+	register := hash >> (64 - hllPrecision)
+	// Set a guard bit so the number of leading zeros is bounded
+	remaining := hash<<hllPrecision | 1<<(hllPrecision-1)
+	rank := uint8(bits.LeadingZeros64(remaining)) + 1
+	if rank > h[register] {
+		h[register] = rank
+	}
+}
+
+// merge sets the registers to the maximum of both estimators
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, rank := range other {
+		if rank > h[i] {
+			h[i] = rank
+		}
+	}
+}
+
+// estimate returns the estimated number of distinct items added
+func (h *hyperLogLog) estimate() float64 {
+	m := float64(hllRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha * m * m / sum
+	// Use linear counting for small cardinalities, where it is more accurate
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return estimate
+}
+
+// WindowedCardinality estimates the number of distinct items seen within a sliding time window.
+// The window is split into buckets, each with its own estimator, and the oldest bucket is
+// reset when the window slides.  It is safe for concurrent use.
+type WindowedCardinality struct {
+	mutex       sync.Mutex
+	buckets     []hyperLogLog
+	bucketWidth time.Duration
+	current     int
+	currentEnd  time.Time
+}
+
+// NewWindowedCardinality creates an estimator over the window, split into the number of buckets
+func NewWindowedCardinality(window time.Duration, buckets int) *WindowedCardinality {
+	return &WindowedCardinality{
+		buckets:     make([]hyperLogLog, buckets),
+		bucketWidth: window / time.Duration(buckets),
+	}
+}
+
+// Add records an item as seen now
+func (wc *WindowedCardinality) Add(item string) {
+	wc.addAt(item, time.Now())
+}
+
+// Estimate returns the estimated number of distinct items seen within the window
+func (wc *WindowedCardinality) Estimate() float64 {
+	return wc.estimateAt(time.Now())
+}
+
+func (wc *WindowedCardinality) addAt(item string, now time.Time) {
+	wc.mutex.Lock()
+	defer wc.mutex.Unlock()
+	wc.advance(now)
+	wc.buckets[wc.current].add(HashString(item))
+}
+
+func (wc *WindowedCardinality) estimateAt(now time.Time) float64 {
+	wc.mutex.Lock()
+	defer wc.mutex.Unlock()
+	wc.advance(now)
+	var merged hyperLogLog
+	for i := range wc.buckets {
+		merged.merge(&wc.buckets[i])
+	}
+	return merged.estimate()
+}
+
+// advance moves the current bucket forward to now, resetting the buckets that slid out of the window.
+// Must be called with the mutex held.
+func (wc *WindowedCardinality) advance(now time.Time) {
+	if wc.currentEnd.IsZero() {
+		wc.currentEnd = now.Add(wc.bucketWidth)
+		return
+	}
+	for cleared := 0; !now.Before(wc.currentEnd); cleared++ {
+		if cleared >= len(wc.buckets) {
+			// The whole window has passed, skip ahead
+			wc.currentEnd = now.Add(wc.bucketWidth)
+			return
+		}
+		wc.current = (wc.current + 1) % len(wc.buckets)
+		wc.buckets[wc.current] = hyperLogLog{}
+		wc.currentEnd = wc.currentEnd.Add(wc.bucketWidth)
+	}
+}
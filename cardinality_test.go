@@ -0,0 +1,37 @@
+package shoveler
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestCardinalityEstimate checks the estimate is within the expected error
+func TestCardinalityEstimate(t *testing.T) {
+	for _, distinct := range []int{1, 10, 100, 10000, 100000} {
+		wc := NewWindowedCardinality(time.Hour, 6)
+		for i := 0; i < distinct; i++ {
+			// Add every item twice, duplicates should not be counted
+			wc.Add("192.168.0." + strconv.Itoa(i))
+			wc.Add("192.168.0." + strconv.Itoa(i))
+		}
+		assert.InEpsilon(t, distinct, wc.Estimate(), 0.1, "Estimate for %d distinct items", distinct)
+	}
+}
+
+// TestCardinalityWindow checks that items expire once they slide out of the window
+func TestCardinalityWindow(t *testing.T) {
+	wc := NewWindowedCardinality(time.Hour, 6)
+	start := time.Now()
+	wc.addAt("192.168.0.1", start)
+	wc.addAt("192.168.0.2", start.Add(30*time.Minute))
+	assert.InDelta(t, 2, wc.estimateAt(start.Add(50*time.Minute)), 0.1)
+	// The first server is now outside of the window
+	assert.InDelta(t, 1, wc.estimateAt(start.Add(70*time.Minute)), 0.1)
+	// Both servers are outside of the window
+	assert.InDelta(t, 0, wc.estimateAt(start.Add(5*time.Hour)), 0.1)
+	wc.addAt("192.168.0.3", start.Add(5*time.Hour))
+	assert.InDelta(t, 1, wc.estimateAt(start.Add(5*time.Hour)), 0.1)
+}
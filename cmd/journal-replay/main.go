@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	shoveler "github.com/opensciencegrid/xrootd-monitoring-shoveler"
+	"github.com/opensciencegrid/xrootd-monitoring-shoveler/queue"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	version string
+	commit  string
+	date    string
+	builtBy string
+)
+
+type Options struct {
+	Verbose  []bool   `short:"v" long:"verbose" description:"Show verbose debug information"`
+	Config   string   `short:"c" long:"config" description:"Configuration file to use, by default the shoveler configuration is searched for"`
+	Journal  []string `short:"j" long:"journal" description:"Journal directory, by default journal.dir of the configuration.  Repeat to merge the journals of several shovelers in the order the messages were published"`
+	From     string   `long:"from" description:"Republish the messages published at or after this time, in RFC 3339 format"`
+	To       string   `long:"to" description:"Republish the messages published before this time, in RFC 3339 format"`
+	Exchange string   `long:"exchange" description:"Republish to this exchange instead of the exchange recorded in the journal"`
+	DryRun   bool     `short:"n" long:"dry-run" description:"Count the messages that would be republished without publishing them"`
+}
+
+var options Options
+var parser = flags.NewParser(&options, flags.Default)
+
+func main() {
+
+	shoveler.ShovelerVersion = version
+	shoveler.ShovelerCommit = commit
+	shoveler.ShovelerDate = date
+	shoveler.ShovelerBuiltBy = builtBy
+
+	logger := logrus.New()
+	shoveler.SetLogger(logger)
+
+	if _, err := parser.Parse(); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		} else {
+			logger.Errorln(err)
+			os.Exit(1)
+		}
+	}
+
+	if len(options.Verbose) > 0 {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.InfoLevel)
+	}
+
+	// Load the configuration
+	if options.Config != "" {
+		viper.SetConfigFile(options.Config)
+	}
+	config := shoveler.Config{}
+	config.ReadConfig()
+	if config.MQ != "amqp" && !options.DryRun {
+		logger.Fatalln("Messages can only be republished to AMQP, the configured mq is", config.MQ)
+	}
+
+	journalDirs := options.Journal
+	if len(journalDirs) == 0 && config.JournalDir != "" {
+		journalDirs = []string{config.JournalDir}
+	}
+	if len(journalDirs) == 0 {
+		logger.Fatalln("No journal directory, set journal.dir in the configuration or use --journal")
+	}
+	from, err := parseTime(options.From)
+	if err != nil {
+		logger.Fatalln("Failed to parse --from:", err)
+	}
+	to, err := parseTime(options.To)
+	if err != nil {
+		logger.Fatalln("Failed to parse --to:", err)
+	}
+
+	// The journal is encrypted with the queue encryption key
+	var key []byte
+	if config.QueueKeyFile != "" {
+		if key, err = queue.ReadKeyFile(config.QueueKeyFile); err != nil {
+			logger.Fatalln("Failed to read the queue encryption key:", err)
+		}
+	}
+
+	// Wait for the broker to confirm every message before exiting
+	config.StrictOrder = true
+	sessions := make(map[string]*shoveler.Session)
+	defer func() {
+		for _, session := range sessions {
+			session.Close()
+		}
+	}()
+
+	republished := 0
+	err = shoveler.ReadJournals(journalDirs, key, from, to, func(record *shoveler.JournalRecord) error {
+		exchange := record.Exchange
+		if options.Exchange != "" {
+			exchange = options.Exchange
+		}
+		republished++
+		if options.DryRun {
+			return nil
+		}
+		session, ok := sessions[exchange]
+		if !ok {
+			session, err = newSession(&config, exchange)
+			if err != nil {
+				return err
+			}
+			sessions[exchange] = session
+		}
+		for {
+			err := session.Push(exchange, record.Message)
+			if err == nil {
+				return nil
+			}
+			logger.Debugln("Failed to republish message, retrying:", err)
+			time.Sleep(time.Second)
+		}
+	})
+	if err != nil {
+		logger.Fatalln("Failed to republish the journal:", err)
+	}
+	if options.DryRun {
+		logger.Infoln(republished, "messages would be republished")
+	} else {
+		logger.Infoln("Republished", republished, "messages")
+	}
+}
+
+// parseTime parses an RFC 3339 time, an empty string is the zero time
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// newSession connects to the AMQP server with the token of the exchange
+func newSession(config *shoveler.Config, exchange string) (*shoveler.Session, error) {
+	tokenContents, err := os.ReadFile(config.TokenLocation(exchange))
+	if err != nil {
+		return nil, err
+	}
+	amqpURL := *config.AmqpURL
+	amqpURL.User = url.UserPassword("shoveler", strings.TrimSpace(string(tokenContents)))
+	return shoveler.New(amqpURL, exchange, config), nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	shoveler "github.com/opensciencegrid/xrootd-monitoring-shoveler"
+	"github.com/opensciencegrid/xrootd-monitoring-shoveler/queue"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	version string
+	commit  string
+	date    string
+	builtBy string
+)
+
+var logger *logrus.Logger
+
+type Options struct {
+	Verbose []bool `short:"v" long:"verbose" description:"Show verbose debug information"`
+	Config  string `short:"c" long:"config" description:"Configuration file to use, by default the shoveler configuration is searched for"`
+	Dir     string `short:"d" long:"dir" description:"Queue directory, by default queue_directory of the configuration"`
+	Key     string `short:"k" long:"key" description:"Queue encryption key file, by default queue_encryption_key_file of the configuration"`
+}
+
+type InspectCommand struct {
+	Messages int `short:"m" long:"messages" description:"Print the first messages of the queue" default:"0"`
+}
+
+type CompactCommand struct{}
+
+var options Options
+var parser = flags.NewParser(&options, flags.Default)
+
+func init() {
+	_, _ = parser.AddCommand("inspect", "Print the size of the queue, and the lock owner",
+		"Print the size of the queue, the process locking it, and optionally the first messages", &InspectCommand{})
+	_, _ = parser.AddCommand("compact", "Rewrite the queue on disk to release the space of dequeued messages",
+		"Rewrite the queue on disk to release the space of dequeued messages.  The shoveler must be stopped.", &CompactCommand{})
+}
+
+func main() {
+
+	shoveler.ShovelerVersion = version
+	shoveler.ShovelerCommit = commit
+	shoveler.ShovelerDate = date
+	shoveler.ShovelerBuiltBy = builtBy
+
+	logger = logrus.New()
+	shoveler.SetLogger(logger)
+
+	// The errors are printed by the parser
+	if _, err := parser.Parse(); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(1)
+	}
+}
+
+// queueDir returns the queue directory and the key file from the options, or
+// the configuration
+func queueDir() (string, string) {
+	if len(options.Verbose) > 0 {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.WarnLevel)
+	}
+	if options.Dir != "" {
+		return options.Dir, options.Key
+	}
+	if options.Config != "" {
+		viper.SetConfigFile(options.Config)
+	}
+	config := shoveler.Config{}
+	config.ReadConfig()
+	if options.Key != "" {
+		return config.QueueDir, options.Key
+	}
+	return config.QueueDir, config.QueueKeyFile
+}
+
+// openQueue opens the queue, explaining who holds the lock if it is in use
+func openQueue(dir string, keyFile string) (*queue.Queue, error) {
+	queueOptions := queue.Options{}
+	if keyFile != "" {
+		key, err := queue.ReadKeyFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		queueOptions.Key = key
+	}
+	q, err := queue.Open(dir, queueOptions)
+	if errors.Is(err, queue.ErrLocked) {
+		return nil, fmt.Errorf("%w, stop the shoveler first", err)
+	}
+	return q, err
+}
+
+func (c *InspectCommand) Execute(args []string) error {
+	dir, keyFile := queueDir()
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	owner, active, err := queue.LockState(dir)
+	if err != nil {
+		return err
+	}
+	if active && owner != nil {
+		fmt.Println("Locked by pid", owner.Pid, "on", owner.Hostname, "since", owner.Started.Format(time.RFC3339))
+	} else if active {
+		fmt.Println("Locked by an unknown process")
+	}
+	if active {
+		// The size of a queue in use can not be read safely
+		return nil
+	}
+
+	q, err := openQueue(dir, keyFile)
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+	fmt.Println("Queue directory:", dir)
+	fmt.Println("Messages:", q.Len())
+	printed := 0
+	errDone := errors.New("done")
+	err = q.Iterate(func(msg []byte) error {
+		if printed >= c.Messages {
+			return errDone
+		}
+		printed++
+		fmt.Println(strconv.Itoa(printed)+":", string(msg))
+		return nil
+	})
+	if err != nil && err != errDone {
+		return err
+	}
+	return nil
+}
+
+func (c *CompactCommand) Execute(args []string) error {
+	q, err := openQueue(queueDir())
+	if err != nil {
+		return err
+	}
+	if err := q.Compact(); err != nil {
+		q.Close()
+		return err
+	}
+	fmt.Println("Compacted", q.Len(), "messages")
+	return q.Close()
+}
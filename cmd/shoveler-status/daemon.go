@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	shoveler "github.com/opensciencegrid/xrootd-monitoring-shoveler"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Health check results exported in daemon mode
+var (
+	checkUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "shoveler_status_up",
+		Help: "Whether the shoveler metrics endpoint could be read (1) or not (0)",
+	})
+	checkTokenExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "shoveler_status_token_expiry_seconds",
+		Help: "Seconds until the first of the AMQP tokens of the exchanges expires, negative if it has expired",
+	})
+	checkTokenOk = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "shoveler_status_token_ok",
+		Help: "Whether the AMQP tokens are valid beyond the warning window (1) or not (0)",
+	})
+	checkQueueSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "shoveler_status_queue_size",
+		Help: "The number of messages in the shoveler queue",
+	})
+	checkQueueOk = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "shoveler_status_queue_ok",
+		Help: "Whether the shoveler queue is below the error threshold of 100 messages (1) or not (0)",
+	})
+	checkPacketsDelta = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "shoveler_status_packets_delta",
+		Help: "The number of packets received by the shoveler since the previous check",
+	})
+	checkReceivingOk = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "shoveler_status_receiving_ok",
+		Help: "Whether the shoveler received packets since the previous check (1) or not (0)",
+	})
+)
+
+// alert is an alert in the format of the alertmanager v2 API
+type alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+func boolGauge(ok bool) float64 {
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+// RunDaemon checks the shoveler every period, exports the results as prometheus
+// metrics, and pushes alerts for failing checks to the alertmanager
+func RunDaemon(config shoveler.Config) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(checkUp, checkTokenExpiry, checkTokenOk, checkQueueSize, checkQueueOk,
+		checkPacketsDelta, checkReceivingOk)
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		if err := http.ListenAndServe(options.Listen, mux); err != nil {
+			logger.Errorln("Failed to listen and serve the status metrics:", err)
+			os.Exit(1)
+		}
+	}()
+
+	metricsURL := "http://localhost:" + strconv.Itoa(config.MetricsPort) + "/metrics"
+	period := time.Duration(options.Period) * time.Second
+	tokenWarning := time.Duration(options.Warn) * time.Hour
+	var lastStats *ShovelerStats
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		var failures []string
+
+		if config.MQ == "amqp" {
+			// The token expiring first, of the tokens of every exchange
+			var expiry time.Time
+			var err error
+			for _, tokenLocation := range config.TokenLocations() {
+				tokenExpiry, tokenErr := shoveler.TokenExpiry(tokenLocation)
+				if tokenErr != nil {
+					err = fmt.Errorf("%s: %w", tokenLocation, tokenErr)
+					break
+				}
+				if expiry.IsZero() || tokenExpiry.Before(expiry) {
+					expiry = tokenExpiry
+				}
+			}
+			if err != nil {
+				logger.Errorln("Unable to read the token expiry:", err)
+				checkTokenExpiry.Set(0)
+				checkTokenOk.Set(0)
+				failures = append(failures, "ShovelerTokenInvalid")
+			} else {
+				remaining := time.Until(expiry)
+				checkTokenExpiry.Set(remaining.Seconds())
+				checkTokenOk.Set(boolGauge(remaining > tokenWarning))
+				if remaining <= tokenWarning {
+					failures = append(failures, "ShovelerTokenExpiring")
+				}
+			}
+		}
+
+		stats, err := fetchShovelerStats(metricsURL)
+		if err != nil {
+			logger.Errorln("Unable to connect to the shoveler metrics endpoint:", err)
+			checkUp.Set(0)
+			failures = append(failures, "ShovelerDown")
+			lastStats = nil
+		} else {
+			checkUp.Set(1)
+			checkQueueSize.Set(float64(stats.shoveler_queue_size))
+			checkQueueOk.Set(boolGauge(stats.shoveler_queue_size <= 100))
+			if stats.shoveler_queue_size > 100 {
+				failures = append(failures, "ShovelerQueueBacklog")
+			}
+			if lastStats != nil {
+				delta := stats.packetsReceived - lastStats.packetsReceived
+				checkPacketsDelta.Set(float64(delta))
+				checkReceivingOk.Set(boolGauge(delta > 0))
+				if delta <= 0 {
+					failures = append(failures, "ShovelerNotReceiving")
+				}
+			}
+			lastStats = &stats
+		}
+
+		if options.Alerts != "" && len(failures) > 0 {
+			if err := pushAlerts(failures, period); err != nil {
+				logger.Errorln("Failed to push alerts to the alertmanager:", err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// pushAlerts sends the failing checks to the alertmanager.  The alerts end after
+// a few periods unless they are pushed again, so they resolve when the check passes.
+func pushAlerts(failures []string, period time.Duration) error {
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	alerts := make([]alert, 0, len(failures))
+	for _, failure := range failures {
+		alerts = append(alerts, alert{
+			Labels:      map[string]string{"alertname": failure, "instance": hostname, "service": "xrootd-monitoring-shoveler"},
+			Annotations: map[string]string{"summary": "xrootd-monitoring-shoveler check " + failure + " failed on " + hostname},
+			StartsAt:    now,
+			EndsAt:      now.Add(3 * period),
+		})
+	}
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(strings.TrimSuffix(options.Alerts, "/")+"/api/v2/alerts", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("alertmanager returned " + resp.Status)
+	}
+	return nil
+}
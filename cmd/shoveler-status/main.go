@@ -14,6 +14,7 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/jessevdk/go-flags"
 	shoveler "github.com/opensciencegrid/xrootd-monitoring-shoveler"
+	"github.com/opensciencegrid/xrootd-monitoring-shoveler/queue"
 	"github.com/pterm/pterm"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -34,15 +35,23 @@ var logger *logrus.Logger
 type Options struct {
 	Verbose []bool `short:"v" long:"verbose" description:"Show verbose debug information"`
 	Version bool   `short:"V" long:"version" description:"Print version information"`
-	Config  string `short:"c" long:"config" description:"Configuration file to use" default:"/etc/xrootd-monitoring-shoveler/config.yaml"`
+	Config  string `short:"c" long:"config" description:"Configuration file to use, by default the shoveler configuration is searched for"`
 	Period  int    `short:"p" long:"period" description:"Period in seconds to check the shoveler status" default:"10"`
 	Host    string `short:"H" long:"host" description:"Host to check the shoveler status, by default will use the port from the detected shoveler configuration" default:"localhost:8000"`
+	Daemon  bool   `short:"d" long:"daemon" description:"Continuously check the shoveler status every period and export the results as prometheus metrics"`
+	Watch   bool   `short:"w" long:"watch" description:"Continuously show the shoveler metrics, refreshed every period"`
+	Listen  string `long:"listen" description:"Address to export the prometheus metrics of the daemon mode" default:":8001"`
+	Alerts  string `long:"alertmanager" description:"Alertmanager URL to push alerts to in daemon mode, such as http://localhost:9093"`
+	Warn    int    `long:"token-warning" description:"Hours before the token expires to report it as expiring" default:"72"`
 }
 
 type ShovelerStats struct {
 	packetsReceived       int64
 	rabbitmqReconnections int64
 	shoveler_queue_size   int64
+	tokenExpiry           int64 // Earliest expiry of the tokens used by the shoveler, 0 if unknown
+	validationsFailed     int64
+	published             map[string]int64 // Messages published to each exchange
 }
 
 var options Options
@@ -55,7 +64,7 @@ func main() {
 	shoveler.ShovelerDate = date
 	shoveler.ShovelerBuiltBy = builtBy
 
-	logger := logrus.New()
+	logger = logrus.New()
 	shoveler.SetLogger(logger)
 
 	// Parse flags from `args'. Note that here we use flags.ParseArgs for
@@ -69,10 +78,17 @@ func main() {
 			os.Exit(1)
 		}
 	}
+	if options.Period < 1 {
+		logger.Errorln("The period must be at least 1 second, got", options.Period)
+		os.Exit(1)
+	}
 
 	spinnerConfig, _ := pterm.DefaultSpinner.Start("Checking the shoveler configuration")
 
 	// Load the configuration
+	if options.Config != "" {
+		viper.SetConfigFile(options.Config)
+	}
 	config := shoveler.Config{}
 	config.ReadConfig()
 
@@ -85,8 +101,20 @@ func main() {
 	logger.Debugln("Using configuration file:", viper.ConfigFileUsed())
 	spinnerConfig.Success()
 
+	if options.Daemon {
+		RunDaemon(config)
+		return
+	}
+
+	if options.Watch {
+		RunWatch(config)
+		return
+	}
+
 	CheckToken(config)
 
+	CheckQueueLock(config)
+
 	// Try to connect to the prometheus endpoint
 	if !config.Metrics {
 		pterm.Error.Println("Metrics are disabled in the configuration file")
@@ -106,6 +134,18 @@ func main() {
 		//os.Exit(1)
 	}
 
+	// Check the token the shoveler is using, which may differ from the token file until it is reloaded
+	if initialStats.tokenExpiry > 0 {
+		expiry := time.Unix(initialStats.tokenExpiry, 0)
+		if remaining := time.Until(expiry); remaining <= 0 {
+			pterm.Error.Println("The token used by the shoveler expired at", expiry.Format(time.RFC3339))
+		} else if remaining <= time.Duration(options.Warn)*time.Hour {
+			pterm.Warning.Println("The token used by the shoveler expires in", remaining.Round(time.Minute).String())
+		} else {
+			pterm.Success.Println("The token used by the shoveler expires at", expiry.Format(time.RFC3339))
+		}
+	}
+
 	// Check the queue size
 	if initialStats.shoveler_queue_size > 100 {
 		pterm.Error.Println("The shoveler has", strconv.FormatInt(initialStats.shoveler_queue_size, 10), " packets in the queue, which indicates that the shoveler is not keeping up with the incoming packets")
@@ -221,13 +261,43 @@ func CheckToken(config shoveler.Config) {
 	spinnerToken.Success()
 }
 
+func CheckQueueLock(config shoveler.Config) {
+	spinnerLock, _ := pterm.DefaultSpinner.Start("Checking the shoveler queue directory lock")
+	owner, active, err := queue.LockState(config.QueueDir)
+	if err != nil {
+		spinnerLock.Fail("Unable to check the queue directory lock: ", err)
+		return
+	}
+	if !active {
+		spinnerLock.Warning("The queue directory " + config.QueueDir + " is not locked, the shoveler does not appear to be running")
+		return
+	}
+	if owner == nil {
+		spinnerLock.Success("The queue directory " + config.QueueDir + " is locked by an unknown process")
+		return
+	}
+	spinnerLock.Success("The queue directory is locked by pid " + strconv.Itoa(owner.Pid) + " on " + owner.Hostname +
+		" since " + owner.Started.Format(time.RFC3339))
+}
+
 func CheckPrometheusEndpoint(metricsPort int) (ShovelerStats, error) {
 	// Download from the metrics endpoint
 	metricsURL := "http://localhost:" + strconv.Itoa(metricsPort) + "/metrics"
 	spinnerInitialConnect, _ := pterm.DefaultSpinner.Start("Checking the shoveler metrics endpoint: " + metricsURL)
+	stats, err := fetchShovelerStats(metricsURL)
+	if err != nil {
+		spinnerInitialConnect.Fail("Unable to read the metrics endpoint")
+		return ShovelerStats{}, err
+	}
+	spinnerInitialConnect.Success()
+	return stats, nil
+
+}
+
+// fetchShovelerStats downloads and parses the shoveler metrics
+func fetchShovelerStats(metricsURL string) (ShovelerStats, error) {
 	resp, err := http.Get(metricsURL)
 	if err != nil {
-		spinnerInitialConnect.Fail()
 		return ShovelerStats{}, err
 	}
 	defer resp.Body.Close()
@@ -235,12 +305,9 @@ func CheckPrometheusEndpoint(metricsPort int) (ShovelerStats, error) {
 	// Read all the body and return it
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		spinnerInitialConnect.Fail("Unable to read the metrics endpoint")
 		return ShovelerStats{}, err
 	}
-	spinnerInitialConnect.Success()
 	return parseShovelerStats(string(body)), nil
-
 }
 
 func parsePrometheusMetric(line string) int64 {
@@ -253,16 +320,55 @@ func parsePrometheusMetric(line string) int64 {
 	return int
 }
 
+// metricName returns the name of the metric on a line of the prometheus text format,
+// without the _total suffix of the counters, so the legacy names match too
+func metricName(line string) string {
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return ""
+	}
+	return strings.TrimSuffix(line[:end], "_total")
+}
+
+// metricLabel returns the value of the label on a line of the prometheus text format
+func metricLabel(line string, label string) string {
+	start := strings.Index(line, "{"+label+"=\"")
+	if start < 0 {
+		start = strings.Index(line, ","+label+"=\"")
+	}
+	if start < 0 {
+		return ""
+	}
+	value := line[start+len(label)+3:]
+	end := strings.Index(value, "\"")
+	if end < 0 {
+		return ""
+	}
+	return value[:end]
+}
+
 func parseShovelerStats(body string) ShovelerStats {
 	// Loop through the body and parse the stats
-	var stats ShovelerStats
+	stats := ShovelerStats{published: make(map[string]int64)}
 	for _, line := range strings.Split(body, "\n") {
-		if strings.HasPrefix(line, "shoveler_packets_received") {
+		switch metricName(line) {
+		case "shoveler_packets_received":
 			stats.packetsReceived = parsePrometheusMetric(line)
-		} else if strings.HasPrefix(line, "shoveler_rabbitmq_reconnects") {
+		case "shoveler_rabbitmq_reconnects":
 			stats.rabbitmqReconnections = parsePrometheusMetric(line)
-		} else if strings.HasPrefix(line, "shoveler_queue_size") {
+		case "shoveler_queue_size":
 			stats.shoveler_queue_size = parsePrometheusMetric(line)
+		case "shoveler_validations_failed":
+			stats.validationsFailed = parsePrometheusMetric(line)
+		case "shoveler_amqp_publish_attempts":
+			if metricLabel(line, "result") == "published" {
+				stats.published[metricLabel(line, "exchange")] = parsePrometheusMetric(line)
+			}
+		case "shoveler_amqp_token_expiry_timestamp":
+			// One per exchange, keep the token expiring first
+			if expiry := parsePrometheusMetric(line); stats.tokenExpiry == 0 || expiry < stats.tokenExpiry {
+				stats.tokenExpiry = expiry
+			}
 		}
 	}
 	return stats
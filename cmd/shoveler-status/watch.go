@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	shoveler "github.com/opensciencegrid/xrootd-monitoring-shoveler"
+	"github.com/pterm/pterm"
+)
+
+// Thresholds of the watch mode colors
+const (
+	watchQueueWarning = 1
+	watchQueueError   = 100
+	watchErrorRate    = 0.01 // Fraction of the packets failing validation shown in red
+)
+
+// RunWatch shows the shoveler metrics every period, refreshed in place, until interrupted
+func RunWatch(config shoveler.Config) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	metricsURL := "http://localhost:" + strconv.Itoa(config.MetricsPort) + "/metrics"
+	period := time.Duration(options.Period) * time.Second
+	area, err := pterm.DefaultArea.Start()
+	if err != nil {
+		logger.Errorln("Unable to start the watch display:", err)
+		os.Exit(1)
+	}
+	defer func() { _ = area.Stop() }()
+
+	var lastStats *ShovelerStats
+	var lastTime time.Time
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		stats, err := fetchShovelerStats(metricsURL)
+		header := pterm.DefaultSection.Sprint("Shoveler at " + metricsURL + ", refreshed " + now.Format(time.TimeOnly) +
+			" every " + period.String())
+		if err != nil {
+			area.Update(header, pterm.Error.Sprint("Unable to connect to the shoveler metrics endpoint: ", err))
+			lastStats = nil
+		} else {
+			table, err := pterm.DefaultTable.WithHasHeader().WithData(watchTable(&stats, lastStats, now.Sub(lastTime))).Srender()
+			if err != nil {
+				logger.Errorln("Unable to render the watch display:", err)
+			}
+			area.Update(header, table)
+			lastStats = &stats
+		}
+		lastTime = now
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchTable returns the rows of the watch display.  Rates are only
+// shown once the stats of the previous refresh are known.
+func watchTable(stats *ShovelerStats, last *ShovelerStats, elapsed time.Duration) [][]string {
+	rate := func(current int64, previous int64) float64 {
+		return float64(current-previous) / elapsed.Seconds()
+	}
+	rows := [][]string{{"Metric", "Value"}}
+
+	queueSize := strconv.FormatInt(stats.shoveler_queue_size, 10)
+	switch {
+	case stats.shoveler_queue_size >= watchQueueError:
+		queueSize = pterm.Red(queueSize)
+	case stats.shoveler_queue_size >= watchQueueWarning:
+		queueSize = pterm.Yellow(queueSize)
+	default:
+		queueSize = pterm.Green(queueSize)
+	}
+	rows = append(rows, []string{"Queue size", queueSize})
+
+	reconnects := strconv.FormatInt(stats.rabbitmqReconnections, 10)
+	if last != nil && stats.rabbitmqReconnections > last.rabbitmqReconnections {
+		reconnects = pterm.Red(reconnects)
+	}
+	rows = append(rows, []string{"Reconnects", reconnects})
+
+	if last == nil {
+		rows = append(rows, []string{"Packets/s", "..."}, []string{"Invalid packets", "..."})
+		return rows
+	}
+
+	packetRate := rate(stats.packetsReceived, last.packetsReceived)
+	packets := fmt.Sprintf("%.1f", packetRate)
+	if packetRate <= 0 {
+		packets = pterm.Yellow(packets)
+	}
+	rows = append(rows, []string{"Packets/s", packets})
+
+	invalid := "0.0%"
+	if received := stats.packetsReceived - last.packetsReceived; received > 0 {
+		errorRate := float64(stats.validationsFailed-last.validationsFailed) / float64(received)
+		invalid = fmt.Sprintf("%.1f%%", errorRate*100)
+		if errorRate >= watchErrorRate {
+			invalid = pterm.Red(invalid)
+		} else if errorRate > 0 {
+			invalid = pterm.Yellow(invalid)
+		}
+	}
+	rows = append(rows, []string{"Invalid packets", invalid})
+
+	exchanges := make([]string, 0, len(stats.published))
+	for exchange := range stats.published {
+		exchanges = append(exchanges, exchange)
+	}
+	sort.Strings(exchanges)
+	for _, exchange := range exchanges {
+		published := fmt.Sprintf("%.1f", rate(stats.published[exchange], last.published[exchange]))
+		rows = append(rows, []string{"Published/s to " + exchange, published})
+	}
+	return rows
+}
@@ -1,7 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	shoveler "github.com/opensciencegrid/xrootd-monitoring-shoveler"
 	"github.com/sirupsen/logrus"
@@ -16,6 +25,9 @@ var (
 var DEBUG bool = false
 
 func main() {
+	selfTestOnly := flag.Bool("self-test", false, "Run the self-test, then exit with its result")
+	dumpConfig := flag.Bool("dump-config", false, "Print the effective configuration as JSON, with the secrets redacted, then exit")
+	flag.Parse()
 
 	shoveler.ShovelerVersion = version
 	shoveler.ShovelerCommit = commit
@@ -34,6 +46,15 @@ func main() {
 	config := shoveler.Config{}
 	config.ReadConfig()
 
+	if *dumpConfig {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(config.Dump()); err != nil {
+			logger.Fatalln("Failed to encode the configuration:", err)
+		}
+		return
+	}
+
 	if DEBUG || config.Debug {
 		logger.SetLevel(logrus.DebugLevel)
 	} else {
@@ -43,20 +64,95 @@ func main() {
 	// Log the version information
 	logrus.Infoln("Starting xrootd-monitoring-shoveler", version, "commit:", commit, "built on:", date, "built by:", builtBy)
 
+	// Start recording operational events
+	if config.EventsFile != "" {
+		shoveler.StartEvents(&config)
+	}
+	shoveler.EmitEvent(shoveler.EventStartup, shoveler.SeverityInfo, map[string]interface{}{"mq": config.MQ})
+
+	// Start recording the published messages
+	if config.JournalDir != "" {
+		shoveler.StartJournal(&config)
+	}
+
+	// Shutdown cleanly on SIGINT and SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Check the queue and the message bus before accepting packets
+	if config.SelfTest || *selfTestOnly {
+		if err := shoveler.RunSelfTest(ctx, &config); err != nil {
+			logger.Errorln(err)
+			os.Exit(1)
+		}
+		if *selfTestOnly {
+			fmt.Println("Self-test passed")
+			os.Exit(0)
+		}
+	}
+
 	// Start the message queue
 	cq := shoveler.NewConfirmationQueue(&config)
 
-	if config.MQ == "amqp" {
-		// Start the AMQP go func
-		go shoveler.StartAMQP(&config, cq)
-	} else if config.MQ == "stomp" {
-		// Start the STOMP go func
-		go shoveler.StartStomp(&config, cq)
+	// The publisher returns once the context is done
+	var publisher sync.WaitGroup
+	publisher.Add(1)
+	go func() {
+		defer publisher.Done()
+		if config.MQ == "amqp" {
+			// Start the AMQP go func
+			shoveler.StartAMQP(ctx, &config, cq)
+		} else if config.MQ == "stomp" {
+			// Start the STOMP go func
+			shoveler.StartStomp(ctx, &config, cq)
+		} else if config.MQ == "pubsub" {
+			// Start the Pub/Sub go func
+			shoveler.StartPubSub(ctx, &config, cq)
+		} else if config.MQ == "relay" {
+			// Start relaying to another shoveler
+			shoveler.StartRelay(ctx, &config, cq)
+		}
+	}()
+
+	// Accept messages relayed from other shovelers
+	var relayListener *shoveler.RelayListener
+	if config.RelayListen != "" {
+		var err error
+		relayListener, err = shoveler.ListenRelay(ctx, &config, cq)
+		if err != nil {
+			logger.Fatalln("Failed to listen for relayed messages:", err)
+		}
 	}
 
 	// Start the metrics
+	shoveler.ConfigureInvalidPackets(&config)
+	shoveler.ConfigureFaults(&config)
 	if config.Metrics {
-		shoveler.StartMetrics(config.MetricsPort)
+		shoveler.SetInfoMetric(&config)
+		shoveler.StartMetrics(&config)
+	}
+
+	// Start writing the status file
+	if config.StatusFile != "" {
+		go shoveler.StartStatusFile(ctx, &config, cq)
+	}
+
+	// Start the profiling endpoint
+	if config.Profile {
+		shoveler.StartProfile(config.ProfilePort)
+	}
+
+	// Start the debugging endpoints
+	if config.DebugServer {
+		shoveler.StartDebugServer(config.DebugPort)
+	}
+
+	// Only accept packets once they can be published
+	if config.WaitForOutput {
+		logger.Infoln("Waiting for the output to be connected before listening for packets")
+		if !shoveler.WaitForOutput(ctx, config.WaitTimeout) && ctx.Err() == nil {
+			logger.Warningln("The output is still not connected after", config.WaitTimeout, "listening for packets anyway")
+		}
 	}
 
 	// Process incoming UDP packets
@@ -71,19 +167,19 @@ func main() {
 		panic(err)
 	}
 
-	// Set the read buffer size to 1 MB
-	err = conn.SetReadBuffer(1024 * 1024)
-
-	if err != nil {
-		logger.Warningln("Failed to set read buffer size to 1 MB:", err)
-	}
+	// Set the read buffer size, 1 MB by default
+	shoveler.ConfigureUDPBuffer(conn, config.ReadBuffer)
+	go shoveler.MonitorUDPDrops(ctx, conn)
 
-	defer func(conn *net.UDPConn) {
+	// Closing the UDP connection stops the read loop below
+	go func() {
+		<-ctx.Done()
+		logger.Warningln("Shutting down the shoveler")
 		err := conn.Close()
 		if err != nil {
 			logger.Errorln("Error closing UDP connection:", err)
 		}
-	}(conn)
+	}()
 
 	// Create the UDP forwarding destinations
 	var udpDestinations []net.Conn
@@ -98,39 +194,85 @@ func main() {
 		}
 	}
 
+	// Errors repeat for every packet, only log them once a minute
+	readErrors := shoveler.NewRateLimitedLog(time.Minute)
+	forwardErrors := shoveler.NewRateLimitedLog(time.Minute)
+	proxyErrors := shoveler.NewRateLimitedLog(time.Minute)
+	enqueueErrors := shoveler.NewRateLimitedLog(time.Minute)
+
 	var buf [65536]byte
 	for {
 		rlen, remote, err := conn.ReadFromUDP(buf[:])
 		// Do stuff with the read bytes
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
 			// output errors
-			logger.Errorln("Failed to read from UDP connection:", err)
+			readErrors.Errorln("Failed to read from UDP connection:", err)
 			// If we failed to read from the UDP connection, I'm not
 			// sure what to do, maybe just continue as if nothing happened?
 			continue
 		}
 		shoveler.PacketsReceived.Inc()
-
-		if config.Verify && !shoveler.VerifyPacket(buf[:rlen]) {
-			shoveler.ValidationsFailed.Inc()
+		if shoveler.DropPacketFault() {
 			continue
 		}
 
-		msg := shoveler.PackageUdp(buf[:rlen], remote, &config)
+		packet := buf[:rlen]
+		if config.ProxyHeader {
+			var result string
+			packet, remote, result = shoveler.UnwrapProxyHeader(packet, remote, config.ProxySources)
+			shoveler.ProxyHeaders.WithLabelValues(result).Inc()
+			if result != shoveler.ProxyHeaderOk && result != shoveler.ProxyHeaderMissing {
+				proxyErrors.Warningln("Dropping packet with", result, "proxy header")
+				continue
+			}
+		}
+		shoveler.ActiveServers.Add(remote.IP.String())
+
+		if config.Verify {
+			packet = shoveler.TrimPadding(packet, remote, config.VerifyPadding)
+			if reason := shoveler.PacketError(packet); reason != "" {
+				// Scrubbed like the valid packets, the samples are served at /debug/invalid_packets
+				shoveler.RecordInvalidPacket(shoveler.ScrubPacket(packet, config.ScrubKeys), remote, reason)
+				continue
+			}
+		}
+
+		packet = shoveler.ScrubPacket(packet, config.ScrubKeys)
+		shoveler.TapPacket(packet, remote)
+		msg := shoveler.PackageUdp(packet, remote, &config)
 
 		// Send the message to the queue
 		logger.Debugln("Sending msg:", string(msg))
-		cq.Enqueue(msg)
+		if err := cq.Enqueue(msg); err != nil {
+			// Such as while the disk is full
+			shoveler.PacketsEnqueueFailed.Inc()
+			enqueueErrors.Errorln("Failed to enqueue the packet, dropping it:", err)
+		}
 
 		// Send to the UDP destinations
 		if len(udpDestinations) > 0 {
 			for _, udpConn := range udpDestinations {
 				_, err := udpConn.Write(msg)
 				if err != nil {
-					logger.Errorln("Failed to send message to UDP destination "+udpConn.RemoteAddr().String()+":", err)
+					forwardErrors.Errorln("Failed to send message to UDP destination "+udpConn.RemoteAddr().String()+":", err)
 				}
 			}
 		}
 
 	}
+
+	// Wait for the publisher and the relayed connections to stop, then keep the
+	// remaining messages on disk
+	if relayListener != nil {
+		relayListener.Wait()
+	}
+	publisher.Wait()
+	shoveler.CloseJournal()
+	if err := cq.Close(); err != nil {
+		logger.Errorln("Failed to close the queue:", err)
+	}
+	shoveler.CloseEvents()
 }
@@ -2,22 +2,27 @@ package shoveler
 
 import (
 	"fmt"
+	"net"
 	"net/url"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	MQ            string   // Which technology to use for the MQ connection
-	AmqpURL       *url.URL // AMQP URL (password comes from the token)
-	AmqpExchange  string   // Exchange to shovel messages
-	AmqpToken     string   // File location of the token
+	MQ            string            // Which technology to use for the MQ connection
+	AmqpURL       *url.URL          // AMQP URL (password comes from the token)
+	AmqpExchange  string            // Exchange to shovel messages
+	AmqpToken     string            // File location of the token
+	AmqpTokens    map[string]string // File location of the token for each exchange, overrides AmqpToken
 	ListenPort    int
 	ListenIp      string
 	DestUdp       []string
 	Debug         bool
 	Verify        bool
+	VerifyPadding int // Bytes a packet may exceed its header length by, truncated before verifying
 	StompUser     string
 	StompPassword string
 	StompURL      *url.URL
@@ -27,14 +32,86 @@ type Config struct {
 	StompCert     string
 	StompCertKey  string
 	QueueDir      string
+	QueueKeyFile  string // File of the hex encoded AES key encrypting the queue on disk, not encrypted if empty
 	IpMapAll      string
 	IpMap         map[string]string
+	StrictOrder   bool // Wait for broker confirmation of each message before sending the next
+	Profile       bool
+	ProfilePort   int
+	DebugServer   bool // Serve the debugging endpoints, which show the packets, on localhost
+	DebugPort     int
+
+	ListenLabel        string        // Label of the listener added to every message
+	ReadBuffer         int           // Requested size of the kernel receive buffer of the UDP socket
+	Compression        string        // Compression of the packets in the messages
+	Checksum           bool          // Add the checksum of the packet to the messages
+	PubSubProject      string        // Google Cloud project of the Pub/Sub topic
+	PubSubTopic        string        // Pub/Sub topic to publish messages
+	PubSubCredentials  string        // Service account key file, application default credentials if empty
+	PubSubEndpoint     string        // Pub/Sub API endpoint
+	PubSubOrdering     bool          // Use the remote of the message as the ordering key
+	PubSubBatchSize    int           // Maximum number of messages published at once
+	PubSubBatchDelay   time.Duration // Maximum time to wait to fill a batch
+	RelayDestination   string        // Address of the shoveler to relay messages to
+	RelayWindow        int           // Maximum number of relayed messages waiting for an acknowledgement
+	RelayTLS           bool          // Connect to the relay destination with TLS
+	RelayCA            string        // CA bundle to verify the relay destination, system roots if empty
+	RelayCert          string        // Client certificate for the relay destination
+	RelayCertKey       string        // Key of the client certificate for the relay destination
+	RelayListen        string        // Address to accept relayed messages from other shovelers, disabled if empty
+	RelayListenCert    string        // Server certificate for relayed messages, TLS is disabled if empty
+	RelayListenCertKey string        // Key of the server certificate for relayed messages
+	RelayListenCA      string        // CA bundle to verify the certificates of relaying shovelers
+	EventsFile         string        // Location of the operational events file, disabled if empty
+	StatusFile         string        // Location of the JSON status file, disabled if empty
+	StatusFileInterval time.Duration // How often to write the status file
+	TokenGracePeriod   time.Duration // How long the token may fail to be read before the shoveler exits
+	TokenRefreshCmd    []string      // Command run to refresh the token before it expires, disabled if empty
+	TokenExpiryWarning time.Duration // How long before the token expires to log warnings
+	TokenRefreshBefore time.Duration // How long before the token expires to run the refresh command
+	JournalDir         string        // Directory of the journal of published messages, disabled if empty
+	JournalMaxSize     int64         // Size in bytes of a journal file before a new one is started
+	JournalMaxFiles    int           // Number of journal files kept
+	WaitForOutput      bool          // Wait for the output to be connected before listening for packets
+	WaitTimeout        time.Duration // How long to wait for the output before listening anyway, forever if 0
+	AmqpStream         string        // RabbitMQ stream queue declared and bound to the exchange, disabled if empty
+	AmqpStreamBinding  string        // Binding key of the stream queue
+	AmqpStreamMaxBytes int64         // Maximum size of the stream in bytes, unlimited if 0
+	AmqpStreamMaxAge   string        // Maximum age of the messages in the stream, such as 7D, unlimited if empty
+	AmqpReconnectDelay time.Duration // Base delay between the attempts to connect to the AMQP server
+	AmqpReInitDelay    time.Duration // Base delay between the attempts to set up the AMQP channel
+	AmqpResendDelay    time.Duration // Base delay between the attempts to publish, and how long to wait for a confirm
+	AmqpMaxDelay       time.Duration // Maximum delay between the attempts, as they back off
+	InvalidSampleRate  int           // Keep 1 in every InvalidSampleRate invalid packets for debugging
+	InvalidSampleSize  int           // Maximum number of invalid packets kept
+	StompVHost         string        // Virtual host of the STOMP connection, the server's default if empty
+	StompHeartBeatSend time.Duration // Interval of the heart-beats sent to the STOMP server, disabled if 0
+	StompHeartBeatRecv time.Duration // Interval of the heart-beats expected from the STOMP server, disabled if 0
+	StompReceipt       bool          // Wait for a receipt of every message sent to the STOMP server
+	StompWindow        int           // Messages sent to the STOMP server waiting for their receipt at once
+	ScrubKeys          []string      // Keys of the user information blanked in 'u' and 'T' packets
+	ProxyHeader        bool          // Read the original source address from the proxy header of the packets
+	ProxySources       []*net.IPNet  // Sources trusted to send proxy headers, required with ProxyHeader
+	Faults             *Faults       // Faults injected for testing, nil unless enabled
+	MetricsInstance    string        // Value of the instance label added to every metric, not added if empty
+	MetricsLegacyNames bool          // Also export the counters under their names without the _total suffix
+	QueueMaintenance   time.Duration // How often to compact the queue on disk if it is worth it, disabled if 0
+	SummaryExchange    string        // AMQP exchange of the XML summary packets, the AmqpExchange if empty
+	SummaryTopic       string        // STOMP topic of the XML summary packets, the StompTopic if empty
+	SelfTest           bool          // Check the queue and publish a canary message at startup, exiting if it fails
+	SelfTestTimeout    time.Duration // How long the self-test may take before failing
+	SelfTestRoutingKey string        // Routing key of the canary message, or its topic with STOMP
+
+	StaticFields map[string]string // Site-defined fields added to every message, such as the federation
+
+	ConfigFile string    // Configuration file read, empty if only the environment was used
+	LoadedAt   time.Time // When the configuration was read
 }
 
 func (c *Config) ReadConfig() {
 	viper.SetConfigName("config")                            // name of config file (without extension)
 	viper.SetConfigType("yaml")                              // REQUIRED if the config file does not have the extension in the name
-	viper.AddConfigPath("/etc/xrootd-monitoring-shoveler/")  // path to look for the config file in
+	viper.AddConfigPath(defaultConfigDir())                  // path to look for the config file in
 	viper.AddConfigPath("$HOME/.xrootd-monitoring-shoveler") // call multiple times to add many search paths
 	viper.AddConfigPath(".")                                 // optionally look for config in the working directory
 	viper.AddConfigPath("config/")
@@ -42,6 +119,8 @@ func (c *Config) ReadConfig() {
 	if err != nil {             // Handle errors reading the config file
 		log.Warningln("Unable to read in config file, will check environment for configuration:", err)
 	}
+	c.ConfigFile = viper.ConfigFileUsed()
+	c.LoadedAt = time.Now()
 	viper.SetEnvPrefix("SHOVELER")
 
 	// Autmatically look to the ENV for all "Gets"
@@ -54,7 +133,7 @@ func (c *Config) ReadConfig() {
 
 	if c.MQ == "amqp" {
 		viper.SetDefault("amqp.exchange", "shoveled-xrd")
-		viper.SetDefault("amqp.token_location", "/etc/xrootd-monitoring-shoveler/token")
+		viper.SetDefault("amqp.token_location", filepath.Join(defaultConfigDir(), "token"))
 
 		// Get the AMQP URL
 		c.AmqpURL, err = url.Parse(viper.GetString("amqp.url"))
@@ -67,9 +146,56 @@ func (c *Config) ReadConfig() {
 		c.AmqpExchange = viper.GetString("amqp.exchange")
 		log.Debugln("AMQP Exchange:", c.AmqpExchange)
 
+		// Get the exchange of the summary packets, published with the others if not set
+		c.SummaryExchange = viper.GetString("amqp.summary_exchange")
+		if c.SummaryExchange != "" {
+			log.Debugln("AMQP Summary Exchange:", c.SummaryExchange)
+		}
+
 		// Get the Token location
 		c.AmqpToken = viper.GetString("amqp.token_location")
 		log.Debugln("AMQP Token location:", c.AmqpToken)
+
+		// How long the token file may be missing or unreadable, for example while it is replaced
+		viper.SetDefault("amqp.token_grace_period", 300)
+		c.TokenGracePeriod = time.Duration(viper.GetInt("amqp.token_grace_period")) * time.Second
+		log.Debugln("AMQP Token grace period:", c.TokenGracePeriod)
+
+		viper.SetDefault("amqp.token_expiry_warning", 72)
+		c.TokenExpiryWarning = time.Duration(viper.GetInt("amqp.token_expiry_warning")) * time.Hour
+
+		// Command to refresh the token before it expires, such as htgettoken
+		c.TokenRefreshCmd = viper.GetStringSlice("amqp.token_refresh_command")
+		viper.SetDefault("amqp.token_refresh_before", 10)
+		c.TokenRefreshBefore = time.Duration(viper.GetInt("amqp.token_refresh_before")) * time.Minute
+		log.Debugln("AMQP Token refresh command:", c.TokenRefreshCmd, "before expiry:", c.TokenRefreshBefore)
+
+		// Get the per exchange token locations
+		c.AmqpTokens = viper.GetStringMapString("amqp.tokens")
+		for exchange, tokenLocation := range c.AmqpTokens {
+			log.Debugln("AMQP Token location for exchange", exchange+":", tokenLocation)
+		}
+
+		// Get the RabbitMQ stream the exchange is bound to
+		c.AmqpStream = viper.GetString("amqp.stream.queue")
+		c.AmqpStreamBinding = viper.GetString("amqp.stream.binding_key")
+		c.AmqpStreamMaxBytes = viper.GetInt64("amqp.stream.max_length_bytes")
+		c.AmqpStreamMaxAge = viper.GetString("amqp.stream.max_age")
+		if c.AmqpStream != "" {
+			log.Debugln("AMQP Stream:", c.AmqpStream)
+		}
+
+		// Delays between the attempts to connect and publish, backing off with jitter
+		viper.SetDefault("amqp.reconnect_delay", int(reconnectDelay/time.Second))
+		c.AmqpReconnectDelay = time.Duration(viper.GetInt("amqp.reconnect_delay")) * time.Second
+		viper.SetDefault("amqp.reinit_delay", int(reInitDelay/time.Second))
+		c.AmqpReInitDelay = time.Duration(viper.GetInt("amqp.reinit_delay")) * time.Second
+		viper.SetDefault("amqp.resend_delay", int(resendDelay/time.Second))
+		c.AmqpResendDelay = time.Duration(viper.GetInt("amqp.resend_delay")) * time.Second
+		viper.SetDefault("amqp.max_delay", int(maxRetryDelay/time.Second))
+		c.AmqpMaxDelay = time.Duration(viper.GetInt("amqp.max_delay")) * time.Second
+		log.Debugln("AMQP Delays: reconnect", c.AmqpReconnectDelay, "reinit", c.AmqpReInitDelay,
+			"resend", c.AmqpResendDelay, "max", c.AmqpMaxDelay)
 	} else if c.MQ == "stomp" {
 		viper.SetDefault("stomp.topic", "xrootd.shoveler")
 
@@ -86,6 +212,10 @@ func (c *Config) ReadConfig() {
 
 		c.StompTopic = viper.GetString("stomp.topic")
 		log.Debugln("STOMP Topic:", c.StompTopic)
+		c.SummaryTopic = viper.GetString("stomp.summary_topic")
+		if c.SummaryTopic != "" {
+			log.Debugln("STOMP Summary Topic:", c.SummaryTopic)
+		}
 
 		// Get the STOMP cert
 		c.StompCert = viper.GetString("stomp.cert")
@@ -94,13 +224,101 @@ func (c *Config) ReadConfig() {
 		// Get the STOMP certkey
 		c.StompCertKey = viper.GetString("stomp.certkey")
 		log.Debugln("STOMP CERTKEY:", c.StompCertKey)
+
+		// Get the STOMP connection options
+		c.StompVHost = viper.GetString("stomp.vhost")
+		viper.SetDefault("stomp.heartbeat_send", 60000)
+		c.StompHeartBeatSend = time.Duration(viper.GetInt("stomp.heartbeat_send")) * time.Millisecond
+		viper.SetDefault("stomp.heartbeat_receive", 60000)
+		c.StompHeartBeatRecv = time.Duration(viper.GetInt("stomp.heartbeat_receive")) * time.Millisecond
+		viper.SetDefault("stomp.receipt", true)
+		c.StompReceipt = viper.GetBool("stomp.receipt")
+		viper.SetDefault("stomp.window", 1)
+		c.StompWindow = viper.GetInt("stomp.window")
+		log.Debugln("STOMP VHost:", c.StompVHost, "Heart-beats:", c.StompHeartBeatSend, c.StompHeartBeatRecv, "Receipts:", c.StompReceipt, "Window:", c.StompWindow)
+	} else if c.MQ == "pubsub" {
+		viper.SetDefault("pubsub.topic", "shoveled-xrd")
+		viper.SetDefault("pubsub.endpoint", "https://pubsub.googleapis.com")
+		viper.SetDefault("pubsub.ordering", false)
+		viper.SetDefault("pubsub.batch_size", 100)
+		viper.SetDefault("pubsub.batch_delay", 100)
+
+		c.PubSubProject = viper.GetString("pubsub.project")
+		log.Debugln("Pub/Sub Project:", c.PubSubProject)
+		c.PubSubTopic = viper.GetString("pubsub.topic")
+		log.Debugln("Pub/Sub Topic:", c.PubSubTopic)
+		c.PubSubCredentials = viper.GetString("pubsub.credentials")
+		log.Debugln("Pub/Sub Credentials:", c.PubSubCredentials)
+		c.PubSubEndpoint = viper.GetString("pubsub.endpoint")
+		log.Debugln("Pub/Sub Endpoint:", c.PubSubEndpoint)
+		c.PubSubOrdering = viper.GetBool("pubsub.ordering")
+		c.PubSubBatchSize = viper.GetInt("pubsub.batch_size")
+		if c.PubSubBatchSize < 1 {
+			c.PubSubBatchSize = 1
+		} else if c.PubSubBatchSize > pubsubMaxBatchSize {
+			log.Warningln("pubsub.batch_size", c.PubSubBatchSize, "is above the limit of the Pub/Sub API, using", pubsubMaxBatchSize)
+			c.PubSubBatchSize = pubsubMaxBatchSize
+		}
+		c.PubSubBatchDelay = time.Duration(viper.GetInt("pubsub.batch_delay")) * time.Millisecond
+	} else if c.MQ == "relay" {
+		viper.SetDefault("relay.window", 100)
+
+		c.RelayDestination = viper.GetString("relay.destination")
+		log.Debugln("Relay destination:", c.RelayDestination)
+		c.RelayWindow = viper.GetInt("relay.window")
+		if c.RelayWindow < 1 {
+			c.RelayWindow = 1
+		}
+		c.RelayTLS = viper.GetBool("relay.tls")
+		c.RelayCA = viper.GetString("relay.ca")
+		c.RelayCert = viper.GetString("relay.cert")
+		c.RelayCertKey = viper.GetString("relay.certkey")
 	} else {
-		log.Panic("MQ option is not one of the allowed ones (amqp, stomp)")
+		log.Panic("MQ option is not one of the allowed ones (amqp, stomp, pubsub, relay)")
 	}
+
+	// Accept messages relayed by other shovelers
+	c.RelayListen = viper.GetString("relay.listen")
+	c.RelayListenCert = viper.GetString("relay.listen_cert")
+	c.RelayListenCertKey = viper.GetString("relay.listen_certkey")
+	c.RelayListenCA = viper.GetString("relay.listen_ca")
 	// Get the UDP listening parameters
 	viper.SetDefault("listen.port", 9993)
 	c.ListenPort = viper.GetInt("listen.port")
 	c.ListenIp = viper.GetString("listen.ip")
+	c.ListenLabel = viper.GetString("listen.label")
+	c.StaticFields = viper.GetStringMapString("static_fields")
+	if len(c.StaticFields) == 0 {
+		c.StaticFields = nil
+	}
+	viper.SetDefault("listen.proxy_header", false)
+	c.ProxyHeader = viper.GetBool("listen.proxy_header")
+	// An invalid source must not leave the headers trusted from any source
+	c.ProxySources, err = parseProxySources(viper.GetStringSlice("listen.proxy_sources"))
+	if err != nil {
+		panic(fmt.Errorf("Fatal error parsing listen.proxy_sources: %s \n", err))
+	}
+	// Trusting any source would let any host spoof the address of a server
+	if c.ProxyHeader && len(c.ProxySources) == 0 {
+		panic(fmt.Errorf("Fatal error: listen.proxy_header is set without listen.proxy_sources, set them to the load balancers \n"))
+	}
+	viper.SetDefault("listen.read_buffer", 1024*1024)
+	c.ReadBuffer = viper.GetInt("listen.read_buffer")
+	viper.SetDefault("listen.wait_for_output", false)
+	c.WaitForOutput = viper.GetBool("listen.wait_for_output")
+	viper.SetDefault("listen.wait_timeout", 300)
+	c.WaitTimeout = time.Duration(viper.GetInt("listen.wait_timeout")) * time.Second
+
+	viper.SetDefault("checksum", false)
+	c.Checksum = viper.GetBool("checksum")
+
+	c.Compression = viper.GetString("compression")
+	if c.Compression == "none" {
+		c.Compression = ""
+	} else if c.Compression != "" && c.Compression != CompressionGzip {
+		log.Warningln("Unknown compression", c.Compression, "the messages will not be compressed")
+		c.Compression = ""
+	}
 
 	c.DestUdp = viper.GetStringSlice("outputs.destinations")
 
@@ -108,20 +326,138 @@ func (c *Config) ReadConfig() {
 
 	viper.SetDefault("verify", true)
 	c.Verify = viper.GetBool("verify")
+	viper.SetDefault("verify_padding", 0)
+	c.VerifyPadding = viper.GetInt("verify_padding")
+
+	c.ScrubKeys = scrubKeys(viper.GetStringSlice("scrub.fields"))
+	log.Debugln("Scrubbed fields:", c.ScrubKeys)
+
+	// Fault injection, only for testing
+	if viper.GetBool("faults.enable") {
+		c.Faults = &Faults{
+			DropPacket:     viper.GetFloat64("faults.drop_packet"),
+			DelayPublish:   viper.GetFloat64("faults.delay_publish"),
+			PublishDelay:   time.Duration(viper.GetInt("faults.publish_delay")) * time.Millisecond,
+			FailQueueWrite: viper.GetFloat64("faults.fail_queue_write"),
+			ForceReconnect: viper.GetFloat64("faults.force_reconnect"),
+		}
+	}
 
 	// Metrics defaults
 	viper.SetDefault("metrics.enable", true)
 	c.Metrics = viper.GetBool("metrics.enable")
 	viper.SetDefault("metrics.port", 8000)
 	c.MetricsPort = viper.GetInt("metrics.port")
+	c.MetricsInstance = viper.GetString("metrics.instance")
+	viper.SetDefault("metrics.legacy_names", true)
+	c.MetricsLegacyNames = viper.GetBool("metrics.legacy_names")
+
+	// Profile defaults
+	viper.SetDefault("profile.enable", false)
+	c.Profile = viper.GetBool("profile.enable")
+	viper.SetDefault("profile.port", 6060)
+	c.ProfilePort = viper.GetInt("profile.port")
+
+	// Debug server defaults
+	viper.SetDefault("debug_server.enable", false)
+	c.DebugServer = viper.GetBool("debug_server.enable")
+	viper.SetDefault("debug_server.port", 6061)
+	c.DebugPort = viper.GetInt("debug_server.port")
+
+	c.EventsFile = viper.GetString("events.file")
+
+	// Status file defaults
+	c.StatusFile = viper.GetString("status_file.path")
+	viper.SetDefault("status_file.interval", 30)
+	c.StatusFileInterval = time.Duration(viper.GetInt("status_file.interval")) * time.Second
+	if c.StatusFileInterval <= 0 {
+		log.Warningln("status_file.interval", viper.GetInt("status_file.interval"), "is not positive, using 30 seconds")
+		c.StatusFileInterval = 30 * time.Second
+	}
+
+	// Sampling of the invalid packets
+	viper.SetDefault("invalid_packets.sample_rate", 100)
+	c.InvalidSampleRate = viper.GetInt("invalid_packets.sample_rate")
+	viper.SetDefault("invalid_packets.sample_size", 50)
+	c.InvalidSampleSize = viper.GetInt("invalid_packets.sample_size")
+
+	// Self-test defaults
+	viper.SetDefault("self_test.enable", false)
+	c.SelfTest = viper.GetBool("self_test.enable")
+	viper.SetDefault("self_test.timeout", 30)
+	c.SelfTestTimeout = time.Duration(viper.GetInt("self_test.timeout")) * time.Second
+	viper.SetDefault("self_test.routing_key", "shoveler.self-test")
+	c.SelfTestRoutingKey = viper.GetString("self_test.routing_key")
+
+	// Journal defaults
+	c.JournalDir = viper.GetString("journal.dir")
+	viper.SetDefault("journal.max_size", 100)
+	c.JournalMaxSize = viper.GetInt64("journal.max_size") * 1024 * 1024
+	viper.SetDefault("journal.max_files", 10)
+	c.JournalMaxFiles = viper.GetInt("journal.max_files")
 
-	viper.SetDefault("queue_directory", "/var/spool/xrootd-monitoring-shoveler/queue")
+	viper.SetDefault("strict_ordering", false)
+	c.StrictOrder = viper.GetBool("strict_ordering")
+
+	viper.SetDefault("queue_directory", defaultQueueDir())
 	c.QueueDir = viper.GetString("queue_directory")
+	c.QueueKeyFile = viper.GetString("queue_encryption_key_file")
+	viper.SetDefault("queue_maintenance_interval", 60)
+	c.QueueMaintenance = time.Duration(viper.GetInt("queue_maintenance_interval")) * time.Minute
 
 	// Configure the mapper
 	// First, check for the map environment variable
-	c.IpMapAll = viper.GetString("map.all")
+	c.IpMapAll = NormalizeIP(viper.GetString("map.all"))
 
 	// If the map is not set
-	c.IpMap = viper.GetStringMapString("map")
+	c.IpMap = normalizeIPMap(viper.GetStringMapString("map"))
+}
+
+// TokenLocation returns the location of the token used to publish to the exchange.
+// A token configured for the exchange in amqp.tokens takes precedence over amqp.token_location.
+func (c *Config) TokenLocation(exchange string) string {
+	// Viper lower cases the keys of maps read from the configuration
+	for _, name := range []string{exchange, strings.ToLower(exchange)} {
+		if tokenLocation, ok := c.AmqpTokens[name]; ok && tokenLocation != "" {
+			return tokenLocation
+		}
+	}
+	return c.AmqpToken
+}
+
+// TokenLocations returns the file locations of the tokens of the exchanges the
+// shoveler publishes to, without duplicates
+func (c *Config) TokenLocations() []string {
+	exchanges := []string{c.AmqpExchange}
+	if c.SummaryExchange != "" {
+		exchanges = append(exchanges, c.SummaryExchange)
+	}
+	var locations []string
+	for _, exchange := range exchanges {
+		location := c.TokenLocation(exchange)
+		found := false
+		for _, existing := range locations {
+			if existing == location {
+				found = true
+				break
+			}
+		}
+		if !found {
+			locations = append(locations, location)
+		}
+	}
+	return locations
+}
+
+// parseProxySources parses the networks trusted to send proxy headers
+func parseProxySources(sources []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, source := range sources {
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
 }
@@ -0,0 +1,46 @@
+package shoveler
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenLocation(t *testing.T) {
+	var yamlExample = []byte(`
+amqp:
+  url: amqps://example.com/vhost
+  token_location: /etc/xrootd-monitoring-shoveler/token
+  tokens:
+    Shoveled-Summary: /etc/xrootd-monitoring-shoveler/summary-token
+`)
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(bytes.NewBuffer(yamlExample))
+	defer viper.Reset()
+	assert.NoError(t, err, "Failed to read config file")
+	config := Config{
+		AmqpToken:  viper.GetString("amqp.token_location"),
+		AmqpTokens: viper.GetStringMapString("amqp.tokens"),
+	}
+	assert.Equal(t, "/etc/xrootd-monitoring-shoveler/summary-token", config.TokenLocation("Shoveled-Summary"), "Token configured for the exchange")
+	assert.Equal(t, "/etc/xrootd-monitoring-shoveler/token", config.TokenLocation("shoveled-xrd"), "Default token for other exchanges")
+
+	config.AmqpExchange = "shoveled-xrd"
+	assert.Equal(t, []string{"/etc/xrootd-monitoring-shoveler/token"}, config.TokenLocations())
+	config.SummaryExchange = "Shoveled-Summary"
+	assert.Equal(t, []string{"/etc/xrootd-monitoring-shoveler/token", "/etc/xrootd-monitoring-shoveler/summary-token"},
+		config.TokenLocations())
+}
+
+func TestParseProxySources(t *testing.T) {
+	networks, err := parseProxySources([]string{"10.0.0.0/24", "2001:db8::/32"})
+	assert.NoError(t, err)
+	assert.Len(t, networks, 2)
+	assert.Equal(t, "10.0.0.0/24", networks[0].String())
+
+	// A typo must not leave the headers trusted from any source
+	_, err = parseProxySources([]string{"10.0.0.0/24", "10.0.0.300/24"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,97 @@
+package shoveler
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"time"
+)
+
+// redacted replaces the values of the secrets in the configuration dump
+const redacted = "REDACTED"
+
+// secretConfigFields are the fields of the Config redacted from the dump, the
+// passwords of the URLs are also redacted.  The token refresh command may have
+// credentials in its arguments, such as a client secret.
+var secretConfigFields = map[string]bool{
+	"StompPassword":   true,
+	"TokenRefreshCmd": true,
+}
+
+// ConfigDump is the effective configuration, after merging the configuration
+// file and the environment, with the secrets redacted
+type ConfigDump struct {
+	ConfigFile string                 `json:"config_file"` // Configuration file read, empty if only the environment was used
+	LoadedAt   time.Time              `json:"loaded_at"`
+	Config     map[string]interface{} `json:"config"`
+}
+
+// Dump returns the configuration, with the secrets redacted
+func (c *Config) Dump() *ConfigDump {
+	dump := ConfigDump{
+		ConfigFile: c.ConfigFile,
+		LoadedAt:   c.LoadedAt,
+		Config:     dumpStruct(reflect.ValueOf(c).Elem(), secretConfigFields),
+	}
+	// Already at the top of the dump
+	delete(dump.Config, "ConfigFile")
+	delete(dump.Config, "LoadedAt")
+	return &dump
+}
+
+// dumpStruct returns the exported fields of a struct, with the secrets redacted
+func dumpStruct(value reflect.Value, secrets map[string]bool) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if secrets[field.Name] && !value.Field(i).IsZero() {
+			fields[field.Name] = redacted
+			continue
+		}
+		fields[field.Name] = dumpValue(value.Field(i))
+	}
+	return fields
+}
+
+// dumpValue returns a value of the configuration as it is shown in the dump
+func dumpValue(value reflect.Value) interface{} {
+	switch v := value.Interface().(type) {
+	case *url.URL:
+		if v == nil {
+			return nil
+		}
+		return v.Redacted()
+	case time.Duration:
+		return v.String()
+	case []*net.IPNet:
+		networks := make([]string, 0, len(v))
+		for _, network := range v {
+			networks = append(networks, network.String())
+		}
+		return networks
+	}
+	if value.Kind() == reflect.Pointer && value.Type().Elem().Kind() == reflect.Struct {
+		if value.IsNil() {
+			return nil
+		}
+		return dumpStruct(value.Elem(), nil)
+	}
+	return value.Interface()
+}
+
+// configHandler serves the configuration dump as JSON
+func configHandler(config *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(config.Dump()); err != nil {
+			log.Errorln("Failed to encode the configuration:", err)
+		}
+	}
+}
@@ -5,14 +5,30 @@ import (
 )
 
 const (
-	// When reconnecting to the server after connection failure
+	// When reconnecting to the server after connection failure, the default of amqp.reconnect_delay
 	reconnectDelay = 5 * time.Second
 
-	// When setting up the channel after a channel exception
+	// When setting up the channel after a channel exception, the default of amqp.reinit_delay
 	reInitDelay = 2 * time.Second
 
-	// When resending messages the server didn't confirm
+	// When resending messages the server didn't confirm, the default of amqp.resend_delay
 	resendDelay = 5 * time.Second
+
+	// Maximum delay between the attempts of the AMQP session, the default of amqp.max_delay
+	maxRetryDelay = 5 * time.Minute
+
+	// How often to check the token file for changes
+	tokenCheckInterval = 10 * time.Second
+
+	// When checking the token file again after it failed to be read, doubled on each failure
+	tokenRetryDelay = 1 * time.Second
+
+	// How long the token refresh command may run, and how long to wait before running it again
+	tokenRefreshTimeout = 1 * time.Minute
+	tokenRefreshRetry   = 1 * time.Minute
+
+	// How often repeated errors, such as failures to publish, are logged
+	errorLogInterval = 1 * time.Minute
 )
 
 var (
@@ -0,0 +1,221 @@
+// Package consumer decodes the messages published by the shoveler, for Go
+// programs consuming them from the message bus.  Each message is a JSON
+// envelope of the XRootD monitoring packet, see the Message Format section of
+// the README.  Messages of other producers may instead carry the packet as the
+// body, with the remote and version in the message headers.
+package consumer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	stomp "github.com/go-stomp/stomp/v3"
+	shoveler "github.com/opensciencegrid/xrootd-monitoring-shoveler"
+	"github.com/streadway/amqp"
+)
+
+// Packet is an XRootD monitoring packet received by a shoveler
+type Packet struct {
+	Remote          string            // Address of the server that sent the packet, host:port with IPv6 hosts in brackets
+	ShovelerVersion string            // Version of the shoveler that received the packet
+	Received        time.Time         // When the packet was received, zero for messages of format version 1
+	Listener        string            // Label of the listener that received the packet
+	StaticFields    map[string]string // Site-defined fields of the shoveler that received the packet
+	Header          *shoveler.Header  // Header of the packet, nil for summary packets
+	Data            []byte            // The packet, decompressed, including the header
+}
+
+// Message headers read by DecodeWithHeaders, set by producers that publish the
+// packet as the body of the message rather than in a JSON envelope
+const (
+	HeaderRemote  = "remote"
+	HeaderVersion = "version"
+)
+
+// IsSummary returns true for the XML summary packets, which have no binary header
+func (p *Packet) IsSummary() bool {
+	return len(p.Data) > 0 && p.Data[0] == '<'
+}
+
+// Decode decodes a message published by the shoveler, of any format version.
+// Returns shoveler.ErrChecksumMismatch if the packet does not match the checksum
+// of the message, counted in shoveler.MessageChecksumMismatches.
+func Decode(message []byte) (*Packet, error) {
+	envelope, data, err := shoveler.UnpackageUdp(message)
+	if err != nil {
+		return nil, err
+	}
+	packet := Packet{
+		Remote:          envelope.Remote,
+		ShovelerVersion: envelope.ShovelerVersion,
+		Listener:        envelope.Listener,
+		StaticFields:    envelope.StaticFields,
+		Data:            data,
+	}
+	if envelope.ReceivedTs != 0 {
+		packet.Received = time.UnixMilli(envelope.ReceivedTs)
+	}
+	if err := packet.parseHeader(); err != nil {
+		return nil, err
+	}
+	return &packet, nil
+}
+
+// DecodeWithHeaders decodes a message along with its headers.  A message that
+// is not a JSON envelope is the packet itself, with the remote and version
+// taken from the HeaderRemote and HeaderVersion headers.  For an envelope, the
+// headers are only used if the envelope does not have the field.
+func DecodeWithHeaders(message []byte, headers map[string]string) (*Packet, error) {
+	if trimmed := bytes.TrimSpace(message); len(trimmed) > 0 && trimmed[0] == '{' {
+		packet, err := Decode(message)
+		if err != nil {
+			return nil, err
+		}
+		if packet.Remote == "" {
+			packet.Remote = headers[HeaderRemote]
+		}
+		if packet.ShovelerVersion == "" {
+			packet.ShovelerVersion = headers[HeaderVersion]
+		}
+		return packet, nil
+	}
+	if headers[HeaderRemote] == "" {
+		return nil, errors.New("the message is not a JSON envelope and has no remote header")
+	}
+	packet := Packet{
+		Remote:          headers[HeaderRemote],
+		ShovelerVersion: headers[HeaderVersion],
+		Data:            message,
+	}
+	if err := packet.parseHeader(); err != nil {
+		return nil, err
+	}
+	return &packet, nil
+}
+
+// parseHeader parses the XRootD header of the packet, unless it is a summary
+func (p *Packet) parseHeader() error {
+	if p.IsSummary() {
+		return nil
+	}
+	if len(p.Data) < 8 {
+		return fmt.Errorf("packet of %d bytes is too short for the XRootD header", len(p.Data))
+	}
+	p.Header = &shoveler.Header{
+		Code:        p.Data[0],
+		Pseq:        p.Data[1],
+		Plen:        binary.BigEndian.Uint16(p.Data[2:4]),
+		ServerStart: int32(binary.BigEndian.Uint32(p.Data[4:8])),
+	}
+	return nil
+}
+
+// amqpHeaders returns the string headers of an AMQP message read by DecodeWithHeaders
+func amqpHeaders(table amqp.Table) map[string]string {
+	headers := make(map[string]string)
+	for _, key := range []string{HeaderRemote, HeaderVersion} {
+		switch value := table[key].(type) {
+		case string:
+			headers[key] = value
+		case []byte:
+			headers[key] = string(value)
+		}
+	}
+	return headers
+}
+
+// stompHeaders returns the headers of a STOMP message read by DecodeWithHeaders
+func stompHeaders(msg *stomp.Message) map[string]string {
+	headers := make(map[string]string)
+	for _, key := range []string{HeaderRemote, HeaderVersion} {
+		if value, ok := msg.Header.Contains(key); ok {
+			headers[key] = value
+		}
+	}
+	return headers
+}
+
+// StreamAMQP consumes the messages of the AMQP queue, and calls fn with each
+// decoded packet, until the context is done or fn returns an error.  Messages
+// are acknowledged once fn returns, and messages that cannot be decoded are
+// rejected without being requeued.
+func StreamAMQP(ctx context.Context, amqpURL string, queue string, fn func(*Packet) error) error {
+	conn, err := amqp.Dial(amqpURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return errors.New("the AMQP channel was closed")
+			}
+			packet, err := DecodeWithHeaders(delivery.Body, amqpHeaders(delivery.Headers))
+			if err != nil {
+				_ = delivery.Reject(false)
+				continue
+			}
+			if err := fn(packet); err != nil {
+				_ = delivery.Nack(false, true)
+				return err
+			}
+			if err := delivery.Ack(false); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// StreamSTOMP subscribes to the STOMP destination, and calls fn with each
+// decoded packet, until the context is done or fn returns an error.  Messages
+// are acknowledged once fn returns, and messages that cannot be decoded are
+// skipped.
+func StreamSTOMP(ctx context.Context, address string, username string, password string, destination string, fn func(*Packet) error) error {
+	conn, err := stomp.Dial("tcp", address, stomp.ConnOpt.Login(username, password))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Disconnect() }()
+	sub, err := conn.Subscribe(destination, stomp.AckClientIndividual)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-sub.C:
+			if !ok {
+				return errors.New("the STOMP subscription was closed")
+			}
+			if msg.Err != nil {
+				return msg.Err
+			}
+			packet, err := DecodeWithHeaders(msg.Body, stompHeaders(msg))
+			if err == nil {
+				if err := fn(packet); err != nil {
+					return err
+				}
+			}
+			if err := conn.Ack(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package consumer
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	shoveler "github.com/opensciencegrid/xrootd-monitoring-shoveler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecode(t *testing.T) {
+	data := make([]byte, 16)
+	data[0] = 'f'
+	data[1] = 3
+	binary.BigEndian.PutUint16(data[2:4], 16)
+	binary.BigEndian.PutUint32(data[4:8], 1700000000)
+	remote := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 1234}
+
+	for _, compression := range []string{"", shoveler.CompressionGzip} {
+		config := shoveler.Config{Compression: compression, ListenLabel: "site-a", Checksum: true}
+		packet, err := Decode(shoveler.PackageUdp(data, remote, &config))
+		assert.NoError(t, err)
+		assert.Equal(t, "192.0.2.10:1234", packet.Remote)
+		assert.Equal(t, "site-a", packet.Listener)
+		assert.False(t, packet.Received.IsZero())
+		assert.Equal(t, data, packet.Data)
+		assert.Equal(t, &shoveler.Header{Code: 'f', Pseq: 3, Plen: 16, ServerStart: 1700000000}, packet.Header)
+	}
+
+	// Format version 1 messages, and summary packets without a header
+	packet, err := Decode([]byte(`{"remote":"192.0.2.10:1234","version":"1.0.0","data":"PHN0YXRpc3RpY3M+"}`))
+	assert.NoError(t, err)
+	assert.True(t, packet.IsSummary())
+	assert.Nil(t, packet.Header)
+	assert.True(t, packet.Received.IsZero())
+
+	_, err = Decode([]byte(`{"remote":"192.0.2.10:1234","data":"AAE="}`))
+	assert.Error(t, err, "Too short for the header")
+
+	_, err = Decode([]byte(`{"remote":"192.0.2.10:1234","data":"PHN0YXRpc3RpY3M+","checksum":"xxh64:0000000000000000"}`))
+	assert.ErrorIs(t, err, shoveler.ErrChecksumMismatch)
+}
+
+func TestDecodeWithHeaders(t *testing.T) {
+	data := make([]byte, 16)
+	data[0] = 'f'
+	binary.BigEndian.PutUint16(data[2:4], 16)
+	binary.BigEndian.PutUint32(data[4:8], 1700000000)
+	headers := map[string]string{HeaderRemote: "[2001:db8::1]:1234", HeaderVersion: "producer-1.0"}
+
+	// The packet as the body of the message
+	packet, err := DecodeWithHeaders(data, headers)
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:1234", packet.Remote)
+	assert.Equal(t, "producer-1.0", packet.ShovelerVersion)
+	assert.Equal(t, data, packet.Data)
+	assert.Equal(t, &shoveler.Header{Code: 'f', Plen: 16, ServerStart: 1700000000}, packet.Header)
+
+	_, err = DecodeWithHeaders(data, nil)
+	assert.Error(t, err, "No remote header")
+
+	// The envelope fields are kept, the headers fill the missing ones
+	packet, err = DecodeWithHeaders([]byte(`{"remote":"192.0.2.10:1234","data":"PHN0YXRpc3RpY3M+"}`), headers)
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.10:1234", packet.Remote)
+	assert.Equal(t, "producer-1.0", packet.ShovelerVersion)
+	assert.True(t, packet.IsSummary())
+}
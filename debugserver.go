@@ -0,0 +1,27 @@
+package shoveler
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// StartDebugServer serves the debugging endpoints on localhost.  They show the
+// packets received, which include user identities and file paths, so they
+// are not exposed with the metrics.
+func StartDebugServer(debugPort int) {
+
+	// Listen to the debugging requests in a separate thread
+	go func() {
+		listenAddress := "localhost:" + strconv.Itoa(debugPort)
+		log.Debugln("Starting the debugging endpoints at " + listenAddress + "/debug/")
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/invalid_packets", invalidPacketsHandler)
+		mux.HandleFunc("/debug/packets", livePacketsHandler)
+		err := http.ListenAndServe(listenAddress, mux)
+		if err != nil {
+			log.Errorln("Failed to listen and serve the debugging endpoints:", err)
+			return
+		}
+	}()
+
+}
@@ -0,0 +1,123 @@
+package shoveler
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Severities of the operational events
+const (
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// Types of the operational events
+const (
+	EventStartup          = "startup"
+	EventQueueSpill       = "queue_spill"
+	EventQueueRestore     = "queue_restore"
+	EventTokenRotated     = "token_rotated"
+	EventTokenReadFailure = "token_read_failure"
+	EventMQConnected      = "mq_connected"
+	EventMQDisconnected   = "mq_disconnected"
+	EventMQBlocked        = "mq_blocked"
+	EventMQUnblocked      = "mq_unblocked"
+	EventSelfTest         = "self_test"
+)
+
+// Event is an operational event, written as a line of JSON to the events file,
+// so that operations tooling does not have to scrape the logs
+type Event struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Type      string                 `json:"type"`
+	Severity  string                 `json:"severity"`
+	Hostname  string                 `json:"hostname"`
+	Version   string                 `json:"version"`
+	Context   map[string]interface{} `json:"context,omitempty"`
+}
+
+// eventWriter writes the events emitted to the events file
+type eventWriter struct {
+	mutex  sync.RWMutex // Held to send the events, so they are not sent once the channel is closed
+	events chan *Event
+	closed bool
+	done   chan struct{} // Closed once the events are written and the file closed
+}
+
+// events is nil until StartEvents is called, so events are only recorded when configured
+var events atomic.Pointer[eventWriter]
+
+// StartEvents opens the events file and starts writing the events emitted to it
+func StartEvents(config *Config) {
+	eventsFile, err := os.OpenFile(config.EventsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Errorln("Failed to open the events file, events will not be recorded:", err)
+		return
+	}
+	writer := &eventWriter{events: make(chan *Event, 100), done: make(chan struct{})}
+	go writer.write(eventsFile)
+	events.Store(writer)
+}
+
+// CloseEvents stops recording the events, once the events emitted are written
+func CloseEvents() {
+	writer := events.Swap(nil)
+	if writer == nil {
+		return
+	}
+	writer.mutex.Lock()
+	writer.closed = true
+	close(writer.events)
+	writer.mutex.Unlock()
+	<-writer.done
+}
+
+func (writer *eventWriter) write(eventsFile *os.File) {
+	defer close(writer.done)
+	encoder := json.NewEncoder(eventsFile)
+	for event := range writer.events {
+		if err := encoder.Encode(event); err != nil {
+			log.Errorln("Failed to write event to the events file:", err)
+		}
+	}
+	if err := eventsFile.Close(); err != nil {
+		log.Errorln("Failed to close the events file:", err)
+	}
+}
+
+// send queues the event to be written, without blocking
+func (writer *eventWriter) send(event *Event) {
+	writer.mutex.RLock()
+	defer writer.mutex.RUnlock()
+	if writer.closed {
+		return
+	}
+	select {
+	case writer.events <- event:
+	default:
+		EventsDropped.Inc()
+	}
+}
+
+// EmitEvent records an operational event.  It never blocks, if the events
+// can not be written fast enough the event is dropped.
+func EmitEvent(eventType string, severity string, context map[string]interface{}) {
+	writer := events.Load()
+	if writer == nil {
+		return
+	}
+	hostname, _ := os.Hostname()
+	event := Event{
+		Timestamp: time.Now(),
+		Type:      eventType,
+		Severity:  severity,
+		Hostname:  hostname,
+		Version:   ShovelerVersion,
+		Context:   context,
+	}
+	writer.send(&event)
+}
@@ -0,0 +1,63 @@
+package shoveler
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestEmitEvent makes sure events are written as lines of JSON to the events file
+func TestEmitEvent(t *testing.T) {
+	eventsFile := path.Join(t.TempDir(), "events.jsonl")
+	StartEvents(&Config{EventsFile: eventsFile})
+	defer CloseEvents()
+
+	EmitEvent(EventQueueSpill, SeverityWarning, map[string]interface{}{"queue_size": 100})
+	EmitEvent(EventMQConnected, SeverityInfo, nil)
+
+	var written []Event
+	assert.Eventually(t, func() bool {
+		file, err := os.Open(eventsFile)
+		if err != nil {
+			return false
+		}
+		defer file.Close()
+		written = nil
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			event := Event{}
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+			written = append(written, event)
+		}
+		return len(written) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, EventQueueSpill, written[0].Type)
+	assert.Equal(t, SeverityWarning, written[0].Severity)
+	assert.Equal(t, float64(100), written[0].Context["queue_size"])
+	assert.Equal(t, EventMQConnected, written[1].Type)
+}
+
+// TestCloseEvents makes sure the events emitted are written once the events
+// are closed, and the events emitted after are ignored
+func TestCloseEvents(t *testing.T) {
+	eventsFile := path.Join(t.TempDir(), "events.jsonl")
+	StartEvents(&Config{EventsFile: eventsFile})
+	for i := 0; i < 10; i++ {
+		EmitEvent(EventMQConnected, SeverityInfo, nil)
+	}
+	CloseEvents()
+	EmitEvent(EventMQDisconnected, SeverityWarning, nil)
+	CloseEvents()
+
+	contents, err := os.ReadFile(eventsFile)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, strings.Count(string(contents), "\n"))
+	assert.NotContains(t, string(contents), EventMQDisconnected)
+}
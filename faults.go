@@ -0,0 +1,32 @@
+package shoveler
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Faults injects failures to test the resilience of the shoveler, such as in
+// CI.  Each fault happens with its probability, from 0 (never) to 1 (always).
+// The faults are only injected by a shoveler built with the faults build tag,
+// so a configuration can never inject them in the released binaries.
+type Faults struct {
+	DropPacket     float64       // Drop a received packet
+	DelayPublish   float64       // Delay a message before it is published
+	PublishDelay   time.Duration // How long a delayed message waits
+	FailQueueWrite float64       // Fail to add a message to the queue
+	ForceReconnect float64       // Close the connection to the message bus before publishing
+	mutex          sync.Mutex
+	random         *rand.Rand
+}
+
+// Names of the faults, used as the metric label
+const (
+	FaultDropPacket     = "drop_packet"
+	FaultDelayPublish   = "delay_publish"
+	FaultFailQueueWrite = "fail_queue_write"
+	FaultForceReconnect = "force_reconnect"
+)
+
+var errFaultInjected = errors.New("fault injected")
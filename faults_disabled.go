@@ -0,0 +1,28 @@
+//go:build !faults
+
+package shoveler
+
+import "time"
+
+// ConfigureFaults warns that the faults configured are not injected, the
+// shoveler is built without the faults build tag
+func ConfigureFaults(config *Config) {
+	if config.Faults != nil {
+		log.Warningln("Fault injection is configured, but the shoveler is built without it, no fault is injected")
+	}
+}
+
+// injectFault never injects a fault without the faults build tag
+func injectFault(name string) bool {
+	return false
+}
+
+// DropPacketFault returns true if the received packet should be dropped
+func DropPacketFault() bool {
+	return false
+}
+
+// delayPublishFault waits before a message is published, if the fault is injected
+func delayPublishFault() <-chan time.Time {
+	return nil
+}
@@ -0,0 +1,64 @@
+//go:build faults
+
+package shoveler
+
+import (
+	"math/rand"
+	"time"
+)
+
+// faults is nil unless enabled in the configuration, so no fault is ever injected in production
+var faults *Faults
+
+// ConfigureFaults enables the fault injection if configured
+func ConfigureFaults(config *Config) {
+	if config.Faults == nil {
+		faults = nil
+		return
+	}
+	log.Warningln("Fault injection is enabled, the shoveler will drop and delay messages on purpose")
+	faults = config.Faults
+	faults.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// injectFault returns true if the fault should happen now
+func injectFault(name string) bool {
+	if faults == nil {
+		return false
+	}
+	var probability float64
+	switch name {
+	case FaultDropPacket:
+		probability = faults.DropPacket
+	case FaultDelayPublish:
+		probability = faults.DelayPublish
+	case FaultFailQueueWrite:
+		probability = faults.FailQueueWrite
+	case FaultForceReconnect:
+		probability = faults.ForceReconnect
+	}
+	if probability <= 0 {
+		return false
+	}
+	faults.mutex.Lock()
+	injected := faults.random.Float64() < probability
+	faults.mutex.Unlock()
+	if injected {
+		FaultsInjected.WithLabelValues(name).Inc()
+		log.Debugln("Injecting fault", name)
+	}
+	return injected
+}
+
+// DropPacketFault returns true if the received packet should be dropped
+func DropPacketFault() bool {
+	return injectFault(FaultDropPacket)
+}
+
+// delayPublishFault waits before a message is published, if the fault is injected
+func delayPublishFault() <-chan time.Time {
+	if !injectFault(FaultDelayPublish) {
+		return nil
+	}
+	return time.After(faults.PublishDelay)
+}
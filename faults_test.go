@@ -0,0 +1,43 @@
+//go:build faults
+
+package shoveler
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaults(t *testing.T) {
+	defer ConfigureFaults(&Config{})
+
+	// Disabled by default
+	ConfigureFaults(&Config{})
+	assert.False(t, DropPacketFault())
+	assert.Nil(t, delayPublishFault())
+
+	ConfigureFaults(&Config{Faults: &Faults{DropPacket: 1, DelayPublish: 1, PublishDelay: time.Millisecond}})
+	assert.True(t, DropPacketFault())
+	delay := delayPublishFault()
+	assert.NotNil(t, delay)
+	<-delay
+	assert.False(t, injectFault(FaultForceReconnect), "Faults without a probability are never injected")
+}
+
+// TestFaultQueueWrite makes sure failed queue writes do not add the message
+func TestFaultQueueWrite(t *testing.T) {
+	defer ConfigureFaults(&Config{})
+	config := Config{QueueDir: path.Join(t.TempDir(), "shoveler-queue")}
+	queue := NewConfirmationQueue(&config)
+	defer queue.Close()
+
+	ConfigureFaults(&Config{Faults: &Faults{FailQueueWrite: 1}})
+	queue.Enqueue([]byte("lost"))
+	assert.Equal(t, 0, queue.Size())
+
+	ConfigureFaults(&Config{})
+	queue.Enqueue([]byte("kept"))
+	assert.Equal(t, 1, queue.Size())
+}
@@ -0,0 +1,25 @@
+package shoveler
+
+import (
+	"fmt"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// The hashes are computed for every packet, so they use xxhash, which is an
+// order of magnitude faster than the cryptographic hashes.  They are not
+// suitable where an attacker could craft collisions.
+
+// HashString returns the 64 bit hash of the string
+func HashString(s string) uint64 {
+	return xxhash.Sum64String(s)
+}
+
+// checksumPrefix names the hash function of the checksums in the message envelope
+const checksumPrefix = "xxh64:"
+
+// PayloadChecksum returns the checksum of a packet, as in the checksum field of
+// the message envelope, prefixed with the hash function
+func PayloadChecksum(packet []byte) string {
+	return checksumPrefix + fmt.Sprintf("%016x", xxhash.Sum64(packet))
+}
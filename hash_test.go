@@ -0,0 +1,36 @@
+package shoveler
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPayloadChecksum checks the checksum is prefixed and has a fixed length
+func TestPayloadChecksum(t *testing.T) {
+	packet := []byte("packet")
+	assert.Equal(t, PayloadChecksum(packet), PayloadChecksum(packet))
+	assert.NotEqual(t, PayloadChecksum(packet), PayloadChecksum([]byte("other")))
+	assert.Len(t, PayloadChecksum(packet), len(checksumPrefix)+16)
+}
+
+// benchmarkPacket is the size of a typical monitoring packet
+var benchmarkPacket = make([]byte, 1400)
+
+func BenchmarkPayloadChecksum(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkPacket)))
+	for i := 0; i < b.N; i++ {
+		PayloadChecksum(benchmarkPacket)
+	}
+}
+
+// BenchmarkPacketSHA256 is the cryptographic hash, for comparison
+func BenchmarkPacketSHA256(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkPacket)))
+	for i := 0; i < b.N; i++ {
+		hash := sha256.New()
+		hash.Write(benchmarkPacket)
+		hash.Sum(nil)
+	}
+}
@@ -0,0 +1,134 @@
+// Command schemagen writes the JSON Schema of the Message envelope, from the
+// fields of the struct and their comments.  Run by go generate in the
+// repository root.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"strings"
+
+	shoveler "github.com/opensciencegrid/xrootd-monitoring-shoveler"
+)
+
+// property is the schema of a field of the envelope
+type property struct {
+	Type                 string    `json:"type"`
+	Description          string    `json:"description,omitempty"`
+	AdditionalProperties *property `json:"additionalProperties,omitempty"`
+}
+
+type schema struct {
+	Schema      string              `json:"$schema"`
+	Title       string              `json:"title"`
+	Description string              `json:"description"`
+	Type        string              `json:"type"`
+	Properties  map[string]property `json:"properties"`
+	Required    []string            `json:"required"`
+}
+
+// comments returns the comments of the type, and of each of its fields, in the source file
+func comments(source string, typeName string) (string, map[string]string, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), source, nil, parser.ParseComments)
+	if err != nil {
+		return "", nil, err
+	}
+	fields := make(map[string]string)
+	for _, decl := range file.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range genDecl.Specs {
+			typeSpec := spec.(*ast.TypeSpec)
+			structType, ok := typeSpec.Type.(*ast.StructType)
+			if typeSpec.Name.Name != typeName || !ok {
+				continue
+			}
+			for _, field := range structType.Fields.List {
+				text := field.Doc.Text()
+				if field.Comment != nil {
+					text = field.Comment.Text()
+				}
+				for _, name := range field.Names {
+					fields[name.Name] = strings.Join(strings.Fields(text), " ")
+				}
+			}
+			return strings.Join(strings.Fields(genDecl.Doc.Text()), " "), fields, nil
+		}
+	}
+	return "", nil, fmt.Errorf("type %s not found in %s", typeName, source)
+}
+
+// typeProperty returns the schema of a Go type
+func typeProperty(t reflect.Type) (property, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return property{Type: "string"}, nil
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return property{Type: "integer"}, nil
+	case reflect.Bool:
+		return property{Type: "boolean"}, nil
+	case reflect.Map:
+		values, err := typeProperty(t.Elem())
+		if err != nil {
+			return property{}, err
+		}
+		return property{Type: "object", AdditionalProperties: &values}, nil
+	}
+	return property{}, fmt.Errorf("unsupported type %s", t)
+}
+
+func main() {
+	source := flag.String("source", "packageudp.go", "Go file defining the Message envelope")
+	output := flag.String("o", "schema/message.schema.json", "JSON Schema file to write")
+	flag.Parse()
+
+	doc, fieldDocs, err := comments(*source, "Message")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to read the comments:", err)
+		os.Exit(1)
+	}
+	messageSchema := schema{
+		Schema:      "https://json-schema.org/draft/2020-12/schema",
+		Title:       "Message",
+		Description: doc,
+		Type:        "object",
+		Properties:  make(map[string]property),
+		Required:    []string{},
+	}
+	messageType := reflect.TypeOf(shoveler.Message{})
+	for i := 0; i < messageType.NumField(); i++ {
+		field := messageType.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		prop, err := typeProperty(field.Type)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to describe the field", field.Name+":", err)
+			os.Exit(1)
+		}
+		prop.Description = fieldDocs[field.Name]
+		messageSchema.Properties[name] = prop
+		if options != "omitempty" {
+			messageSchema.Required = append(messageSchema.Required, name)
+		}
+	}
+
+	contents, err := json.MarshalIndent(messageSchema, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to encode the schema:", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*output, append(contents, '\n'), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to write the schema:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,496 @@
+package shoveler
+
+import (
+	"bufio"
+	"container/heap"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opensciencegrid/xrootd-monitoring-shoveler/queue"
+)
+
+// The journal records every published message, for audit and to republish
+// messages lost by the message bus.  Each journal file starts with the
+// journalMagic header, followed by records of:
+//
+//	4 byte length of the record body
+//	body: 8 byte timestamp (unix nanoseconds), 2 byte exchange length, exchange,
+//	      2 byte routing key length, routing key, message
+//	4 byte CRC32 of the body
+//
+// With the queue encryption key, files start with the journalEncryptedMagic
+// header instead, and the message of each record is the AES-GCM nonce followed
+// by the encrypted message.
+//
+// A new file is started once the current one reaches the maximum size, and
+// the oldest files are removed to keep at most the maximum number of files.
+const (
+	journalMagic          = "SHVJ\x01"
+	journalEncryptedMagic = "SHVJ\x02"
+	journalFilePrefix     = "journal-"
+	journalFileSuffix     = ".bin"
+	journalTimeFormat     = "20060102T150405.000000000Z"
+	maxJournalRecord      = 16 * 1024 * 1024
+
+	// How often the records written are flushed to the journal file
+	journalFlushInterval = 1 * time.Second
+)
+
+var (
+	errJournalFormat = errors.New("not a shoveler journal file")
+	errJournalNoKey  = errors.New("journal file is encrypted, but no key is configured")
+)
+
+// JournalRecord is a message published to the message bus
+type JournalRecord struct {
+	Timestamp  time.Time
+	Exchange   string
+	RoutingKey string
+	Message    []byte
+}
+
+// Journal writes the published messages to rotated files in a directory
+type Journal struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	mutex    sync.Mutex
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	aead     cipher.AEAD   // Encrypts the messages, nil if not encrypted
+	done     chan struct{} // Closed to stop flushing the records
+
+	flushInterval time.Duration // How often the records written are flushed
+}
+
+// journal is nil until StartJournal is called, so messages are only recorded when configured
+var journal *Journal
+
+// StartJournal opens the journal, and records the messages published from then
+// on, encrypted with the queue encryption key if configured
+func StartJournal(config *Config) {
+	var key []byte
+	if config.QueueKeyFile != "" {
+		var err error
+		if key, err = queue.ReadKeyFile(config.QueueKeyFile); err != nil {
+			log.Errorln("Failed to read the queue encryption key, published messages will not be recorded:", err)
+			return
+		}
+	}
+	newJournal, err := OpenJournal(config.JournalDir, config.JournalMaxSize, config.JournalMaxFiles, key)
+	if err != nil {
+		log.Errorln("Failed to open the journal, published messages will not be recorded:", err)
+		return
+	}
+	journal = newJournal
+}
+
+// CloseJournal closes the journal opened by StartJournal
+func CloseJournal() {
+	if journal == nil {
+		return
+	}
+	if err := journal.Close(); err != nil {
+		log.Errorln("Failed to close the journal:", err)
+	}
+}
+
+// JournalMessage records a message published to the exchange, if the journal is enabled
+func JournalMessage(exchange string, routingKey string, msg []byte) {
+	if journal == nil {
+		return
+	}
+	record := JournalRecord{Timestamp: time.Now(), Exchange: exchange, RoutingKey: routingKey, Message: msg}
+	if err := journal.Write(&record); err != nil {
+		log.Errorln("Failed to write the message to the journal:", err)
+	}
+}
+
+// OpenJournal creates the journal directory if needed, and starts a new
+// journal file.  The messages are encrypted with the key, if not empty.
+func OpenJournal(dir string, maxSize int64, maxFiles int, key []byte) (*Journal, error) {
+	aead, err := queue.NewAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	newJournal := &Journal{dir: dir, maxSize: maxSize, maxFiles: maxFiles, aead: aead, done: make(chan struct{}),
+		flushInterval: journalFlushInterval}
+	if err := newJournal.rotate(); err != nil {
+		return nil, err
+	}
+	go newJournal.flushLoop()
+	return newJournal, nil
+}
+
+// flushLoop flushes the records written every flush interval, rather than
+// every record, until the journal is closed
+func (j *Journal) flushLoop() {
+	ticker := time.NewTicker(j.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-ticker.C:
+			j.mutex.Lock()
+			if j.file != nil {
+				if err := j.writer.Flush(); err != nil {
+					log.Errorln("Failed to flush the journal:", err)
+				}
+			}
+			j.mutex.Unlock()
+		}
+	}
+}
+
+// Write appends the record to the journal, starting a new file if the current one is full
+func (j *Journal) Write(record *JournalRecord) error {
+	if len(record.Exchange) > 0xffff || len(record.RoutingKey) > 0xffff {
+		return errors.New("exchange or routing key too long for the journal")
+	}
+	message := record.Message
+	if j.aead != nil {
+		nonce := make([]byte, j.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		message = j.aead.Seal(nonce, nonce, message, nil)
+	}
+	body := make([]byte, 0, 12+len(record.Exchange)+len(record.RoutingKey)+len(message))
+	body = binary.BigEndian.AppendUint64(body, uint64(record.Timestamp.UnixNano()))
+	body = binary.BigEndian.AppendUint16(body, uint16(len(record.Exchange)))
+	body = append(body, record.Exchange...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(record.RoutingKey)))
+	body = append(body, record.RoutingKey...)
+	body = append(body, message...)
+	if len(body) > maxJournalRecord {
+		return errors.New("message too large for the journal")
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil {
+		return os.ErrClosed
+	}
+	if j.size > int64(len(journalMagic)) && j.size+int64(len(body))+8 > j.maxSize {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(body)))
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.ChecksumIEEE(body))
+	for _, part := range [][]byte{header, body, checksum} {
+		if _, err := j.writer.Write(part); err != nil {
+			return err
+		}
+	}
+	j.size += int64(len(body)) + 8
+	return nil
+}
+
+// rotate closes the current journal file, starts a new one, and removes the oldest files
+func (j *Journal) rotate() error {
+	if j.file != nil {
+		if err := j.closeFile(); err != nil {
+			return err
+		}
+	}
+	name := journalFilePrefix + time.Now().UTC().Format(journalTimeFormat) + journalFileSuffix
+	file, err := os.OpenFile(filepath.Join(j.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	magic := journalMagic
+	if j.aead != nil {
+		magic = journalEncryptedMagic
+	}
+	if _, err := file.WriteString(magic); err != nil {
+		file.Close()
+		return err
+	}
+	j.file = file
+	j.writer = bufio.NewWriter(file)
+	j.size = int64(len(magic))
+
+	files, err := JournalFiles(j.dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > j.maxFiles && j.maxFiles > 0 {
+		log.Debugln("Removing old journal file", files[0])
+		if err := os.Remove(files[0]); err != nil {
+			log.Errorln("Failed to remove old journal file:", err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+func (j *Journal) closeFile() error {
+	err := j.writer.Flush()
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+	j.file = nil
+	j.writer = nil
+	return err
+}
+
+// Close flushes and closes the current journal file
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	close(j.done)
+	return j.closeFile()
+}
+
+// JournalFiles returns the journal files in the directory, oldest first
+func JournalFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, journalFilePrefix) && strings.HasSuffix(name, journalFileSuffix) {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	// The file names start with the time they were created
+	sort.Strings(files)
+	return files, nil
+}
+
+// ReadJournal calls fn with each record in the journal directory published from
+// the start time, inclusive, until the end time, exclusive.  A zero time is
+// unbounded.  The key decrypts the messages of the encrypted journal files.
+func ReadJournal(dir string, key []byte, start time.Time, end time.Time, fn func(*JournalRecord) error) error {
+	return ReadJournals([]string{dir}, key, start, end, fn)
+}
+
+// ReadJournals is ReadJournal for the journals of several shovelers, calling fn
+// with the records of all the directories merged in the order they were published
+func ReadJournals(dirs []string, key []byte, start time.Time, end time.Time, fn func(*JournalRecord) error) error {
+	aead, err := queue.NewAEAD(key)
+	if err != nil {
+		return err
+	}
+	readers := make(journalMerge, 0, len(dirs))
+	defer func() {
+		for _, reader := range readers {
+			reader.close()
+		}
+	}()
+	for i, dir := range dirs {
+		reader, err := newJournalReader(dir, i, aead)
+		if err != nil {
+			return err
+		}
+		if err := reader.next(); err == io.EOF {
+			continue
+		} else if err != nil {
+			return err
+		}
+		readers = append(readers, reader)
+	}
+	heap.Init(&readers)
+
+	for len(readers) > 0 {
+		reader := readers[0]
+		record := reader.record
+		if err := reader.next(); err == io.EOF {
+			heap.Pop(&readers)
+			reader.close()
+		} else if err != nil {
+			return err
+		} else {
+			heap.Fix(&readers, 0)
+		}
+		if !start.IsZero() && record.Timestamp.Before(start) {
+			continue
+		}
+		if !end.IsZero() && !record.Timestamp.Before(end) {
+			continue
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// journalReader reads the records of the journal files of a directory, in order
+type journalReader struct {
+	order     int // Order of the directory, for the records published at the same time
+	files     []string
+	fileName  string
+	file      *os.File
+	reader    *bufio.Reader
+	encrypted bool           // Whether the messages of the file being read are encrypted
+	aead      cipher.AEAD    // Decrypts the messages of the encrypted files, nil without a key
+	record    *JournalRecord // Record read by the last call to next
+}
+
+func newJournalReader(dir string, order int, aead cipher.AEAD) (*journalReader, error) {
+	files, err := JournalFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &journalReader{order: order, files: files, aead: aead}, nil
+}
+
+// next reads the next record into record, returns io.EOF after the last file
+func (r *journalReader) next() error {
+	for {
+		if r.reader == nil {
+			if len(r.files) == 0 {
+				return io.EOF
+			}
+			if err := r.open(r.files[0]); err != nil {
+				return fmt.Errorf("failed to read journal file %s: %w", r.files[0], err)
+			}
+			r.files = r.files[1:]
+		}
+		record, err := readJournalRecord(r.reader)
+		if err == nil && r.encrypted {
+			err = r.decrypt(record)
+		}
+		if err == nil {
+			r.record = record
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			// The last record was not completely written, such as after a crash
+			log.Warningln("Journal file", r.fileName, "ends with an incomplete record")
+		} else if err != io.EOF {
+			return fmt.Errorf("failed to read journal file %s: %w", r.fileName, err)
+		}
+		r.close()
+	}
+}
+
+// open starts reading a journal file, after its header
+func (r *journalReader) open(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	magic := make([]byte, len(journalMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || (string(magic) != journalMagic && string(magic) != journalEncryptedMagic) {
+		file.Close()
+		return errJournalFormat
+	}
+	r.encrypted = string(magic) == journalEncryptedMagic
+	if r.encrypted && r.aead == nil {
+		file.Close()
+		return errJournalNoKey
+	}
+	r.fileName = fileName
+	r.file = file
+	r.reader = reader
+	return nil
+}
+
+// decrypt replaces the encrypted message of the record with the message
+func (r *journalReader) decrypt(record *JournalRecord) error {
+	nonceSize := r.aead.NonceSize()
+	if len(record.Message) < nonceSize {
+		return errors.New("invalid journal record nonce")
+	}
+	msg, err := r.aead.Open(nil, record.Message[:nonceSize], record.Message[nonceSize:], nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt journal record: %w", err)
+	}
+	record.Message = msg
+	return nil
+}
+
+// close closes the journal file being read, if any
+func (r *journalReader) close() {
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file = nil
+	r.reader = nil
+}
+
+// journalMerge is a heap of the journal readers, ordered by the timestamp of
+// their next record, then by the order of their directories
+type journalMerge []*journalReader
+
+func (m journalMerge) Len() int { return len(m) }
+func (m journalMerge) Less(i, j int) bool {
+	if m[i].record.Timestamp.Equal(m[j].record.Timestamp) {
+		return m[i].order < m[j].order
+	}
+	return m[i].record.Timestamp.Before(m[j].record.Timestamp)
+}
+func (m journalMerge) Swap(i, j int)       { m[i], m[j] = m[j], m[i] }
+func (m *journalMerge) Push(x interface{}) { *m = append(*m, x.(*journalReader)) }
+func (m *journalMerge) Pop() interface{} {
+	old := *m
+	reader := old[len(old)-1]
+	*m = old[:len(old)-1]
+	return reader
+}
+
+func readJournalRecord(reader *bufio.Reader) (*JournalRecord, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length < 12 || length > maxJournalRecord {
+		return nil, fmt.Errorf("invalid journal record length %d", length)
+	}
+	body := make([]byte, length+4)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	body, checksum := body[:length], body[length:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(checksum) {
+		return nil, errors.New("journal record checksum mismatch")
+	}
+
+	record := JournalRecord{Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(body)))}
+	body = body[8:]
+	exchangeLen := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	if len(body) < exchangeLen+2 {
+		return nil, errors.New("invalid journal record exchange")
+	}
+	record.Exchange = string(body[:exchangeLen])
+	body = body[exchangeLen:]
+	routingKeyLen := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	if len(body) < routingKeyLen {
+		return nil, errors.New("invalid journal record routing key")
+	}
+	record.RoutingKey = string(body[:routingKeyLen])
+	record.Message = body[routingKeyLen:]
+	return &record, nil
+}
@@ -0,0 +1,164 @@
+package shoveler
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestJournal writes messages to the journal and reads them back
+func TestJournal(t *testing.T) {
+	journalDir := path.Join(t.TempDir(), "journal")
+	testJournal, err := OpenJournal(journalDir, 1024, 3, nil)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		record := JournalRecord{Timestamp: start.Add(time.Duration(i) * time.Second), Exchange: "shoveled-xrd", Message: []byte("test." + strconv.Itoa(i))}
+		assert.NoError(t, testJournal.Write(&record))
+	}
+	assert.NoError(t, testJournal.Close())
+
+	// Only the newest files are kept
+	files, err := JournalFiles(journalDir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 3)
+
+	var records []*JournalRecord
+	err = ReadJournal(journalDir, nil, time.Time{}, time.Time{}, func(record *JournalRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, records)
+	assert.Equal(t, "test.99", string(records[len(records)-1].Message))
+	assert.Equal(t, "shoveled-xrd", records[0].Exchange)
+
+	// Read a time range
+	records = nil
+	err = ReadJournal(journalDir, nil, start.Add(95*time.Second), start.Add(98*time.Second), func(record *JournalRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, records, 3) {
+		assert.Equal(t, "test.95", string(records[0].Message))
+		assert.Equal(t, "test.97", string(records[2].Message))
+	}
+}
+
+// TestJournalIncompleteRecord makes sure a journal cut in the middle of a record can be read
+func TestJournalIncompleteRecord(t *testing.T) {
+	journalDir := path.Join(t.TempDir(), "journal")
+	testJournal, err := OpenJournal(journalDir, 1024*1024, 3, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, testJournal.Write(&JournalRecord{Timestamp: time.Now(), Exchange: "shoveled-xrd", Message: []byte("test1")}))
+	assert.NoError(t, testJournal.Write(&JournalRecord{Timestamp: time.Now(), Exchange: "shoveled-xrd", Message: []byte("test2")}))
+	assert.NoError(t, testJournal.Close())
+
+	files, err := JournalFiles(journalDir)
+	assert.NoError(t, err)
+	info, err := os.Stat(files[0])
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(files[0], info.Size()-3))
+
+	var records []*JournalRecord
+	err = ReadJournal(journalDir, nil, time.Time{}, time.Time{}, func(record *JournalRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "test1", string(records[0].Message))
+	}
+}
+
+// TestReadJournals makes sure the journals of several shovelers are merged in
+// the order the messages were published
+func TestReadJournals(t *testing.T) {
+	start := time.Now()
+	var dirs []string
+	for shoveler := 0; shoveler < 3; shoveler++ {
+		journalDir := path.Join(t.TempDir(), "journal")
+		testJournal, err := OpenJournal(journalDir, 256, 100, nil)
+		require.NoError(t, err)
+		for i := shoveler; i < 30; i += 3 {
+			record := JournalRecord{Timestamp: start.Add(time.Duration(i) * time.Second), Exchange: "shoveled-xrd", Message: []byte("test." + strconv.Itoa(i))}
+			require.NoError(t, testJournal.Write(&record))
+		}
+		require.NoError(t, testJournal.Close())
+		dirs = append(dirs, journalDir)
+	}
+	// An empty journal is skipped
+	emptyDir := path.Join(t.TempDir(), "journal")
+	require.NoError(t, os.Mkdir(emptyDir, 0755))
+	dirs = append(dirs, emptyDir)
+
+	var messages []string
+	err := ReadJournals(dirs, nil, start.Add(5*time.Second), time.Time{}, func(record *JournalRecord) error {
+		messages = append(messages, string(record.Message))
+		return nil
+	})
+	require.NoError(t, err)
+	if assert.Len(t, messages, 25) {
+		for i, message := range messages {
+			assert.Equal(t, "test."+strconv.Itoa(i+5), message)
+		}
+	}
+}
+
+// TestJournalEncrypted makes sure the messages are encrypted with the key, and
+// only read back with it
+func TestJournalEncrypted(t *testing.T) {
+	journalDir := path.Join(t.TempDir(), "journal")
+	key := bytes.Repeat([]byte{7}, 32)
+	testJournal, err := OpenJournal(journalDir, 1024*1024, 3, key)
+	require.NoError(t, err)
+	require.NoError(t, testJournal.Write(&JournalRecord{Timestamp: time.Now(), Exchange: "shoveled-xrd", Message: []byte("secret.user")}))
+	require.NoError(t, testJournal.Close())
+
+	files, err := JournalFiles(journalDir)
+	require.NoError(t, err)
+	contents, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.NotContains(t, string(contents), "secret.user")
+
+	var records []*JournalRecord
+	err = ReadJournal(journalDir, key, time.Time{}, time.Time{}, func(record *JournalRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "secret.user", string(records[0].Message))
+		assert.Equal(t, "shoveled-xrd", records[0].Exchange)
+	}
+
+	err = ReadJournal(journalDir, nil, time.Time{}, time.Time{}, func(record *JournalRecord) error { return nil })
+	assert.ErrorIs(t, err, errJournalNoKey)
+}
+
+// TestJournalFlush makes sure the records are written to the file without
+// closing the journal
+func TestJournalFlush(t *testing.T) {
+	journalDir := path.Join(t.TempDir(), "journal")
+	testJournal, err := OpenJournal(journalDir, 1024*1024, 3, nil)
+	require.NoError(t, err)
+	defer testJournal.Close()
+	require.NoError(t, testJournal.Write(&JournalRecord{Timestamp: time.Now(), Exchange: "shoveled-xrd", Message: []byte("test1")}))
+
+	assert.Eventually(t, func() bool {
+		count := 0
+		err := ReadJournal(journalDir, nil, time.Time{}, time.Time{}, func(record *JournalRecord) error {
+			count++
+			return nil
+		})
+		return err == nil && count == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
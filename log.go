@@ -1,6 +1,13 @@
 package shoveler
 
-import "github.com/sirupsen/logrus"
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/opensciencegrid/xrootd-monitoring-shoveler/queue"
+	"github.com/sirupsen/logrus"
+)
 
 var log logrus.FieldLogger
 
@@ -11,4 +18,56 @@ func init() {
 
 func SetLogger(logger logrus.FieldLogger) {
 	log = logger
+	queue.SetLogger(logger)
+}
+
+// RateLimitedLog logs at most one line every interval, for errors that repeat
+// quickly such as publish failures during a message bus outage.  The lines in
+// between are counted, and the count is added to the next line logged.
+type RateLimitedLog struct {
+	interval   time.Duration
+	mutex      sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+// NewRateLimitedLog creates a log that writes at most one line every interval
+func NewRateLimitedLog(interval time.Duration) *RateLimitedLog {
+	return &RateLimitedLog{interval: interval}
+}
+
+// allow returns whether a line can be logged now, and the number of lines suppressed since the last one
+func (r *RateLimitedLog) allow() (bool, int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	if !r.last.IsZero() && now.Sub(r.last) < r.interval {
+		r.suppressed++
+		return false, 0
+	}
+	suppressed := r.suppressed
+	r.last = now
+	r.suppressed = 0
+	return true, suppressed
+}
+
+func (r *RateLimitedLog) summary(args []interface{}, suppressed int) []interface{} {
+	if suppressed == 0 {
+		return args
+	}
+	return append(args, fmt.Sprintf("(%d similar messages suppressed in the last %s)", suppressed, r.interval))
+}
+
+// Errorln logs at the error level, unless a line was logged less than the interval ago
+func (r *RateLimitedLog) Errorln(args ...interface{}) {
+	if ok, suppressed := r.allow(); ok {
+		log.Errorln(r.summary(args, suppressed)...)
+	}
+}
+
+// Warningln logs at the warning level, unless a line was logged less than the interval ago
+func (r *RateLimitedLog) Warningln(args ...interface{}) {
+	if ok, suppressed := r.allow(); ok {
+		log.Warningln(r.summary(args, suppressed)...)
+	}
 }
@@ -0,0 +1,30 @@
+package shoveler
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRateLimitedLog makes sure repeated lines are suppressed and counted
+func TestRateLimitedLog(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	previous := log
+	SetLogger(logger)
+	defer SetLogger(previous)
+
+	rateLimited := NewRateLimitedLog(50 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		rateLimited.Errorln("Failed to push message")
+	}
+	assert.Len(t, hook.AllEntries(), 1)
+
+	time.Sleep(60 * time.Millisecond)
+	rateLimited.Warningln("Failed to push message")
+	if assert.Len(t, hook.AllEntries(), 2) {
+		assert.True(t, strings.Contains(hook.LastEntry().Message, "9 similar messages suppressed"), hook.LastEntry().Message)
+	}
+}
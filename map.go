@@ -2,6 +2,7 @@ package shoveler
 
 import (
 	"net"
+	"strings"
 )
 
 // mapIp returns the mapped IP address
@@ -11,10 +12,43 @@ func mapIp(remote *net.UDPAddr, config *Config) string {
 		return config.IpMapAll
 	}
 	if len(config.IpMap) == 0 {
-		return remote.IP.String()
+		return NormalizeIP(remote.IP.String())
 	}
-	if ip, ok := config.IpMap[remote.IP.String()]; ok {
+	if ip, ok := config.IpMap[NormalizeIP(remote.IP.String())]; ok {
 		return ip
 	}
-	return remote.IP.String()
+	return NormalizeIP(remote.IP.String())
+}
+
+// NormalizeIP returns the canonical form of an IP address, so the addresses
+// written in different shapes, such as "[::ffff:192.0.2.1]", "::192.0.2.1",
+// and "192.0.2.1", compare equal.  The brackets and the zone are removed,
+// IPv4-mapped and IPv4-compatible addresses become IPv4, and IPv6 addresses
+// are lower case and compressed.  Host names are returned unchanged.
+func NormalizeIP(host string) string {
+	address := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if zone := strings.IndexByte(address, '%'); zone >= 0 {
+		address = address[:zone]
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	// An IPv4-compatible address, only recognized when written with the IPv4 address
+	if strings.Contains(address, ".") && ip[:12].Equal(net.IPv6zero[:12]) {
+		return ip[12:].String()
+	}
+	return ip.String()
+}
+
+// normalizeIPMap returns the IP map with the addresses normalized
+func normalizeIPMap(ipMap map[string]string) map[string]string {
+	normalized := make(map[string]string, len(ipMap))
+	for from, to := range ipMap {
+		normalized[NormalizeIP(from)] = NormalizeIP(to)
+	}
+	return normalized
 }
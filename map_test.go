@@ -45,3 +45,24 @@ map:
 	ip = net.UDPAddr{IP: net.ParseIP("172.168.2.7"), Port: 514}
 	assert.Equal(t, "129.93.10.5", mapIp(&ip, &config), "Test when map is set by config file")
 }
+
+func TestNormalizeIP(t *testing.T) {
+	for _, host := range []string{"192.0.2.1", "[::ffff:192.0.2.1]", "::ffff:192.0.2.1", "::192.0.2.1", "[::192.0.2.1]"} {
+		assert.Equal(t, "192.0.2.1", NormalizeIP(host), host)
+	}
+	for _, host := range []string{"2001:DB8::1", "[2001:db8:0:0::1]", "2001:db8::1%eth0", "[2001:0db8::0001]"} {
+		assert.Equal(t, "2001:db8::1", NormalizeIP(host), host)
+	}
+	assert.Equal(t, "::1", NormalizeIP("[::1]"))
+	assert.Equal(t, "xrootd.example.com", NormalizeIP("xrootd.example.com"))
+	assert.Equal(t, "", NormalizeIP(""))
+}
+
+// TestMapIpNormalized makes sure the IP map matches the addresses written in another shape
+func TestMapIpNormalized(t *testing.T) {
+	config := Config{IpMap: normalizeIPMap(map[string]string{"[::ffff:192.168.1.5]": "172.168.1.6", "2001:DB8::5": "[2001:db8::6]"})}
+	ip := net.UDPAddr{IP: net.ParseIP("192.168.1.5"), Port: 514}
+	assert.Equal(t, "172.168.1.6", mapIp(&ip, &config))
+	ip = net.UDPAddr{IP: net.ParseIP("2001:db8::5"), Port: 514}
+	assert.Equal(t, "2001:db8::6", mapIp(&ip, &config))
+}
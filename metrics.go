@@ -3,41 +3,251 @@ package shoveler
 import (
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	PacketsReceived = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "shoveler_packets_received",
+	// metricsRegistry holds the metrics of the shoveler, served by StartMetrics
+	metricsRegistry = prometheus.NewRegistry()
+	metricsFactory  = promauto.With(metricsRegistry)
+)
+
+var (
+	PacketsReceived = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "shoveler_packets_received_total",
 		Help: "The total number of packets received",
 	})
 
-	ValidationsFailed = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "shoveler_validations_failed",
+	PacketsEnqueueFailed = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "shoveler_packets_enqueue_failed_total",
+		Help: "The total number of packets dropped because they could not be stored in the queue",
+	})
+
+	ProxyHeaders = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "shoveler_proxy_headers_total",
+		Help: "The total number of packets checked for a proxy header, by result (ok, missing, invalid, or untrusted)",
+	}, []string{"result"})
+
+	UDPReceiveBuffer = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Name: "shoveler_udp_receive_buffer_bytes",
+		Help: "The size of the kernel receive buffer of the UDP socket, without the overhead Linux includes",
+	})
+
+	UDPDrops = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "shoveler_udp_drops_total",
+		Help: "The total number of UDP packets dropped by the kernel, usually because the receive buffer was full",
+	})
+
+	RelayMessagesReceived = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "shoveler_relay_messages_received_total",
+		Help: "The total number of messages received from other shovelers",
+	})
+
+	ValidationsFailed = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "shoveler_validations_failed_total",
 		Help: "The total number of packets that failed validation",
 	})
 
-	RabbitmqReconnects = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "shoveler_rabbitmq_reconnects",
+	PacketsTruncated = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "shoveler_packets_padding_truncated_total",
+		Help: "The total number of packets longer than their header length, truncated to it, by the version of the server",
+	}, []string{"version"})
+
+	ValidationsFailedReason = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "shoveler_validations_failed_reason_total",
+		Help: "The total number of packets that failed validation, by reason",
+	}, []string{"reason"})
+
+	MessageChecksumMismatches = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "shoveler_message_checksum_mismatches_total",
+		Help: "The total number of messages decoded with a packet that does not match the checksum of the envelope",
+	})
+
+	PacketsScrubbed = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "shoveler_packets_scrubbed_total",
+		Help: "The total number of user and token packets with sensitive fields blanked before forwarding",
+	})
+
+	RabbitmqReconnects = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "shoveler_rabbitmq_reconnects_total",
 		Help: "The total number of reconnections to rabbitmq bus",
 	})
 
-	QueueSize = promauto.NewGauge(prometheus.GaugeOpts{
+	AmqpPublishes = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "shoveler_amqp_publish_attempts_total",
+		Help: "The total number of attempts to publish a message, by exchange and result (published, or failed when the channel refused it)",
+	}, []string{"exchange", "result"})
+
+	AmqpConfirms = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "shoveler_amqp_publish_confirms_total",
+		Help: "The total number of publisher confirms waited for with strict ordering, by exchange and result (ack, nack, timeout, or closed)",
+	}, []string{"exchange", "result"})
+
+	AmqpReturns = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "shoveler_amqp_publish_returns_total",
+		Help: "The total number of messages returned by the server because they could not be routed, by exchange and reason",
+	}, []string{"exchange", "reason"})
+
+	AmqpChannelErrors = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "shoveler_amqp_channel_errors_total",
+		Help: "The total number of channels closed or failing to open, by exchange and reason",
+	}, []string{"exchange", "reason"})
+
+	AmqpReconnects = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "shoveler_amqp_reconnects_total",
+		Help: "The total number of reconnections to the server, by exchange and cause (connect_failed, connection_closed, or token_rotated)",
+	}, []string{"exchange", "reason"})
+
+	TokenRotations = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "shoveler_token_rotations_total",
+		Help: "The total number of token rotations, by result (success, or failure when the token file could not be read)",
+	}, []string{"result"})
+
+	AmqpBlocked = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shoveler_amqp_blocked",
+		Help: "Whether the server blocked publishing to the exchange (1) or not (0), with connection.blocked",
+	}, []string{"exchange"})
+
+	AmqpTokenExpiry = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shoveler_amqp_token_expiry_timestamp",
+		Help: "The unix time the token used to publish to the exchange expires, from its exp claim",
+	}, []string{"exchange"})
+
+	TokenRefreshes = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "shoveler_token_refreshes_total",
+		Help: "The total number of runs of the token refresh command, by result (success or failure)",
+	}, []string{"result"})
+
+	FaultsInjected = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "shoveler_faults_injected_total",
+		Help: "The total number of faults injected for testing, by fault",
+	}, []string{"fault"})
+
+	QueueSize = metricsFactory.NewGauge(prometheus.GaugeOpts{
 		Name: "shoveler_queue_size",
 		Help: "The number of messages in the queue",
 	})
+
+	QueueDiskBytes = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Name: "shoveler_queue_disk_bytes",
+		Help: "The bytes used by the queue on disk",
+	})
+
+	QueueReclaimedBytes = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "shoveler_queue_reclaimed_bytes_total",
+		Help: "The total bytes released by the maintenance of the queue directory",
+	})
+
+	QueueTruncatedSegments = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "shoveler_queue_truncated_segments_total",
+		Help: "The total queue segments truncated to their last complete record, after a crash while writing them",
+	})
+
+	SelfTestSuccess = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shoveler_self_test_success",
+		Help: "Whether each check of the startup self-test passed (1) or failed (0)",
+	}, []string{"check"})
+
+	EventsDropped = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "shoveler_events_dropped_total",
+		Help: "The total number of operational events dropped because they could not be written fast enough",
+	})
+
+	PubSubMessagesDropped = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Name: "shoveler_pubsub_messages_dropped_total",
+		Help: "The total number of messages dropped because Pub/Sub rejected their batch",
+	})
+
+	MQConnected = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Name: "shoveler_mq_connected",
+		Help: "Whether the shoveler is connected to the message bus (1) or not (0)",
+	})
+
+	ShovelerInfo = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shoveler_info",
+		Help: "Version and non-secret configuration of the shoveler, always 1",
+	}, []string{"version", "commit", "mode", "mq", "destination", "verify", "strict_ordering", "compression", "listen_port"})
+
+	// ActiveServers estimates the distinct server addresses that sent packets in the last hour
+	ActiveServers = NewWindowedCardinality(time.Hour, 6)
+
+	_ = metricsFactory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "shoveler_active_servers_1h",
+		Help: "The estimated number of distinct server addresses that sent packets in the last hour",
+	}, func() float64 {
+		return ActiveServers.Estimate()
+	})
 )
 
-func StartMetrics(metricsPort int) {
+func init() {
+	// Export the process metrics, and the Go metrics including the garbage
+	// collector and scheduler runtime metrics
+	metricsRegistry.MustRegister(
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewGoCollector(
+			collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsGC, collectors.MetricsScheduler),
+		),
+	)
+}
+
+// RegisterMetrics registers the metrics of a subsystem, so they are served
+// along with the shoveler metrics.  Names should start with shoveler_, and
+// counters end with _total.
+func RegisterMetrics(metrics ...prometheus.Collector) error {
+	for _, metric := range metrics {
+		if err := metricsRegistry.Register(metric); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetInfoMetric exports the version and the non-secret configuration in the shoveler_info metric
+func SetInfoMetric(config *Config) {
+	// Where the messages are published, never includes the credentials in the URLs
+	destination := ""
+	switch config.MQ {
+	case "amqp":
+		if config.AmqpURL != nil {
+			destination = config.AmqpURL.Host + config.AmqpURL.Path + "/" + config.AmqpExchange
+		}
+	case "stomp":
+		if config.StompURL != nil {
+			destination = config.StompURL.Host + "/" + config.StompTopic
+		}
+	case "pubsub":
+		destination = config.PubSubProject + "/" + config.PubSubTopic
+	}
+	ShovelerInfo.Reset()
+	ShovelerInfo.WithLabelValues(
+		ShovelerVersion,
+		ShovelerCommit,
+		"shoveling",
+		config.MQ,
+		destination,
+		strconv.FormatBool(config.Verify),
+		strconv.FormatBool(config.StrictOrder),
+		config.Compression,
+		strconv.Itoa(config.ListenPort),
+	).Set(1)
+}
+
+func StartMetrics(config *Config) {
+	gatherer := newLabeledGatherer(metricsRegistry, prometheus.Labels{"instance": config.MetricsInstance, "mode": "shoveling"}, config.MetricsLegacyNames)
 
 	// Listen to the metrics requests in a separate thread
 	go func() {
-		listenAddress := ":" + strconv.Itoa(metricsPort)
+		listenAddress := ":" + strconv.Itoa(config.MetricsPort)
 		log.Debugln("Starting metrics at " + listenAddress + "/metrics")
-		http.Handle("/metrics", promhttp.Handler())
+		http.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+		http.HandleFunc("/ready", readyHandler)
+		http.HandleFunc("/debug/config", configHandler(config))
+		http.HandleFunc("/schema/message.json", schemaHandler)
 		err := http.ListenAndServe(listenAddress, nil)
 		if err != nil {
 			log.Errorln("Failed to listen and serve metrics:", err)
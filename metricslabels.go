@@ -0,0 +1,92 @@
+package shoveler
+
+import (
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// labeledGatherer adds constant labels, such as the instance, to every metric
+// gathered.  The labels are only known once the configuration is read, after
+// the metrics are created.  With legacy names, the counters that existed before
+// the _total suffix was added are also exported under their previous names, so
+// existing dashboards keep working.
+type labeledGatherer struct {
+	gatherer    prometheus.Gatherer
+	labels      []*dto.LabelPair
+	legacyNames bool
+}
+
+func newLabeledGatherer(gatherer prometheus.Gatherer, labels prometheus.Labels, legacyNames bool) *labeledGatherer {
+	labeled := labeledGatherer{gatherer: gatherer, legacyNames: legacyNames}
+	for name, value := range labels {
+		if value == "" {
+			continue
+		}
+		labeled.labels = append(labeled.labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	return &labeled
+}
+
+// Gather implements prometheus.Gatherer
+func (g *labeledGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			metric.Label = addLabels(metric.Label, g.labels)
+		}
+		if g.legacyNames {
+			if legacyName, ok := legacyMetricName(family); ok {
+				legacy := proto.Clone(family).(*dto.MetricFamily)
+				legacy.Name = proto.String(legacyName)
+				families = append(families, legacy)
+			}
+		}
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+	return families, nil
+}
+
+// legacyMetricNames are the counters exported before the _total suffix was
+// added.  The counters added since never had another name.
+var legacyMetricNames = map[string]string{
+	"shoveler_packets_received_total":    "shoveler_packets_received",
+	"shoveler_validations_failed_total":  "shoveler_validations_failed",
+	"shoveler_rabbitmq_reconnects_total": "shoveler_rabbitmq_reconnects",
+}
+
+// legacyMetricName returns the previous name of a shoveler counter, if it had one
+func legacyMetricName(family *dto.MetricFamily) (string, bool) {
+	if family.GetType() != dto.MetricType_COUNTER {
+		return "", false
+	}
+	name, ok := legacyMetricNames[family.GetName()]
+	return name, ok
+}
+
+// addLabels adds the labels the metric does not already have, keeping them sorted by name
+func addLabels(metricLabels []*dto.LabelPair, labels []*dto.LabelPair) []*dto.LabelPair {
+	for _, label := range labels {
+		found := false
+		for _, existing := range metricLabels {
+			if existing.GetName() == label.GetName() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			metricLabels = append(metricLabels, label)
+		}
+	}
+	sort.Slice(metricLabels, func(i, j int) bool {
+		return metricLabels[i].GetName() < metricLabels[j].GetName()
+	})
+	return metricLabels
+}
@@ -1,27 +1,86 @@
 package shoveler
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	// MessageFormatVersion is the version of the Message envelope produced by PackageUdp.
+	// Messages without a fmt_version are version 1, which only had remote, version and data.
+	MessageFormatVersion = 5
+
+	// CompressionGzip marks the data as gzip compressed before being base64 encoded
+	CompressionGzip = "gzip"
+
+	// maxPacketSize is the size of the largest UDP packet, a compressed message
+	// decompressing to more is rejected
+	maxPacketSize = 64 * 1024
+)
+
+// Message is the JSON envelope of a monitoring packet, sent to the message bus
 type Message struct {
-	Remote          string `json:"remote"`
-	ShovelerVersion string `json:"version"`
-	Data            string `json:"data"`
+	FormatVersion   int    `json:"fmt_version,omitempty"` // Version of the envelope, messages without it are version 1
+	Remote          string `json:"remote"`                // Address and port of the server that sent the packet, after IP mapping, IPv6 addresses in brackets
+	ShovelerVersion string `json:"version"`               // Version of the shoveler
+	ReceivedTs      int64  `json:"received_ts,omitempty"` // Unix time in milliseconds the packet was received
+	Listener        string `json:"listener,omitempty"`    // Label of the listener that received the packet
+	Compression     string `json:"compression,omitempty"` // Compression of the packet in data, empty if not compressed
+	Data            string `json:"data"`                  // The packet, base64 encoded
+
+	// Site-defined fields added to every message, nested so they can not collide with the envelope fields
+	StaticFields map[string]string `json:"static_fields,omitempty"`
+
+	// Checksum of the packet before compression, to detect corruption between the shoveler and the consumers
+	Checksum string `json:"checksum,omitempty"`
 }
 
+// ErrChecksumMismatch is returned when the packet of a message does not match its checksum
+var ErrChecksumMismatch = errors.New("the packet does not match the checksum of the message")
+
+// ErrPacketSize is returned when the packet of a message decompresses to more than a UDP packet
+var ErrPacketSize = errors.New("the packet of the message is larger than a UDP packet")
+
 func PackageUdp(packet []byte, remote *net.UDPAddr, config *Config) []byte {
 	msg := Message{}
+	msg.FormatVersion = MessageFormatVersion
+	msg.ReceivedTs = time.Now().UnixMilli()
+	msg.Listener = config.ListenLabel
+	msg.StaticFields = config.StaticFields
+	if config.Checksum {
+		msg.Checksum = PayloadChecksum(packet)
+	}
+
+	if config.Compression == CompressionGzip {
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		_, err := writer.Write(packet)
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			log.Errorln("Failed to compress the packet, sending it uncompressed:", err)
+		} else {
+			packet = buf.Bytes()
+			msg.Compression = CompressionGzip
+		}
+	}
+
 	// Base64 encode the packet
 	str := base64.StdEncoding.EncodeToString(packet)
 	msg.Data = str
 
 	// add the remote
-	msg.Remote = mapIp(remote, config)
-	msg.Remote += ":" + strconv.Itoa(remote.Port)
+	msg.Remote = net.JoinHostPort(mapIp(remote, config), strconv.Itoa(remote.Port))
 
 	msg.ShovelerVersion = ShovelerVersion
 
@@ -32,3 +91,97 @@ func PackageUdp(packet []byte, remote *net.UDPAddr, config *Config) []byte {
 	}
 	return b
 }
+
+// Keys of the Message fields found by IsSummaryMessage without parsing the message
+var (
+	compressionKey = []byte(`"compression":"`)
+	dataKey        = []byte(`"data":"`)
+)
+
+// IsSummaryMessage returns true if the packet of a message created by
+// PackageUdp is an XML summary packet.  It runs for every message published,
+// so the message is not parsed: PackageUdp writes the compression before the
+// data, the first data key is the one of the envelope, and only the first
+// bytes of the packet are decoded.
+func IsSummaryMessage(message []byte) bool {
+	dataStart := bytes.Index(message, dataKey)
+	if dataStart < 0 {
+		return false
+	}
+	compression := ""
+	if start := bytes.Index(message[:dataStart], compressionKey); start >= 0 {
+		value := message[start+len(compressionKey) : dataStart]
+		end := bytes.IndexByte(value, '"')
+		if end < 0 {
+			return false
+		}
+		compression = string(value[:end])
+	}
+	data := message[dataStart+len(dataKey):]
+	end := bytes.IndexByte(data, '"')
+	if end < 4 {
+		return false
+	}
+	var packet io.Reader = base64.NewDecoder(base64.StdEncoding, bytes.NewReader(data[:end]))
+	if compression == CompressionGzip {
+		reader, err := gzip.NewReader(packet)
+		if err != nil {
+			return false
+		}
+		packet = reader
+	} else if compression != "" {
+		return false
+	}
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(packet, first); err != nil {
+		return false
+	}
+	return first[0] == '<'
+}
+
+// UnpackageUdp parses a message created by PackageUdp, of any format version,
+// and returns the envelope along with the original packet.  If the message has
+// a checksum, the packet is verified, and ErrChecksumMismatch returned if it
+// does not match.
+func UnpackageUdp(message []byte) (*Message, []byte, error) {
+	msg := Message{}
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return nil, nil, err
+	}
+	if msg.FormatVersion == 0 {
+		msg.FormatVersion = 1
+	}
+	if msg.FormatVersion > MessageFormatVersion {
+		// Newer formats only add fields, so try to decode the data anyway
+		log.Debugln("Message format version", msg.FormatVersion, "is newer than the supported", MessageFormatVersion)
+	}
+
+	packet, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch msg.Compression {
+	case "":
+	case CompressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(packet))
+		if err != nil {
+			return nil, nil, err
+		}
+		packet, err = io.ReadAll(io.LimitReader(reader, maxPacketSize+1))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(packet) > maxPacketSize {
+			return nil, nil, ErrPacketSize
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown message compression: %s", msg.Compression)
+	}
+	// Checksums of other hash functions, from newer shovelers, are not verified
+	if strings.HasPrefix(msg.Checksum, checksumPrefix) && msg.Checksum != PayloadChecksum(packet) {
+		MessageChecksumMismatches.Inc()
+		return nil, nil, ErrChecksumMismatch
+	}
+	return &msg, packet, nil
+}
@@ -1,10 +1,14 @@
 package shoveler
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"net"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -52,3 +56,116 @@ func TestPackageUdp_MappingMultiple(t *testing.T) {
 	assert.Equal(t, "172.0.0.10:12345", pkg.Remote, "Remote IP should be the same")
 	assert.Equal(t, "YXNkZg==", pkg.Data, "Data should be base64 encoded")
 }
+
+func TestPackageUdp_Envelope(t *testing.T) {
+	ip := net.UDPAddr{IP: net.ParseIP("192.168.0.7"), Port: 12345}
+	config := Config{ListenLabel: "site-a", StaticFields: map[string]string{"federation": "osg", "remote": "not-the-remote"}}
+	before := time.Now().UnixMilli()
+	packaged := PackageUdp([]byte("asdf"), &ip, &config)
+	msg, packet, err := UnpackageUdp(packaged)
+	assert.NoError(t, err)
+	assert.Equal(t, MessageFormatVersion, msg.FormatVersion)
+	assert.Equal(t, "site-a", msg.Listener)
+	assert.Equal(t, "192.168.0.7:12345", msg.Remote, "Static fields should not replace the envelope fields")
+	assert.Equal(t, config.StaticFields, msg.StaticFields)
+	assert.Equal(t, "", msg.Compression)
+	assert.GreaterOrEqual(t, msg.ReceivedTs, before)
+	assert.Equal(t, []byte("asdf"), packet)
+}
+
+func TestPackageUdp_Compression(t *testing.T) {
+	ip := net.UDPAddr{IP: net.ParseIP("192.168.0.7"), Port: 12345}
+	config := Config{Compression: CompressionGzip}
+	packet := bytes.Repeat([]byte("asdf"), 1000)
+	packaged := PackageUdp(packet, &ip, &config)
+	assert.Less(t, len(packaged), len(packet), "Compressed message should be smaller than the packet")
+	msg, unpackaged, err := UnpackageUdp(packaged)
+	assert.NoError(t, err)
+	assert.Equal(t, CompressionGzip, msg.Compression)
+	assert.Equal(t, packet, unpackaged)
+
+	// A message decompressing to more than a UDP packet is rejected
+	packaged = PackageUdp(make([]byte, maxPacketSize+1), &ip, &config)
+	_, _, err = UnpackageUdp(packaged)
+	assert.ErrorIs(t, err, ErrPacketSize)
+}
+
+func TestUnpackageUdp_Version1(t *testing.T) {
+	// Message produced before the envelope was versioned
+	msg, packet, err := UnpackageUdp([]byte(`{"remote":"192.168.0.7:12345","version":"1.0.0","data":"YXNkZg=="}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, msg.FormatVersion)
+	assert.Equal(t, "192.168.0.7:12345", msg.Remote)
+	assert.Equal(t, []byte("asdf"), packet)
+
+	_, _, err = UnpackageUdp([]byte(`{"remote":"192.168.0.7:12345","compression":"lz4","data":"YXNkZg=="}`))
+	assert.Error(t, err, "Unknown compression should fail")
+}
+
+func TestPackageUdp_Checksum(t *testing.T) {
+	ip := net.UDPAddr{IP: net.ParseIP("192.168.0.7"), Port: 12345}
+	config := Config{Checksum: true, Compression: CompressionGzip}
+	packaged := PackageUdp([]byte("asdf"), &ip, &config)
+	msg, packet, err := UnpackageUdp(packaged)
+	assert.NoError(t, err)
+	assert.Equal(t, PayloadChecksum([]byte("asdf")), msg.Checksum)
+	assert.Equal(t, []byte("asdf"), packet)
+
+	// Corrupt the packet in the envelope
+	var envelope Message
+	assert.NoError(t, json.Unmarshal(packaged, &envelope))
+	envelope.Compression = ""
+	envelope.Data = base64.StdEncoding.EncodeToString([]byte("asdg"))
+	corrupted, err := json.Marshal(envelope)
+	assert.NoError(t, err)
+	before := testutil.ToFloat64(MessageChecksumMismatches)
+	_, _, err = UnpackageUdp(corrupted)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.Equal(t, before+1, testutil.ToFloat64(MessageChecksumMismatches))
+
+	// Messages without a checksum are not verified
+	packaged = PackageUdp([]byte("asdf"), &ip, &Config{})
+	msg, _, err = UnpackageUdp(packaged)
+	assert.NoError(t, err)
+	assert.Empty(t, msg.Checksum)
+}
+
+func TestIsSummaryMessage(t *testing.T) {
+	ip := net.UDPAddr{IP: net.ParseIP("192.168.0.7"), Port: 12345}
+	summary := []byte(`<statistics tod="1700000000" ver="v5.6.0"></statistics>`)
+	for _, config := range []Config{{}, {Compression: CompressionGzip}} {
+		assert.True(t, IsSummaryMessage(PackageUdp(summary, &ip, &config)), config.Compression)
+		assert.False(t, IsSummaryMessage(PackageUdp([]byte{'u', 1, 0, 8, 0, 0, 0, 5}, &ip, &config)), config.Compression)
+	}
+	assert.False(t, IsSummaryMessage([]byte("not json")))
+	assert.False(t, IsSummaryMessage([]byte(`{"data":""}`)))
+	assert.False(t, IsSummaryMessage([]byte(`{"data":"PHN0`)), "The data is not terminated")
+
+	// Only the data of the envelope is decoded, "PA==" is "<" base64 encoded
+	config := Config{ListenLabel: `"data":"PA==`, StaticFields: map[string]string{"data": "PA=="}}
+	assert.False(t, IsSummaryMessage(PackageUdp([]byte{'u', 1, 0, 8, 0, 0, 0, 5}, &ip, &config)))
+}
+
+// BenchmarkIsSummaryMessage measures the check of the summary packets, done
+// for every message published with a summary exchange or topic
+func BenchmarkIsSummaryMessage(b *testing.B) {
+	ip := net.UDPAddr{IP: net.ParseIP("192.168.0.7"), Port: 12345}
+	msg := PackageUdp(bytes.Repeat([]byte{'f'}, 1400), &ip, &Config{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		IsSummaryMessage(msg)
+	}
+}
+
+func TestPackageUdp_IPv6(t *testing.T) {
+	ip := net.UDPAddr{IP: net.ParseIP("2001:db8::5"), Port: 43210}
+	msg, _, err := UnpackageUdp(PackageUdp([]byte("asdf"), &ip, &Config{}))
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::5]:43210", msg.Remote)
+
+	// IPv4-mapped addresses, as received on a dual-stack socket, are IPv4
+	ip = net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.5"), Port: 43210}
+	msg, _, err = UnpackageUdp(PackageUdp([]byte("asdf"), &ip, &Config{}))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.5:43210", msg.Remote)
+}
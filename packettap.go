@@ -0,0 +1,240 @@
+package shoveler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LivePacket is a packet received, streamed to the clients of /debug/packets
+type LivePacket struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Remote      string    `json:"remote"`
+	Length      int       `json:"length"`
+	Type        string    `json:"type"` // Code of the packet, such as "f" or "u", or "summary" for the XML summary packets
+	Pseq        uint8     `json:"pseq"`
+	Plen        uint16    `json:"plen"`
+	ServerStart int32     `json:"server_start"`
+	Payload     string    `json:"payload"` // Hex encoded, truncated to maxSampledPayload bytes
+}
+
+// Limits of the requests to /debug/packets
+const (
+	defaultLivePackets = 10
+	maxLivePackets     = 1000
+	defaultLiveTimeout = 60 * time.Second
+	maxLiveTimeout     = 10 * time.Minute
+	maxLiveClients     = 10 // Every client is checked for each packet received
+)
+
+// packetFilter selects the packets streamed to a client
+type packetFilter struct {
+	networks []*net.IPNet // Networks of the remotes, any if empty
+	types    []string     // Types of the packets, any if empty
+}
+
+// packetType returns the type of the packet, as in LivePacket
+func packetType(packet []byte) string {
+	if len(packet) == 0 {
+		return ""
+	}
+	if packet[0] == '<' {
+		return "summary"
+	}
+	return string(packet[:1])
+}
+
+func (filter *packetFilter) matches(packet []byte, remote *net.UDPAddr) bool {
+	if len(filter.networks) > 0 {
+		found := false
+		for _, network := range filter.networks {
+			if network.Contains(remote.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(filter.types) > 0 {
+		found := false
+		for _, filterType := range filter.types {
+			if packetType(packet) == filterType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// packetTap receives the packets matching its filter
+type packetTap struct {
+	filter  packetFilter
+	packets chan LivePacket
+}
+
+var (
+	tapsMutex sync.Mutex
+	taps      = make(map[*packetTap]struct{})
+	tapCount  atomic.Int32 // Number of taps, so the packets are not locked while nobody watches
+)
+
+// addTap adds a tap for a client, or returns nil if there are already maxLiveClients
+func addTap(filter packetFilter, count int) *packetTap {
+	tap := &packetTap{filter: filter, packets: make(chan LivePacket, count)}
+	tapsMutex.Lock()
+	defer tapsMutex.Unlock()
+	if len(taps) >= maxLiveClients {
+		return nil
+	}
+	taps[tap] = struct{}{}
+	tapCount.Add(1)
+	return tap
+}
+
+func removeTap(tap *packetTap) {
+	tapsMutex.Lock()
+	defer tapsMutex.Unlock()
+	delete(taps, tap)
+	tapCount.Add(-1)
+}
+
+// TapPacket sends the packet to the clients of /debug/packets whose filter it
+// matches.  Packets are dropped rather than waiting for a slow client.
+func TapPacket(packet []byte, remote *net.UDPAddr) {
+	if tapCount.Load() == 0 {
+		return
+	}
+	tapsMutex.Lock()
+	defer tapsMutex.Unlock()
+	var live *LivePacket
+	for tap := range taps {
+		if !tap.filter.matches(packet, remote) {
+			continue
+		}
+		if live == nil {
+			live = newLivePacket(packet, remote)
+		}
+		select {
+		case tap.packets <- *live:
+		default:
+		}
+	}
+}
+
+func newLivePacket(packet []byte, remote *net.UDPAddr) *LivePacket {
+	payload := packet
+	if len(payload) > maxSampledPayload {
+		payload = payload[:maxSampledPayload]
+	}
+	live := LivePacket{
+		Timestamp: time.Now(),
+		Remote:    remote.String(),
+		Length:    len(packet),
+		Type:      packetType(packet),
+		Payload:   hex.EncodeToString(payload),
+	}
+	if header := ParseHeader(packet); header != nil {
+		live.Pseq = header.Pseq
+		live.Plen = header.Plen
+		live.ServerStart = header.ServerStart
+	}
+	return &live
+}
+
+// parseLiveRequest reads the filter, number of packets, and timeout of a request to /debug/packets
+func parseLiveRequest(r *http.Request) (packetFilter, int, time.Duration, error) {
+	filter := packetFilter{}
+	query := r.URL.Query()
+	for _, remote := range strings.Split(query.Get("remote"), ",") {
+		if remote == "" {
+			continue
+		}
+		if !strings.Contains(remote, "/") {
+			if ip := net.ParseIP(remote); ip != nil && ip.To4() != nil {
+				remote += "/32"
+			} else {
+				remote += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(remote)
+		if err != nil {
+			return filter, 0, 0, err
+		}
+		filter.networks = append(filter.networks, network)
+	}
+	for _, packetType := range strings.Split(query.Get("type"), ",") {
+		if packetType != "" {
+			filter.types = append(filter.types, packetType)
+		}
+	}
+
+	count := defaultLivePackets
+	if query.Get("count") != "" {
+		var err error
+		if count, err = strconv.Atoi(query.Get("count")); err != nil || count < 1 || count > maxLivePackets {
+			return filter, 0, 0, fmt.Errorf("count must be between 1 and %d", maxLivePackets)
+		}
+	}
+	timeout := defaultLiveTimeout
+	if query.Get("timeout") != "" {
+		seconds, err := strconv.Atoi(query.Get("timeout"))
+		timeout = time.Duration(seconds) * time.Second
+		if err != nil || seconds < 1 || timeout > maxLiveTimeout {
+			return filter, 0, 0, fmt.Errorf("timeout must be between 1 and %d seconds", int(maxLiveTimeout.Seconds()))
+		}
+	}
+	return filter, count, timeout, nil
+}
+
+// livePacketsHandler streams the next packets received matching the filter of
+// the request, as lines of JSON, until count packets are sent or the timeout
+func livePacketsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, count, timeout, err := parseLiveRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tap := addTap(filter, count)
+	if tap == nil {
+		http.Error(w, fmt.Sprintf("too many clients, at most %d", maxLiveClients), http.StatusServiceUnavailable)
+		return
+	}
+	defer removeTap(tap)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for sent := 0; sent < count; sent++ {
+		select {
+		case packet := <-tap.packets:
+			if err := encoder.Encode(packet); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-timer.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package shoveler
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestLivePackets makes sure only the packets matching the filter are
+// streamed, and the stream ends after the count
+func TestLivePackets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(livePacketsHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/debug/packets?remote=192.168.0.0/16&type=u,summary&count=2")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Eventually(t, func() bool { return tapCount.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	inside := &net.UDPAddr{IP: net.ParseIP("192.168.0.4"), Port: 1234}
+	outside := &net.UDPAddr{IP: net.ParseIP("10.0.0.4"), Port: 1234}
+	TapPacket([]byte{'u', 1, 0, 8, 0, 0, 0, 5}, outside)
+	TapPacket([]byte{'f', 1, 0, 8, 0, 0, 0, 5}, inside)
+	TapPacket([]byte{'u', 2, 0, 8, 0, 0, 0, 5}, inside)
+	TapPacket([]byte("<statistics/>"), inside)
+	TapPacket([]byte{'u', 3, 0, 8, 0, 0, 0, 5}, inside)
+
+	var packets []LivePacket
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var packet LivePacket
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &packet))
+		packets = append(packets, packet)
+	}
+	if assert.Len(t, packets, 2) {
+		assert.Equal(t, "u", packets[0].Type)
+		assert.Equal(t, uint8(2), packets[0].Pseq)
+		assert.Equal(t, int32(5), packets[0].ServerStart)
+		assert.Equal(t, "7502000800000005", packets[0].Payload)
+		assert.Equal(t, "192.168.0.4:1234", packets[0].Remote)
+		assert.Equal(t, "summary", packets[1].Type)
+		assert.Equal(t, len("<statistics/>"), packets[1].Length)
+	}
+	assert.Eventually(t, func() bool { return tapCount.Load() == 0 }, 5*time.Second, 10*time.Millisecond,
+		"The tap should be removed at the end of the stream")
+}
+
+func TestLivePacketsBadRequest(t *testing.T) {
+	for _, query := range []string{"remote=not-a-network", "count=0", "count=100000", "timeout=-1"} {
+		recorder := httptest.NewRecorder()
+		livePacketsHandler(recorder, httptest.NewRequest(http.MethodGet, "/debug/packets?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, query)
+	}
+}
+
+// TestLivePacketsClients makes sure the clients beyond the limit are turned away
+func TestLivePacketsClients(t *testing.T) {
+	for i := 0; i < maxLiveClients; i++ {
+		tap := addTap(packetFilter{}, 1)
+		require.NotNil(t, tap)
+		defer removeTap(tap)
+	}
+	recorder := httptest.NewRecorder()
+	livePacketsHandler(recorder, httptest.NewRequest(http.MethodGet, "/debug/packets", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+}
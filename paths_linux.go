@@ -0,0 +1,16 @@
+package shoveler
+
+// The shoveler is deployed as a system service on Linux, with the
+// configuration and the queue in the system directories
+const (
+	systemConfigDir = "/etc/xrootd-monitoring-shoveler"
+	systemQueueDir  = "/var/spool/xrootd-monitoring-shoveler/queue"
+)
+
+func defaultConfigDir() string {
+	return systemConfigDir
+}
+
+func defaultQueueDir() string {
+	return systemQueueDir
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package shoveler
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// On other platforms the shoveler is usually run by a developer for testing,
+// without access to the system directories, so the defaults are in the
+// user's configuration and cache directories
+const appDir = "xrootd-monitoring-shoveler"
+
+func defaultConfigDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return appDir
+	}
+	return filepath.Join(dir, appDir)
+}
+
+func defaultQueueDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, appDir, "queue")
+}
@@ -0,0 +1,30 @@
+package shoveler
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+)
+
+// StartProfile serves the pprof profiling endpoints on localhost.
+// The profiles are served on their own port so they are not exposed with the metrics.
+func StartProfile(profilePort int) {
+
+	// Listen to the profile requests in a separate thread
+	go func() {
+		listenAddress := "localhost:" + strconv.Itoa(profilePort)
+		log.Debugln("Starting profiling at " + listenAddress + "/debug/pprof/")
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		err := http.ListenAndServe(listenAddress, mux)
+		if err != nil {
+			log.Errorln("Failed to listen and serve profiles:", err)
+			return
+		}
+	}()
+
+}
@@ -0,0 +1,122 @@
+package shoveler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// When the packets traverse a load balancer or NAT, the source address seen by
+// the shoveler is the load balancer's.  The load balancer may prefix each
+// packet with a PROXY protocol version 2 header carrying the original source
+// address:
+//
+//	12 byte signature, 1 byte version (2) and command (0 local, 1 proxy),
+//	1 byte address family and transport, 2 byte length of the addresses,
+//	source address, destination address, source port, destination port
+//
+// Only the headers of the configured trusted sources are used, so other hosts
+// cannot spoof the address of a server.
+
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyHeaderLen  = 16
+	proxyCmdLocal   = 0x20
+	proxyCmdProxy   = 0x21
+	proxyFamilyUDP4 = 0x12
+	proxyFamilyUDP6 = 0x22
+)
+
+var (
+	errNoProxyHeader      = errors.New("no proxy header")
+	errInvalidProxyHeader = errors.New("invalid proxy header")
+)
+
+// Results of unwrapping the proxy header, used as the metric label
+const (
+	ProxyHeaderOk        = "ok"
+	ProxyHeaderMissing   = "missing"
+	ProxyHeaderInvalid   = "invalid"
+	ProxyHeaderUntrusted = "untrusted"
+)
+
+// ParseProxyHeader returns the original source address in the proxy header
+// and the packet after the header.  The source is nil for a local command,
+// such as a health check of the load balancer.  Fails with errNoProxyHeader if
+// the packet does not start with a proxy header.
+func ParseProxyHeader(packet []byte) (*net.UDPAddr, []byte, error) {
+	if !bytes.HasPrefix(packet, proxySignature) {
+		return nil, packet, errNoProxyHeader
+	}
+	if len(packet) < proxyHeaderLen {
+		return nil, nil, errInvalidProxyHeader
+	}
+	command := packet[12]
+	family := packet[13]
+	length := int(binary.BigEndian.Uint16(packet[14:16]))
+	if len(packet) < proxyHeaderLen+length {
+		return nil, nil, errInvalidProxyHeader
+	}
+	addresses := packet[proxyHeaderLen : proxyHeaderLen+length]
+	payload := packet[proxyHeaderLen+length:]
+
+	switch command {
+	case proxyCmdLocal:
+		return nil, payload, nil
+	case proxyCmdProxy:
+	default:
+		return nil, nil, errInvalidProxyHeader
+	}
+	var ipLen int
+	switch family {
+	case proxyFamilyUDP4:
+		ipLen = net.IPv4len
+	case proxyFamilyUDP6:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, errInvalidProxyHeader
+	}
+	if len(addresses) < 2*ipLen+4 {
+		return nil, nil, errInvalidProxyHeader
+	}
+	source := &net.UDPAddr{
+		IP:   net.IP(append([]byte{}, addresses[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(addresses[2*ipLen : 2*ipLen+2])),
+	}
+	return source, payload, nil
+}
+
+// UnwrapProxyHeader removes the proxy header of a packet received from a
+// trusted source, and returns the packet with its original source address.
+// Packets without a header keep the address they were received from.  The
+// result is ProxyHeaderOk or ProxyHeaderMissing if the packet should be
+// processed, otherwise the reason it should be dropped.
+func UnwrapProxyHeader(packet []byte, remote *net.UDPAddr, trusted []*net.IPNet) ([]byte, *net.UDPAddr, string) {
+	source, payload, err := ParseProxyHeader(packet)
+	if err == errNoProxyHeader {
+		return packet, remote, ProxyHeaderMissing
+	}
+	if !trustedSource(remote.IP, trusted) {
+		return nil, nil, ProxyHeaderUntrusted
+	}
+	if err != nil {
+		return nil, nil, ProxyHeaderInvalid
+	}
+	if source == nil {
+		source = remote
+	}
+	return payload, source, ProxyHeaderOk
+}
+
+// trustedSource returns true if the address is in one of the trusted networks,
+// no source is trusted if no networks are configured
+func trustedSource(ip net.IP, trusted []*net.IPNet) bool {
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package shoveler
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// proxyPacket prefixes the payload with a proxy header for the source address
+func proxyPacket(source *net.UDPAddr, payload []byte) []byte {
+	family, ip := byte(proxyFamilyUDP6), source.IP.To16()
+	if ip4 := source.IP.To4(); ip4 != nil {
+		family, ip = proxyFamilyUDP4, ip4
+	}
+	addresses := append(append([]byte{}, ip...), make([]byte, len(ip))...)
+	addresses = binary.BigEndian.AppendUint16(addresses, uint16(source.Port))
+	addresses = binary.BigEndian.AppendUint16(addresses, 9993)
+
+	packet := append([]byte{}, proxySignature...)
+	packet = append(packet, proxyCmdProxy, family)
+	packet = binary.BigEndian.AppendUint16(packet, uint16(len(addresses)))
+	packet = append(packet, addresses...)
+	return append(packet, payload...)
+}
+
+func TestUnwrapProxyHeader(t *testing.T) {
+	balancer := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	_, trusted, err := net.ParseCIDR("10.0.0.0/24")
+	assert.NoError(t, err)
+	payload := []byte("xrootd packet")
+
+	for _, source := range []*net.UDPAddr{
+		{IP: net.ParseIP("192.0.2.10").To4(), Port: 1234},
+		{IP: net.ParseIP("2001:db8::10"), Port: 1234},
+	} {
+		packet, remote, result := UnwrapProxyHeader(proxyPacket(source, payload), balancer, []*net.IPNet{trusted})
+		assert.Equal(t, ProxyHeaderOk, result)
+		assert.Equal(t, payload, packet)
+		assert.Equal(t, source.String(), remote.String())
+	}
+
+	// Packets without a header keep the address they were received from
+	packet, remote, result := UnwrapProxyHeader(payload, balancer, []*net.IPNet{trusted})
+	assert.Equal(t, ProxyHeaderMissing, result)
+	assert.Equal(t, payload, packet)
+	assert.Equal(t, balancer, remote)
+
+	// Only trusted sources may send a header
+	source := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 1234}
+	spoofer := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1234}
+	_, _, result = UnwrapProxyHeader(proxyPacket(source, payload), spoofer, []*net.IPNet{trusted})
+	assert.Equal(t, ProxyHeaderUntrusted, result)
+	_, _, result = UnwrapProxyHeader(proxyPacket(source, payload), balancer, nil)
+	assert.Equal(t, ProxyHeaderUntrusted, result, "No source is trusted without trusted networks")
+
+	// Truncated header
+	_, _, result = UnwrapProxyHeader(proxyPacket(source, nil)[:20], balancer, []*net.IPNet{trusted})
+	assert.Equal(t, ProxyHeaderInvalid, result)
+}
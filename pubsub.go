@@ -0,0 +1,357 @@
+package shoveler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	pubsubScope       = "https://www.googleapis.com/auth/pubsub"
+	gceMetadataToken  = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	pubsubEmulatorEnv = "PUBSUB_EMULATOR_HOST"
+
+	// Limits of a publish request of the Pub/Sub API, the messages are base64
+	// encoded in a request of at most 10 MB
+	pubsubMaxBatchSize  = 1000
+	pubsubMaxBatchBytes = 7 * 1024 * 1024
+)
+
+// Failures to publish repeat for every batch while Pub/Sub is unavailable
+var pubsubErrors = NewRateLimitedLog(errorLogInterval)
+
+// StartPubSub publishes the messages in the queue to a Google Cloud Pub/Sub topic.
+// This should run in a new go co-routine, it returns once the context is done.
+func StartPubSub(ctx context.Context, config *Config, queue *ConfirmationQueue) {
+	publisher := NewPubSubPublisher(config)
+	// There is no connection to wait for, the output is ready once the credentials give an access token
+	if err := publisher.waitReady(ctx); err != nil {
+		return
+	}
+	defer setOutputReady(false)
+
+	messagesQueue := make(chan []byte)
+	readerDone := make(chan struct{})
+	go func() {
+		readMsg(ctx, messagesQueue, queue)
+		close(readerDone)
+	}()
+
+	// Messages are published in batches of up to PubSubBatchSize messages,
+	// waiting at most PubSubBatchDelay after the first message of a batch
+	batch := make([][]byte, 0, config.PubSubBatchSize)
+	batchBytes := 0
+	var flush <-chan time.Time
+	// publishBatch publishes the batch, and returns false if the context is done first
+	publishBatch := func() bool {
+		err := publisher.publishRetry(ctx, batch)
+		if ctx.Err() != nil {
+			return false
+		}
+		// The batches rejected by Pub/Sub are dropped
+		if err == nil {
+			for _, msg := range batch {
+				JournalMessage(config.PubSubTopic, "", msg)
+			}
+		}
+		batch = batch[:0]
+		batchBytes = 0
+		flush = nil
+		return true
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			<-readerDone
+			// Put the unpublished messages back, they will be kept on disk until the next start
+			queue.Requeue(batch...)
+			return
+		case msg := <-messagesQueue:
+			// Keep the request under the size limit of the API
+			if len(batch) > 0 && batchBytes+len(msg) > pubsubMaxBatchBytes && !publishBatch() {
+				batch = append(batch, msg)
+				continue
+			}
+			if len(batch) == 0 {
+				flush = time.After(config.PubSubBatchDelay)
+			}
+			batch = append(batch, msg)
+			batchBytes += len(msg)
+			if len(batch) < config.PubSubBatchSize {
+				continue
+			}
+		case <-flush:
+		}
+		publishBatch()
+	}
+}
+
+// PubSubPublisher publishes messages with the Pub/Sub REST API
+type PubSubPublisher struct {
+	publishURL  string
+	ordering    bool
+	tokenSource *googleTokenSource
+	client      *http.Client
+}
+
+type pubsubMessage struct {
+	Data        string `json:"data"`
+	OrderingKey string `json:"orderingKey,omitempty"`
+}
+
+type pubsubPublishRequest struct {
+	Messages []pubsubMessage `json:"messages"`
+}
+
+// NewPubSubPublisher creates a publisher for the configured topic.  Credentials come from the
+// configured service account key file, the key file in GOOGLE_APPLICATION_CREDENTIALS, or the
+// GCE metadata server, in that order.  No credentials are used with the Pub/Sub emulator.
+func NewPubSubPublisher(config *Config) *PubSubPublisher {
+	endpoint := config.PubSubEndpoint
+	var tokenSource *googleTokenSource
+	if emulatorHost := os.Getenv(pubsubEmulatorEnv); emulatorHost != "" {
+		endpoint = "http://" + emulatorHost
+	} else {
+		keyFile := config.PubSubCredentials
+		if keyFile == "" {
+			keyFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		}
+		tokenSource = &googleTokenSource{keyFile: keyFile}
+	}
+	return &PubSubPublisher{
+		publishURL: strings.TrimSuffix(endpoint, "/") + "/v1/projects/" + url.PathEscape(config.PubSubProject) +
+			"/topics/" + url.PathEscape(config.PubSubTopic) + ":publish",
+		ordering:    config.PubSubOrdering,
+		tokenSource: tokenSource,
+		client:      &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// waitReady gets an access token, retrying until it succeeds or the context is
+// done, and reports the output as ready
+func (publisher *PubSubPublisher) waitReady(ctx context.Context) error {
+	for publisher.tokenSource != nil {
+		_, err := publisher.tokenSource.Token(publisher.client)
+		if err == nil {
+			break
+		}
+		pubsubErrors.Errorln("Failed to get a Pub/Sub access token, retrying:", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(reconnectDelay):
+		}
+	}
+	setOutputReady(true)
+	return nil
+}
+
+// pubsubStatusError is the response of the Pub/Sub API to a failed publish
+type pubsubStatusError struct {
+	status     string
+	statusCode int
+	body       string
+}
+
+func (e *pubsubStatusError) Error() string {
+	return fmt.Sprintf("publish failed with status %s: %s", e.status, e.body)
+}
+
+// rejected returns whether the batch itself was rejected, such as a malformed
+// or oversized request, so publishing it again fails the same way.  Failures to
+// authenticate or to find the topic are fixed by the configuration, and retried.
+func (e *pubsubStatusError) rejected() bool {
+	return e.statusCode == http.StatusBadRequest || e.statusCode == http.StatusRequestEntityTooLarge
+}
+
+// publishRetry publishes the batch, retrying until it is accepted or the context is done.
+// A batch rejected by Pub/Sub is not retried, it is dropped and its error returned.
+func (publisher *PubSubPublisher) publishRetry(ctx context.Context, batch [][]byte) error {
+	for {
+		err := publisher.Publish(ctx, batch)
+		if err == nil {
+			setOutputReady(true)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var statusErr *pubsubStatusError
+		if errors.As(err, &statusErr) && statusErr.rejected() {
+			log.Errorln("Pub/Sub rejected a batch of", len(batch), "messages, dropping it:", err)
+			PubSubMessagesDropped.Add(float64(len(batch)))
+			return err
+		}
+		setOutputReady(false)
+		pubsubErrors.Errorln("Failed to publish to Pub/Sub, retrying:", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+// Publish sends a batch of messages to the topic.  With ordering enabled, the
+// ID of the server that sent the packet of each message is the ordering key,
+// so messages from a server are delivered in order.
+func (publisher *PubSubPublisher) Publish(ctx context.Context, batch [][]byte) error {
+	request := pubsubPublishRequest{Messages: make([]pubsubMessage, 0, len(batch))}
+	for _, msg := range batch {
+		pubMsg := pubsubMessage{Data: base64.StdEncoding.EncodeToString(msg)}
+		if publisher.ordering {
+			pubMsg.OrderingKey = pubsubOrderingKey(msg)
+		}
+		request.Messages = append(request.Messages, pubMsg)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, publisher.publishURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	if publisher.tokenSource != nil {
+		token, err := publisher.tokenSource.Token(publisher.client)
+		if err != nil {
+			return err
+		}
+		httpRequest.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := publisher.client.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &pubsubStatusError{status: resp.Status, statusCode: resp.StatusCode, body: strings.TrimSpace(string(respBody))}
+	}
+	return nil
+}
+
+// pubsubOrderingKey returns the ID of the server that sent the packet of the
+// message, its start time and address, or only its address for the summary
+// packets, which have no header
+func pubsubOrderingKey(msg []byte) string {
+	envelope, data, err := UnpackageUdp(msg)
+	if err != nil {
+		return ""
+	}
+	if header := ParseHeader(data); header != nil {
+		return strconv.FormatInt(int64(header.ServerStart), 10) + "#" + envelope.Remote
+	}
+	return envelope.Remote
+}
+
+// googleTokenSource gets and caches OAuth2 access tokens for the Pub/Sub API
+type googleTokenSource struct {
+	keyFile string
+	mutex   sync.Mutex
+	token   string
+	expiry  time.Time
+}
+
+type googleServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+type googleTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Token returns a valid access token, refreshing it a minute before it expires
+func (ts *googleTokenSource) Token(client *http.Client) (string, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	if ts.token != "" && time.Now().Add(time.Minute).Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	var request *http.Request
+	var err error
+	if ts.keyFile != "" {
+		request, err = ts.serviceAccountRequest()
+	} else {
+		request, err = http.NewRequest(http.MethodGet, gceMetadataToken, nil)
+		if err == nil {
+			request.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get an access token, status: %s", resp.Status)
+	}
+	tokenResponse := googleTokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", err
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", errors.New("no access token in the token response")
+	}
+	ts.token = tokenResponse.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+// serviceAccountRequest creates the request exchanging a JWT signed by the service account for an access token
+func (ts *googleTokenSource) serviceAccountRequest() (*http.Request, error) {
+	contents, err := os.ReadFile(ts.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	account := googleServiceAccount{}
+	if err := json.Unmarshal(contents, &account); err != nil {
+		return nil, err
+	}
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   account.ClientEmail,
+		"scope": pubsubScope,
+		"aud":   account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+	request, err := http.NewRequest(http.MethodPost, account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request, nil
+}
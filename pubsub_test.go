@@ -0,0 +1,105 @@
+package shoveler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPubSubPublish publishes a batch with service account credentials to a fake Pub/Sub API
+func TestPubSubPublish(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	var published pubsubPublishRequest
+	tokenRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			tokenRequests++
+			assert.NoError(t, r.ParseForm())
+			assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.Form.Get("grant_type"))
+			assert.NotEmpty(t, r.Form.Get("assertion"))
+			_, _ = w.Write([]byte(`{"access_token": "secret", "expires_in": 3600}`))
+		case "/v1/projects/osg/topics/shoveled-xrd:publish":
+			assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&published))
+			_, _ = w.Write([]byte(`{"messageIds": ["1", "2"]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	keyFile := path.Join(t.TempDir(), "key.json")
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	key, err := json.Marshal(googleServiceAccount{ClientEmail: "shoveler@osg.iam.gserviceaccount.com", PrivateKey: string(keyPem), TokenURI: server.URL + "/token"})
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(keyFile, key, 0600))
+
+	config := Config{PubSubProject: "osg", PubSubTopic: "shoveled-xrd", PubSubCredentials: keyFile,
+		PubSubEndpoint: server.URL, PubSubOrdering: true}
+	publisher := NewPubSubPublisher(&config)
+
+	// Ready once the credentials give an access token, before anything is published
+	setOutputReady(false)
+	defer setOutputReady(false)
+	assert.NoError(t, publisher.waitReady(context.Background()))
+	assert.True(t, OutputReady())
+
+	ip := net.UDPAddr{IP: net.ParseIP("192.168.0.7"), Port: 12345}
+	msg := PackageUdp([]byte("asdf"), &ip, &config)
+	assert.NoError(t, publisher.Publish(context.Background(), [][]byte{msg, msg}))
+	assert.NoError(t, publisher.Publish(context.Background(), [][]byte{msg}))
+	assert.Equal(t, 1, tokenRequests, "Access token should be cached")
+
+	assert.Len(t, published.Messages, 1)
+	assert.Equal(t, "192.168.0.7:12345", published.Messages[0].OrderingKey)
+	data, err := base64.StdEncoding.DecodeString(published.Messages[0].Data)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, data)
+}
+
+// TestPubSubOrderingKey makes sure the ordering key is the ID of the server
+func TestPubSubOrderingKey(t *testing.T) {
+	ip := net.UDPAddr{IP: net.ParseIP("192.168.0.7"), Port: 12345}
+	packet := make([]byte, 8)
+	packet[0] = 'f'
+	binary.BigEndian.PutUint32(packet[4:8], 1700000000)
+	assert.Equal(t, "1700000000#192.168.0.7:12345", pubsubOrderingKey(PackageUdp(packet, &ip, &Config{})))
+	assert.Equal(t, "192.168.0.7:12345", pubsubOrderingKey(PackageUdp([]byte("<stats/>"), &ip, &Config{})))
+}
+
+// TestPubSubRejected makes sure a batch rejected by Pub/Sub is dropped rather than retried
+func TestPubSubRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Request payload size exceeds the limit", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	t.Setenv(pubsubEmulatorEnv, strings.TrimPrefix(server.URL, "http://"))
+
+	publisher := NewPubSubPublisher(&Config{PubSubProject: "osg", PubSubTopic: "shoveled-xrd"})
+	dropped := testutil.ToFloat64(PubSubMessagesDropped)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := publisher.publishRetry(ctx, [][]byte{[]byte("test1"), []byte("test2")})
+	assert.Error(t, err)
+	assert.NoError(t, ctx.Err(), "The batch should not be retried")
+	assert.Equal(t, dropped+2, testutil.ToFloat64(PubSubMessagesDropped))
+}
@@ -1,32 +1,25 @@
 package shoveler
 
 import (
-	"container/list"
-
-	"github.com/joncrlsn/dque"
-
-	"errors"
-	"path"
-	"sync"
+	"context"
 	"time"
-)
 
-type MessageStruct struct {
-	Message []byte
-}
+	"github.com/opensciencegrid/xrootd-monitoring-shoveler/queue"
+)
 
+// ConfirmationQueue is the persistent queue of the messages waiting to be
+// published, with the queue size exported as a metric and the spills to
+// disk recorded as operational events
 type ConfirmationQueue struct {
-	diskQueue *dque.DQue
-	mutex     sync.Mutex
-	emptyCond *sync.Cond
-	memQueue  *list.List
-	usingDisk bool
+	*queue.Queue
+	done chan struct{}
 }
 
 var (
-	ErrEmpty     = errors.New("queue is empty")
-	MaxInMemory  = 100
-	LowWaterMark = 50
+	ErrEmpty     = queue.ErrEmpty
+	ErrClosed    = queue.ErrClosed
+	MaxInMemory  = queue.DefaultMaxInMemory
+	LowWaterMark = queue.DefaultLowWaterMark
 )
 
 // NewConfirmationQueue returns an initialized list.
@@ -34,51 +27,69 @@ func NewConfirmationQueue(config *Config) *ConfirmationQueue {
 	return new(ConfirmationQueue).Init(config)
 }
 
-// ItemBuilder creates a new item and returns a pointer to it.
-// This is used when we load a segment of the queue from disk.
-func ItemBuilder() interface{} {
-	return &MessageStruct{}
-}
-
 // Init initializes the queue
 func (cq *ConfirmationQueue) Init(config *Config) *ConfirmationQueue {
-	qName := path.Base(config.QueueDir)
-	qDir := path.Dir(config.QueueDir)
-	segmentSize := 10000
+	var key []byte
+	if config.QueueKeyFile != "" {
+		var err error
+		key, err = queue.ReadKeyFile(config.QueueKeyFile)
+		if err != nil {
+			log.Panicln("Failed to read the queue encryption key:", err)
+		}
+	}
 	var err error
-	cq.diskQueue, err = dque.NewOrOpen(qName, qDir, segmentSize, ItemBuilder)
+	cq.Queue, err = queue.Open(config.QueueDir, queue.Options{
+		MaxInMemory:  MaxInMemory,
+		LowWaterMark: LowWaterMark,
+		OnSpill: func(size int) {
+			EmitEvent(EventQueueSpill, SeverityWarning, map[string]interface{}{"queue_size": size})
+		},
+		OnRestore: func(size int) {
+			EmitEvent(EventQueueRestore, SeverityInfo, map[string]interface{}{"queue_size": size})
+		},
+		OnReclaim: func(bytes int64) {
+			QueueReclaimedBytes.Add(float64(bytes))
+		},
+		OnTruncate: func(bytes int64) {
+			QueueTruncatedSegments.Inc()
+		},
+		Key: key,
+	})
 	if err != nil {
 		log.Panicln("Failed to create queue:", err)
 	}
-	err = cq.diskQueue.TurboOn()
-	if err != nil {
-		log.Errorln("Failed to turn on dque Turbo mode, the queue will be safer but much slower:", err)
-	}
-
-	// Check if we have any messages in the queue
-	if cq.diskQueue.Size() > 0 {
-		cq.usingDisk = true
-	}
-
-	cq.emptyCond = sync.NewCond(&cq.mutex)
+	cq.done = make(chan struct{})
 
 	// Start the metrics goroutine
-	cq.memQueue = list.New()
 	go cq.queueMetrics()
+	if config.QueueMaintenance > 0 {
+		go cq.maintain(config.QueueMaintenance)
+	}
 	return cq
 
 }
 
-func (cq *ConfirmationQueue) Size() int {
-	cq.mutex.Lock()
-	defer cq.mutex.Unlock()
-	if cq.usingDisk {
-		return cq.diskQueue.SizeUnsafe()
-	} else {
-		return cq.memQueue.Len()
+// maintain compacts the queue on disk every interval, when it is worth it
+// Should be run within a go routine
+func (cq *ConfirmationQueue) maintain(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-cq.done:
+			return
+		}
+		if err := cq.Maintain(); err != nil && err != ErrClosed {
+			log.Errorln("Failed to maintain the queue directory:", err)
+		}
 	}
 }
 
+func (cq *ConfirmationQueue) Size() int {
+	return cq.Len()
+}
+
 // queueMetrics updates the queue size prometheus metric
 // Should be run within a go routine
 func (cq *ConfirmationQueue) queueMetrics() {
@@ -87,106 +98,61 @@ func (cq *ConfirmationQueue) queueMetrics() {
 	defer ticker.Stop()
 	// Do a select on the timer
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-cq.done:
+			return
+		}
 		// Update the prometheus
 		queueSizeInt := cq.Size()
 		QueueSize.Set(float64(queueSizeInt))
 		log.Debugln("Queue Size:", queueSizeInt)
+		if usage, err := cq.DiskUsage(); err == nil {
+			QueueDiskBytes.Set(float64(usage))
+		}
 
 	}
 
 }
 
-// Enqueue the message
-func (cq *ConfirmationQueue) Enqueue(msg []byte) {
-	cq.mutex.Lock()
-	defer cq.mutex.Unlock()
-	// Check size of in memory queue
-
-	// Still using in-memory
-	if !cq.usingDisk && (cq.memQueue.Len()+1) < MaxInMemory {
-		cq.memQueue.PushBack(msg)
-	} else if !cq.usingDisk && (cq.memQueue.Len()+1) >= MaxInMemory {
-		// Not using disk queue, but the next message would go over MaxInMemory
-		// Transfer everything to the on-disk queue
-		for cq.memQueue.Len() > 0 {
-			toEnqueue := cq.memQueue.Remove(cq.memQueue.Front()).([]byte)
-			err := cq.diskQueue.Enqueue(&MessageStruct{Message: toEnqueue})
-			if err != nil {
-				log.Errorln("Failed to enqueue message:", err)
-			}
-		}
-		// Enqueue the current
-		err := cq.diskQueue.Enqueue(&MessageStruct{Message: msg})
-		if err != nil {
-			log.Errorln("Failed to enqueue message:", err)
-		}
-		cq.usingDisk = true
-
-	} else {
-		// Last option is we are using disk
-		err := cq.diskQueue.Enqueue(&MessageStruct{Message: msg})
-		if err != nil {
-			log.Errorln("Failed to enqueue message:", err)
-		}
+// Enqueue the message, returning the error if it could not be stored
+func (cq *ConfirmationQueue) Enqueue(msg []byte) error {
+	if injectFault(FaultFailQueueWrite) {
+		return errFaultInjected
 	}
-	cq.emptyCond.Broadcast()
+	return cq.Queue.Enqueue(msg)
 }
 
-// dequeueLocked dequeues a message, assuming the queue has already been locked
-func (cq *ConfirmationQueue) dequeueLocked() ([]byte, error) {
-	// Check if we have a message available in the queue
-	if !cq.usingDisk && cq.memQueue.Len() == 0 {
-		return nil, ErrEmpty
-	} else if cq.usingDisk && cq.diskQueue.Size() == 0 {
-		return nil, ErrEmpty
+// Requeue puts the messages dequeued but not published back at the front of
+// the queue, in order, so they are published first, or kept on disk until the
+// next start
+func (cq *ConfirmationQueue) Requeue(msgs ...[]byte) {
+	if len(msgs) == 0 {
+		return
 	}
-
-	if !cq.usingDisk {
-		return cq.memQueue.Remove(cq.memQueue.Front()).([]byte), nil
-	} else if cq.usingDisk && (cq.diskQueue.Size()-1) >= LowWaterMark {
-		// If we are using disk, and the on disk size is larger than the low water mark
-		msgStruct, err := cq.diskQueue.Dequeue()
-		if err != nil {
-			log.Errorln("Failed to dequeue: ", err)
-		}
-		return msgStruct.(*MessageStruct).Message, err
-	} else {
-		// Using disk, but the next enqueue makes it < LowWaterMark, transfer everything from on disk to in-memory
-		for cq.diskQueue.Size() > 0 {
-			msgStruct, err := cq.diskQueue.Dequeue()
-			if err != nil {
-				log.Errorln("Failed to dequeue: ", err)
-			}
-			cq.memQueue.PushBack(msgStruct.(*MessageStruct).Message)
-		}
-		cq.usingDisk = false
-		return cq.memQueue.Remove(cq.memQueue.Front()).([]byte), nil
+	if err := cq.Queue.Requeue(msgs...); err != nil {
+		log.Errorln("Failed to put", len(msgs), "unpublished messages back in the queue, they are lost:", err)
 	}
-
 }
 
 // Dequeue Blocking function to receive a message
 func (cq *ConfirmationQueue) Dequeue() ([]byte, error) {
-	cq.mutex.Lock()
-	defer cq.mutex.Unlock()
-	for {
-		msg, err := cq.dequeueLocked()
-		if err == ErrEmpty {
-			cq.emptyCond.Wait()
-			// Wait() atomically unlocks mutexEmptyCond and suspends execution of the calling goroutine.
-			// Receiving the signal does not guarantee an item is available, let's loop and check again.
-			continue
-		} else if err != nil {
-			return nil, err
-		}
-		return msg, nil
-	}
+	return cq.Queue.Dequeue(context.Background())
 }
 
-// Close will close the on-disk files
+// DequeueContext Blocking function to receive a message, which returns the
+// context's error if the context is done before a message is available
+func (cq *ConfirmationQueue) DequeueContext(ctx context.Context) ([]byte, error) {
+	return cq.Queue.Dequeue(ctx)
+}
+
+// Close will write the in-memory messages to disk, so they are kept
+// across restarts, and close the on-disk files
 func (cq *ConfirmationQueue) Close() error {
-	cq.mutex.Lock()
-	defer cq.mutex.Unlock()
-	return cq.diskQueue.Close()
+	select {
+	case <-cq.done:
+	default:
+		close(cq.done)
+	}
+	return cq.Queue.Close()
 }
@@ -0,0 +1,74 @@
+package queue
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrNoKey is returned when an encrypted message is read without a key
+var ErrNoKey = errors.New("queue message is encrypted, but no key is configured")
+
+// ReadKeyFile reads a hex encoded AES key of 16, 24, or 32 bytes from a file,
+// such as one created with `openssl rand -hex 32`
+func ReadKeyFile(fileName string) ([]byte, error) {
+	contents, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the queue key in %s: %w", fileName, err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("the queue key in %s is %d bytes, it must be 16, 24, or 32", fileName, len(key))
+}
+
+// NewAEAD returns the AES-GCM cipher of the key, or nil if there is no key
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns the item stored on disk for the message, encrypted if the
+// queue has a key
+func (q *Queue) seal(msg []byte) (*messageStruct, error) {
+	if q.aead == nil {
+		return &messageStruct{Message: msg}, nil
+	}
+	nonce := make([]byte, q.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &messageStruct{Message: q.aead.Seal(nil, nonce, msg, nil), Nonce: nonce}, nil
+}
+
+// open returns the message of an item read from disk, decrypting it if it was
+// encrypted.  Messages written before the key was configured are not encrypted.
+func (q *Queue) open(item *messageStruct) ([]byte, error) {
+	if item.Nonce == nil {
+		return item.Message, nil
+	}
+	if q.aead == nil {
+		return nil, ErrNoKey
+	}
+	msg, err := q.aead.Open(nil, item.Nonce, item.Message, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt queue message: %w", err)
+	}
+	return msg, nil
+}
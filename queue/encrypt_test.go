@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// onDisk returns whether the message is written in clear in a segment file
+func onDisk(t *testing.T, dir string, msg string) bool {
+	segments, err := filepath.Glob(filepath.Join(dir, "*.dque"))
+	assert.NoError(t, err)
+	for _, segment := range segments {
+		contents, err := os.ReadFile(segment)
+		assert.NoError(t, err)
+		if bytes.Contains(contents, []byte(msg)) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestQueueEncryption makes sure the messages are encrypted on disk, and
+// decrypted when read back
+func TestQueueEncryption(t *testing.T) {
+	dir := path.Join(t.TempDir(), "queue")
+	key := bytes.Repeat([]byte{1}, 32)
+	q, err := Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5, Key: key})
+	assert.NoError(t, err)
+	fill(t, q, 0, 20)
+	assert.NoError(t, q.Close())
+	assert.False(t, onDisk(t, dir, "test.0"))
+
+	_, err = Open(dir, Options{})
+	assert.ErrorIs(t, err, ErrNoKey)
+	_, err = Open(dir, Options{Key: bytes.Repeat([]byte{2}, 32)})
+	assert.Error(t, err)
+
+	q, err = Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5, Key: key})
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.Len(t, iterated(t, q), 20)
+	for i := 0; i < 20; i++ {
+		msg, err := q.TryDequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "test."+strconv.Itoa(i), string(msg))
+	}
+}
+
+// TestQueueEncryptionUpgrade makes sure the messages written before the key
+// was configured are read, and encrypted by compacting
+func TestQueueEncryptionUpgrade(t *testing.T) {
+	dir := path.Join(t.TempDir(), "queue")
+	q, err := Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5})
+	assert.NoError(t, err)
+	fill(t, q, 0, 20)
+	assert.NoError(t, q.Close())
+	assert.True(t, onDisk(t, dir, "test.0"))
+
+	q, err = Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5, Key: bytes.Repeat([]byte{1}, 16)})
+	assert.NoError(t, err)
+	defer q.Close()
+	msg, err := q.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, "test.0", string(msg))
+	assert.NoError(t, q.Compact())
+	assert.False(t, onDisk(t, dir, "test.0"))
+	assert.Len(t, iterated(t, q), 20)
+}
+
+// TestReadKeyFile makes sure only hex encoded AES keys are accepted
+func TestReadKeyFile(t *testing.T) {
+	keyFile := path.Join(t.TempDir(), "key")
+	assert.NoError(t, os.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f\n"), 0600))
+	key, err := ReadKeyFile(keyFile)
+	assert.NoError(t, err)
+	assert.Len(t, key, 16)
+
+	assert.NoError(t, os.WriteFile(keyFile, []byte("0001"), 0600))
+	_, err = ReadKeyFile(keyFile)
+	assert.Error(t, err)
+	assert.NoError(t, os.WriteFile(keyFile, []byte("not hex"), 0600))
+	_, err = ReadKeyFile(keyFile)
+	assert.Error(t, err)
+}
@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// Lock protects a queue directory from being used by multiple processes at once.
+// The lock is held with flock on <queue_directory>.lock, and the owner of the lock
+// is described in <queue_directory>.owner.  The operating system releases the lock
+// when the owner exits, so a lock left behind by a crashed process is stale and is
+// taken over.
+type Lock struct {
+	fileLock  *flock.Flock
+	ownerPath string
+}
+
+// LockOwner describes the process holding the queue lock
+type LockOwner struct {
+	Pid      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Started  time.Time `json:"started"`
+}
+
+var ErrLocked = errors.New("queue directory is in use by another process")
+
+func lockPaths(queueDir string) (string, string) {
+	return queueDir + ".lock", queueDir + ".owner"
+}
+
+// readLockOwner reads the owner of the queue lock, if any
+func readLockOwner(ownerPath string) (*LockOwner, error) {
+	contents, err := os.ReadFile(ownerPath)
+	if err != nil {
+		return nil, err
+	}
+	owner := LockOwner{}
+	if err := json.Unmarshal(contents, &owner); err != nil {
+		return nil, err
+	}
+	return &owner, nil
+}
+
+// LockDir takes the lock on the queue directory, failing with ErrLocked
+// if another process holds it
+func LockDir(queueDir string) (*Lock, error) {
+	lockPath, ownerPath := lockPaths(queueDir)
+	fileLock := flock.New(lockPath)
+	locked, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		owner, err := readLockOwner(ownerPath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s (unknown owner: %v)", ErrLocked, queueDir, err)
+		}
+		return nil, fmt.Errorf("%w: %s is locked by pid %d on %s since %s", ErrLocked, queueDir,
+			owner.Pid, owner.Hostname, owner.Started.Format(time.RFC3339))
+	}
+
+	// We have the lock, any previous owner exited without cleaning up
+	if previous, err := readLockOwner(ownerPath); err == nil {
+		log.Warningln("Taking over stale lock on queue directory", queueDir, "from pid", previous.Pid, "on", previous.Hostname)
+	}
+
+	hostname, _ := os.Hostname()
+	owner, err := json.Marshal(LockOwner{Pid: os.Getpid(), Hostname: hostname, Started: time.Now()})
+	if err != nil {
+		_ = fileLock.Unlock()
+		return nil, err
+	}
+	if err := os.WriteFile(ownerPath, owner, 0644); err != nil {
+		_ = fileLock.Unlock()
+		return nil, err
+	}
+	return &Lock{fileLock: fileLock, ownerPath: ownerPath}, nil
+}
+
+// Unlock releases the lock on the queue directory
+func (ql *Lock) Unlock() error {
+	if err := os.Remove(ql.ownerPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warningln("Failed to remove the queue lock owner file:", err)
+	}
+	return ql.fileLock.Unlock()
+}
+
+// LockState reports the owner of the queue directory lock, and whether the owner is still active.
+// It is meant for tools, such as shoveler-status, that inspect a running queue.
+func LockState(queueDir string) (*LockOwner, bool, error) {
+	lockPath, ownerPath := lockPaths(queueDir)
+	owner, err := readLockOwner(ownerPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, false, err
+	}
+	if _, err := os.Stat(lockPath); errors.Is(err, os.ErrNotExist) {
+		return owner, false, nil
+	}
+	fileLock := flock.New(lockPath)
+	locked, err := fileLock.TryLock()
+	if err != nil {
+		return owner, false, err
+	}
+	if locked {
+		// Nobody holds the lock
+		return owner, false, fileLock.Unlock()
+	}
+	return owner, true, nil
+}
@@ -0,0 +1,55 @@
+package queue
+
+import (
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLock makes sure a second lock on the same queue directory is refused
+func TestLock(t *testing.T) {
+	queuePath := path.Join(t.TempDir(), "shoveler-queue")
+	lock, err := LockDir(queuePath)
+	assert.NoError(t, err)
+
+	owner, active, err := LockState(queuePath)
+	assert.NoError(t, err)
+	assert.True(t, active, "Lock should be active")
+	assert.Equal(t, os.Getpid(), owner.Pid)
+
+	_, err = LockDir(queuePath)
+	assert.True(t, errors.Is(err, ErrLocked), "Second lock should fail with ErrLocked")
+
+	assert.NoError(t, lock.Unlock())
+	_, active, err = LockState(queuePath)
+	assert.NoError(t, err)
+	assert.False(t, active, "Lock should be released")
+
+	lock, err = LockDir(queuePath)
+	assert.NoError(t, err)
+	assert.NoError(t, lock.Unlock())
+}
+
+// TestLockStale makes sure a lock left behind by an exited process is taken over
+func TestLockStale(t *testing.T) {
+	queuePath := path.Join(t.TempDir(), "shoveler-queue")
+	_, ownerPath := lockPaths(queuePath)
+	err := os.WriteFile(ownerPath, []byte(`{"pid": 999999, "hostname": "gone", "started": "2022-01-01T00:00:00Z"}`), 0644)
+	assert.NoError(t, err)
+
+	owner, active, err := LockState(queuePath)
+	assert.NoError(t, err)
+	assert.False(t, active, "Stale lock should not be active")
+	assert.Equal(t, 999999, owner.Pid)
+
+	lock, err := LockDir(queuePath)
+	assert.NoError(t, err)
+	owner, active, err = LockState(queuePath)
+	assert.NoError(t, err)
+	assert.True(t, active)
+	assert.Equal(t, os.Getpid(), owner.Pid)
+	assert.NoError(t, lock.Unlock())
+}
@@ -0,0 +1,15 @@
+package queue
+
+import "github.com/sirupsen/logrus"
+
+var log logrus.FieldLogger
+
+func init() {
+	// Give a default logger at the start to avoid null pointer error
+	log = logrus.New()
+}
+
+// SetLogger sets the logger of the queue package
+func SetLogger(logger logrus.FieldLogger) {
+	log = logger
+}
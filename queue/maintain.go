@@ -0,0 +1,228 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// segmentPattern matches the names of the dque segment files
+var segmentPattern = regexp.MustCompile(`^([0-9]+)\.dque$`)
+
+// segmentFile is a dque segment file of the queue directory
+type segmentFile struct {
+	path   string
+	number int
+	size   int64
+}
+
+// segmentFiles returns the segment files of the queue directory, in order
+func segmentFiles(dir string) ([]segmentFile, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var segments []segmentFile
+	for _, entry := range entries {
+		match := segmentPattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		number, _ := strconv.Atoi(match[1])
+		segments = append(segments, segmentFile{path: filepath.Join(dir, entry.Name()), number: number, size: info.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].number < segments[j].number })
+	return segments, nil
+}
+
+// dirSize returns the bytes used by the files under a directory
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			if info, err := entry.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// removeAll removes a file or directory, adding the bytes it used to reclaimed
+func removeAll(path string, reclaimed *int64) error {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	size := dirSize(path)
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	*reclaimed += size
+	return nil
+}
+
+// recoverCompaction finishes or rolls back a compaction interrupted by a
+// crash, and removes the directories it left behind.  Returns the bytes
+// reclaimed.
+func recoverCompaction(dir string) (int64, error) {
+	compactDir := dir + ".compact"
+	oldDir := dir + ".old"
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		// The compaction stopped between the two renames, the compacted
+		// queue was complete if it exists
+		for _, candidate := range []string{compactDir, oldDir} {
+			if _, err := os.Stat(candidate); err == nil {
+				log.Warningln("Recovering the queue directory from the interrupted compaction in", candidate)
+				if err := os.Rename(candidate, dir); err != nil {
+					return 0, err
+				}
+				break
+			}
+		}
+	}
+	var reclaimed int64
+	for _, leftover := range []string{compactDir, oldDir} {
+		if err := removeAll(leftover, &reclaimed); err != nil {
+			return reclaimed, err
+		}
+	}
+	return reclaimed, nil
+}
+
+// pruneSegments truncates the segment files of the queue directory that end
+// with a record torn by a crash to their last complete record, reporting the
+// bytes removed to onTruncate.  It removes the segments that can not be read,
+// or have no messages left, and renumbers the others so they follow each
+// other, as dque expects.  The last segment is kept even if empty, as messages
+// are appended to it.  Returns the bytes reclaimed.
+func pruneSegments(dir string, onTruncate func(bytes int64)) (int64, error) {
+	segments, err := segmentFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+	var reclaimed int64
+	var kept []segmentFile
+	for i, segment := range segments {
+		items, _, err := readSegment(segment.path)
+		var torn *tornSegmentError
+		if errors.As(err, &torn) {
+			log.Warningln("Truncating the queue segment", segment.path, "to its last complete record, after", torn.complete, "bytes")
+			if err := os.Truncate(segment.path, torn.complete); err != nil {
+				return reclaimed, err
+			}
+			reclaimed += segment.size - torn.complete
+			if onTruncate != nil {
+				onTruncate(segment.size - torn.complete)
+			}
+			items, _, err = readSegment(segment.path)
+		}
+		if err != nil {
+			log.Errorln("Removing the queue segment", segment.path, "that can not be read:", err)
+		} else if len(items) == 0 && i < len(segments)-1 {
+			log.Infoln("Removing the empty queue segment", segment.path)
+		} else {
+			kept = append(kept, segment)
+			continue
+		}
+		if err := removeAll(segment.path, &reclaimed); err != nil {
+			return reclaimed, err
+		}
+	}
+
+	// The segments are renamed in order, to numbers that are free or their own
+	for i, segment := range kept {
+		number := kept[0].number + i
+		if segment.number == number {
+			continue
+		}
+		renamed := filepath.Join(dir, fmt.Sprintf("%013d.dque", number))
+		log.Warningln("Renaming the queue segment", segment.path, "to", renamed, "to close a gap in the queue")
+		if err := os.Rename(segment.path, renamed); err != nil {
+			return reclaimed, err
+		}
+	}
+	return reclaimed, nil
+}
+
+// DiskUsage returns the bytes used by the segment files of the queue
+func (q *Queue) DiskUsage() (int64, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	segments, err := segmentFiles(q.dir)
+	if err != nil {
+		return 0, err
+	}
+	var usage int64
+	for _, segment := range segments {
+		usage += segment.size
+	}
+	return usage, nil
+}
+
+// Maintain compacts the queue on disk if most of the space it uses is taken
+// by the messages already dequeued from the first segment, and reports the
+// space reclaimed to OnReclaim.  Meant to be called periodically.  Like
+// Compact, messages can be enqueued while the queue is compacted.
+func (q *Queue) Maintain() error {
+	q.mutex.Lock()
+	q.waitCompactionLocked()
+	usage, worth, err := q.worthCompactingLocked()
+	if err != nil || !worth {
+		q.mutex.Unlock()
+		return err
+	}
+	q.compacting = true
+	q.mutex.Unlock()
+
+	if err := q.compact(); err != nil {
+		return err
+	}
+	segments, err := segmentFiles(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		usage -= segment.size
+	}
+	if usage > 0 && q.options.OnReclaim != nil {
+		q.options.OnReclaim(usage)
+	}
+	return nil
+}
+
+// worthCompactingLocked returns the bytes used by the segment files, and
+// whether most of them are taken by the messages already dequeued, assuming
+// the queue has already been locked
+func (q *Queue) worthCompactingLocked() (int64, bool, error) {
+	if q.closed {
+		return 0, false, ErrClosed
+	}
+	if !q.usingDisk {
+		return 0, false, nil
+	}
+	segments, err := segmentFiles(q.dir)
+	if err != nil || len(segments) == 0 {
+		return 0, false, err
+	}
+	var usage int64
+	for _, segment := range segments {
+		usage += segment.size
+	}
+	_, used, err := readSegment(segments[0].path)
+	if err != nil {
+		return 0, false, err
+	}
+	return usage, 2*(segments[0].size-used) > usage, nil
+}
@@ -0,0 +1,158 @@
+package queue
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPruneSegments makes sure unreadable and empty segments are removed, and
+// the queue still reads the messages of the others
+func TestPruneSegments(t *testing.T) {
+	dir := path.Join(t.TempDir(), "queue")
+	q, err := Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5})
+	assert.NoError(t, err)
+	fill(t, q, 0, 2*segmentSize+10)
+	assert.NoError(t, q.Close())
+	segments, err := segmentFiles(dir)
+	assert.NoError(t, err)
+	assert.Len(t, segments, 3)
+
+	// A segment left behind by an aborted run, before a gap in the numbering
+	orphan := filepath.Join(dir, "0000000000000000.dque")
+	assert.NoError(t, os.WriteFile(orphan, []byte{}, 0644))
+	// A corrupt segment in the middle of the queue
+	assert.NoError(t, os.WriteFile(segments[1].path, []byte{0xff, 0xff}, 0644))
+
+	reclaimed := int64(0)
+	q, err = Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5, OnReclaim: func(bytes int64) { reclaimed += bytes }})
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, int64(2), reclaimed)
+	_, err = os.Stat(orphan)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	messages := iterated(t, q)
+	assert.Len(t, messages, segmentSize+10)
+	assert.Equal(t, "test.0", messages[0])
+	assert.Equal(t, "test."+strconv.Itoa(2*segmentSize), messages[segmentSize])
+	for range messages {
+		_, err := q.TryDequeue()
+		assert.NoError(t, err)
+	}
+	_, err = q.TryDequeue()
+	assert.ErrorIs(t, err, ErrEmpty)
+}
+
+// TestTruncateTornSegment makes sure a record torn by a crash at the end of the
+// last segment is removed, and the messages before it are kept
+func TestTruncateTornSegment(t *testing.T) {
+	dir := path.Join(t.TempDir(), "queue")
+	q, err := Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5})
+	assert.NoError(t, err)
+	fill(t, q, 0, 20)
+	assert.NoError(t, q.Close())
+	segments, err := segmentFiles(dir)
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+
+	// The length of a record, and only part of the record
+	file, err := os.OpenFile(segments[0].path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = file.Write([]byte{100, 0, 0, 0, 1, 2, 3})
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	truncated := int64(0)
+	q, err = Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5, OnTruncate: func(bytes int64) { truncated += bytes }})
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, int64(7), truncated)
+	messages := iterated(t, q)
+	assert.Len(t, messages, 20)
+	assert.Equal(t, "test.19", messages[19])
+	info, err := os.Stat(segments[0].path)
+	assert.NoError(t, err)
+	assert.Equal(t, segments[0].size, info.Size())
+}
+
+// TestRecoverCompaction makes sure a compaction interrupted between its
+// renames is completed when the queue is opened
+func TestRecoverCompaction(t *testing.T) {
+	dir := path.Join(t.TempDir(), "queue")
+	q, err := Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5})
+	assert.NoError(t, err)
+	fill(t, q, 0, 20)
+	assert.NoError(t, q.Close())
+	assert.NoError(t, os.Rename(dir, dir+".compact"))
+	assert.NoError(t, os.MkdirAll(dir+".old", 0755))
+
+	q, err = Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5})
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, 20, q.Len())
+	for _, leftover := range []string{dir + ".compact", dir + ".old"} {
+		_, err = os.Stat(leftover)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+}
+
+// TestMaintain makes sure the queue is compacted once most of it is dequeued
+func TestMaintain(t *testing.T) {
+	dir := path.Join(t.TempDir(), "queue")
+	reclaimed := int64(0)
+	q, err := Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5, OnReclaim: func(bytes int64) { reclaimed += bytes }})
+	assert.NoError(t, err)
+	defer q.Close()
+	fill(t, q, 0, 1000)
+	before, err := q.DiskUsage()
+	assert.NoError(t, err)
+
+	assert.NoError(t, q.Maintain())
+	assert.Equal(t, int64(0), reclaimed, "Nothing is dequeued yet")
+	for i := 0; i < 900; i++ {
+		_, err := q.TryDequeue()
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, q.Maintain())
+	after, err := q.DiskUsage()
+	assert.NoError(t, err)
+	assert.Greater(t, reclaimed, int64(0))
+	assert.Less(t, after, before)
+
+	msg, err := q.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, "test.900", string(msg))
+	assert.Equal(t, 100, q.Len())
+}
+
+// TestCompactEnqueue makes sure the messages enqueued while the queue is
+// compacted are kept, after the messages compacted
+func TestCompactEnqueue(t *testing.T) {
+	q, err := Open(path.Join(t.TempDir(), "queue"), Options{MaxInMemory: 10, LowWaterMark: 5})
+	assert.NoError(t, err)
+	defer q.Close()
+	fill(t, q, 0, 100)
+	for i := 0; i < 50; i++ {
+		_, err := q.TryDequeue()
+		assert.NoError(t, err)
+	}
+
+	// As Compact does, before copying the messages
+	q.mutex.Lock()
+	q.compacting = true
+	q.mutex.Unlock()
+	fill(t, q, 100, 10)
+	assert.Equal(t, 60, q.Len())
+	assert.NoError(t, q.compact())
+
+	messages := iterated(t, q)
+	assert.Len(t, messages, 60)
+	for i, msg := range messages {
+		assert.Equal(t, "test."+strconv.Itoa(50+i), msg)
+	}
+}
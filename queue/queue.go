@@ -0,0 +1,607 @@
+// Package queue is a persistent FIFO queue of messages.  The messages are kept
+// in memory while the queue is short, and spill to a queue on disk when it
+// grows, so a consumer that is unavailable for a long time does not exhaust the
+// memory.  The queue on disk is kept across restarts, and the queue directory
+// is locked so only one process uses it at a time.
+package queue
+
+import (
+	"container/list"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/joncrlsn/dque"
+)
+
+var (
+	ErrEmpty  = errors.New("queue is empty")
+	ErrClosed = errors.New("queue is closed")
+)
+
+const (
+	DefaultMaxInMemory  = 100
+	DefaultLowWaterMark = 50
+	segmentSize         = 10000
+)
+
+// Options configures a queue.  The zero value uses the defaults.
+type Options struct {
+	MaxInMemory  int               // Messages kept in memory before spilling to disk
+	LowWaterMark int               // Messages on disk below which they are moved back to memory
+	OnSpill      func(size int)    // Called when the messages spill to disk, with the queue size
+	OnRestore    func(size int)    // Called when the messages are moved back to memory, with the queue size
+	OnReclaim    func(bytes int64) // Called when maintenance releases disk space, with the bytes released
+	OnTruncate   func(bytes int64) // Called when a segment torn by a crash is truncated, with the bytes of the incomplete record
+	Key          []byte            // AES key of 16, 24, or 32 bytes encrypting the messages on disk, not encrypted if empty
+}
+
+// messageStruct is the item stored in the queue on disk
+type messageStruct struct {
+	Message []byte
+	Nonce   []byte // Nonce of the AES-GCM encrypted message, nil if not encrypted
+}
+
+// itemBuilder creates a new item and returns a pointer to it.
+// This is used when we load a segment of the queue from disk.
+func itemBuilder() interface{} {
+	return &messageStruct{}
+}
+
+// Queue is a persistent FIFO queue of messages, safe for concurrent use
+type Queue struct {
+	dir       string
+	options   Options
+	aead      cipher.AEAD
+	diskQueue *dque.DQue
+	dirLock   *Lock
+	mutex     sync.Mutex
+	emptyCond *sync.Cond
+	memQueue  *list.List
+	usingDisk bool
+	closed    bool
+
+	// While the queue on disk is compacted, the messages enqueued are kept in
+	// pending, and the messages are only dequeued once it is done
+	compacting bool
+	pending    [][]byte
+
+	// Messages put back in front of the queue on disk, written before it on Close
+	front [][]byte
+}
+
+// Open locks the queue directory, and opens the queue in it, creating it if needed.
+// Fails with ErrLocked if another process uses the queue.
+func Open(dir string, options Options) (*Queue, error) {
+	if options.MaxInMemory <= 0 {
+		options.MaxInMemory = DefaultMaxInMemory
+	}
+	if options.LowWaterMark <= 0 {
+		options.LowWaterMark = DefaultLowWaterMark
+	}
+	q := &Queue{dir: dir, options: options}
+	var err error
+	q.aead, err = NewAEAD(options.Key)
+	if err != nil {
+		return nil, err
+	}
+	q.dirLock, err = LockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.prepareDir(); err != nil {
+		_ = q.dirLock.Unlock()
+		return nil, err
+	}
+	q.diskQueue, err = dque.NewOrOpen(filepath.Base(dir), filepath.Dir(dir), segmentSize, itemBuilder)
+	if err != nil {
+		_ = q.dirLock.Unlock()
+		return nil, err
+	}
+	err = q.diskQueue.TurboOn()
+	if err != nil {
+		log.Errorln("Failed to turn on dque Turbo mode, the queue will be safer but much slower:", err)
+	}
+
+	// Check if we have any messages in the queue
+	if q.diskQueue.Size() > 0 {
+		q.usingDisk = true
+		// Fail now, rather than on every message, if the key is not the one they were encrypted with
+		item, err := q.diskQueue.Peek()
+		if err == nil {
+			_, err = q.open(item.(*messageStruct))
+		}
+		if err != nil {
+			_ = q.diskQueue.Close()
+			_ = q.dirLock.Unlock()
+			return nil, err
+		}
+	}
+
+	q.emptyCond = sync.NewCond(&q.mutex)
+	q.memQueue = list.New()
+	return q, nil
+}
+
+// prepareDir cleans up the queue directory before it is opened, after a
+// crash or an interrupted compaction, and reports the space released
+func (q *Queue) prepareDir() error {
+	recovered, err := recoverCompaction(q.dir)
+	if err != nil {
+		return err
+	}
+	pruned, err := pruneSegments(q.dir, q.options.OnTruncate)
+	if err != nil {
+		return err
+	}
+	if reclaimed := recovered + pruned; reclaimed > 0 {
+		log.Infoln("Released", reclaimed, "bytes of leftover files in the queue directory", q.dir)
+		if q.options.OnReclaim != nil {
+			q.options.OnReclaim(reclaimed)
+		}
+	}
+	return nil
+}
+
+// Dir returns the queue directory
+func (q *Queue) Dir() string {
+	return q.dir
+}
+
+// Len returns the number of messages in the queue
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.lenLocked()
+}
+
+func (q *Queue) lenLocked() int {
+	if q.usingDisk {
+		return len(q.front) + q.diskQueue.SizeUnsafe() + len(q.pending)
+	}
+	return q.memQueue.Len()
+}
+
+// Enqueue adds the message at the end of the queue
+func (q *Queue) Enqueue(msg []byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	defer q.emptyCond.Broadcast()
+
+	// Appended to the queue on disk once the compaction is done
+	if q.compacting {
+		q.pending = append(q.pending, msg)
+		return nil
+	}
+
+	// Still using in-memory
+	if !q.usingDisk && (q.memQueue.Len()+1) < q.options.MaxInMemory {
+		q.memQueue.PushBack(msg)
+		return nil
+	}
+	if !q.usingDisk {
+		// Not using disk queue, but the next message would go over MaxInMemory
+		// Transfer everything to the on-disk queue
+		if q.options.OnSpill != nil {
+			q.options.OnSpill(q.memQueue.Len() + 1)
+		}
+		if err := q.spillLocked(); err != nil {
+			return err
+		}
+		q.usingDisk = true
+	}
+	item, err := q.seal(msg)
+	if err != nil {
+		return err
+	}
+	return q.diskQueue.Enqueue(item)
+}
+
+// Requeue puts the messages back at the front of the queue, in order, before
+// the messages already in the queue, such as messages dequeued but not
+// delivered.  In memory, they are written to disk with the others on Close.
+func (q *Queue) Requeue(msgs ...[]byte) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	defer q.emptyCond.Broadcast()
+
+	if !q.usingDisk {
+		for i := len(msgs) - 1; i >= 0; i-- {
+			q.memQueue.PushFront(msgs[i])
+		}
+		return nil
+	}
+	// dque only appends, so they are kept in memory until the queue is closed
+	q.front = append(append(make([][]byte, 0, len(msgs)+len(q.front)), msgs...), q.front...)
+	return nil
+}
+
+// spillLocked moves the messages in memory to the end of the queue on disk
+func (q *Queue) spillLocked() error {
+	for q.memQueue.Len() > 0 {
+		front := q.memQueue.Front()
+		item, err := q.seal(front.Value.([]byte))
+		if err != nil {
+			return err
+		}
+		if err := q.diskQueue.Enqueue(item); err != nil {
+			return err
+		}
+		q.memQueue.Remove(front)
+	}
+	return nil
+}
+
+// peekLocked returns the first message, without removing it
+func (q *Queue) peekLocked() ([]byte, error) {
+	if q.closed {
+		return nil, ErrClosed
+	}
+	if !q.usingDisk {
+		if q.memQueue.Len() == 0 {
+			return nil, ErrEmpty
+		}
+		return q.memQueue.Front().Value.([]byte), nil
+	}
+	if len(q.front) > 0 {
+		return q.front[0], nil
+	}
+	item, err := q.diskQueue.Peek()
+	if err == dque.ErrEmpty {
+		return nil, ErrEmpty
+	} else if err != nil {
+		return nil, err
+	}
+	return q.open(item.(*messageStruct))
+}
+
+// dequeueLocked dequeues a message, assuming the queue has already been locked
+func (q *Queue) dequeueLocked() ([]byte, error) {
+	if q.closed {
+		return nil, ErrClosed
+	}
+	if q.usingDisk && len(q.front) > 0 {
+		msg := q.front[0]
+		q.front = q.front[1:]
+		return msg, nil
+	}
+	// Check if we have a message available in the queue
+	if !q.usingDisk && q.memQueue.Len() == 0 {
+		return nil, ErrEmpty
+	} else if q.usingDisk && q.diskQueue.Size() == 0 {
+		return nil, ErrEmpty
+	}
+
+	if !q.usingDisk {
+		return q.memQueue.Remove(q.memQueue.Front()).([]byte), nil
+	} else if (q.diskQueue.Size() - 1) >= q.options.LowWaterMark {
+		// If we are using disk, and the on disk size is larger than the low water mark
+		item, err := q.diskQueue.Dequeue()
+		if err != nil {
+			return nil, err
+		}
+		return q.open(item.(*messageStruct))
+	}
+
+	// Using disk, but the next enqueue makes it < LowWaterMark, transfer everything from on disk to in-memory
+	if q.options.OnRestore != nil {
+		q.options.OnRestore(q.diskQueue.Size())
+	}
+	for q.diskQueue.Size() > 0 {
+		item, err := q.diskQueue.Dequeue()
+		if err != nil {
+			log.Errorln("Failed to dequeue: ", err)
+			break
+		}
+		msg, err := q.open(item.(*messageStruct))
+		if err != nil {
+			log.Errorln("Failed to read a message from disk, dropping it:", err)
+			continue
+		}
+		q.memQueue.PushBack(msg)
+	}
+	q.usingDisk = false
+	if q.memQueue.Len() == 0 {
+		return nil, ErrEmpty
+	}
+	return q.memQueue.Remove(q.memQueue.Front()).([]byte), nil
+}
+
+// waitCompactionLocked waits for the compaction of the queue on disk to be
+// done, assuming the queue has already been locked
+func (q *Queue) waitCompactionLocked() {
+	for q.compacting {
+		q.emptyCond.Wait()
+	}
+}
+
+// Peek returns the first message without removing it, or ErrEmpty if the queue is empty
+func (q *Queue) Peek() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.waitCompactionLocked()
+	return q.peekLocked()
+}
+
+// TryDequeue removes and returns the first message, or ErrEmpty if the queue is empty
+func (q *Queue) TryDequeue() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.waitCompactionLocked()
+	return q.dequeueLocked()
+}
+
+// Dequeue removes and returns the first message, waiting for one if the queue
+// is empty.  Returns the context's error if the context is done first, or
+// ErrClosed if the queue is closed.
+func (q *Queue) Dequeue(ctx context.Context) ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	waiting := false
+	for {
+		var msg []byte
+		err := ErrEmpty
+		// Wait for the compaction as for an empty queue, until the context is done
+		if !q.compacting {
+			msg, err = q.dequeueLocked()
+		}
+		if err == ErrEmpty {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if !waiting && ctx.Done() != nil {
+				// Wake up the wait below when the context is done
+				waiting = true
+				stop := make(chan struct{})
+				defer close(stop)
+				go func() {
+					select {
+					case <-ctx.Done():
+						q.mutex.Lock()
+						q.emptyCond.Broadcast()
+						q.mutex.Unlock()
+					case <-stop:
+					}
+				}()
+			}
+			q.emptyCond.Wait()
+			// Wait() atomically unlocks the mutex and suspends execution of the calling goroutine.
+			// Receiving the signal does not guarantee an item is available, let's loop and check again.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+}
+
+// Iterate calls fn with each message in the queue, in order, without removing
+// them, and stops at the first error returned by fn.  The queue is locked while
+// iterating.  The messages on disk are read from the segment files, so iterating
+// a long queue reads all of it from disk.
+func (q *Queue) Iterate(fn func(msg []byte) error) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.waitCompactionLocked()
+	if q.closed {
+		return ErrClosed
+	}
+	if !q.usingDisk {
+		for element := q.memQueue.Front(); element != nil; element = element.Next() {
+			if err := fn(element.Value.([]byte)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, msg := range q.front {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return iterateSegments(q.dir, func(item *messageStruct) error {
+		msg, err := q.open(item)
+		if err != nil {
+			return err
+		}
+		return fn(msg)
+	})
+}
+
+// Compact rewrites the messages on disk into new segment files, so the space
+// used by the messages already dequeued is released.  Segments that are
+// completely dequeued are removed as soon as they are, so this is only useful
+// for long-lived queues that stay mostly full.  The messages are copied to
+// <dir>.compact, which then replaces the queue directory.  The messages are
+// encrypted again with the current key, so compacting also encrypts the
+// messages written before the key was configured.
+//
+// The queue is not locked while the messages are copied: the messages
+// enqueued meanwhile are appended once the compaction is done, and the
+// messages are dequeued after it.
+func (q *Queue) Compact() error {
+	q.mutex.Lock()
+	q.waitCompactionLocked()
+	if q.closed {
+		q.mutex.Unlock()
+		return ErrClosed
+	}
+	if !q.usingDisk {
+		q.mutex.Unlock()
+		return nil
+	}
+	q.compacting = true
+	q.mutex.Unlock()
+	return q.compact()
+}
+
+// compact compacts the queue, once the queue is marked as compacting.  Nothing
+// changes the queue on disk while it is, so its files are read without the lock.
+func (q *Queue) compact() error {
+	compactDir := q.dir + ".compact"
+	err := q.copyCompacted(compactDir)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if err == nil {
+		err = q.swapCompacted(compactDir)
+	} else {
+		_ = os.RemoveAll(compactDir)
+	}
+	if finishErr := q.finishCompactionLocked(); err == nil {
+		err = finishErr
+	}
+	return err
+}
+
+// copyCompacted copies the messages on disk to a new queue in compactDir
+func (q *Queue) copyCompacted(compactDir string) error {
+	if err := os.RemoveAll(compactDir); err != nil {
+		return err
+	}
+	compactQueue, err := dque.New(filepath.Base(compactDir), filepath.Dir(compactDir), segmentSize, itemBuilder)
+	if err != nil {
+		return err
+	}
+	if err := compactQueue.TurboOn(); err != nil {
+		log.Errorln("Failed to turn on dque Turbo mode, compacting will be slower:", err)
+	}
+	err = iterateSegments(q.dir, func(item *messageStruct) error {
+		msg, err := q.open(item)
+		if err != nil {
+			return err
+		}
+		if item, err = q.seal(msg); err != nil {
+			return err
+		}
+		return compactQueue.Enqueue(item)
+	})
+	if closeErr := compactQueue.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// swapCompacted replaces the queue directory with the compacted queue in
+// compactDir, assuming the queue has already been locked
+func (q *Queue) swapCompacted(compactDir string) error {
+	if err := q.diskQueue.Close(); err != nil {
+		q.closed = true
+		return err
+	}
+	oldDir := q.dir + ".old"
+	err := os.RemoveAll(oldDir)
+	if err == nil {
+		err = os.Rename(q.dir, oldDir)
+	}
+	if err == nil {
+		err = os.Rename(compactDir, q.dir)
+	}
+	if err == nil {
+		if err := os.RemoveAll(oldDir); err != nil {
+			log.Warningln("Failed to remove the queue directory before compacting:", err)
+		}
+	}
+	var openErr error
+	q.diskQueue, openErr = dque.Open(filepath.Base(q.dir), filepath.Dir(q.dir), segmentSize, itemBuilder)
+	if openErr != nil {
+		q.closed = true
+		return openErr
+	}
+	if err := q.diskQueue.TurboOn(); err != nil {
+		log.Errorln("Failed to turn on dque Turbo mode, the queue will be safer but much slower:", err)
+	}
+	return err
+}
+
+// finishCompactionLocked appends the messages enqueued during the compaction
+// to the queue on disk, and wakes up the calls waiting for it, assuming the
+// queue has already been locked
+func (q *Queue) finishCompactionLocked() error {
+	defer q.emptyCond.Broadcast()
+	q.compacting = false
+	pending := q.pending
+	q.pending = nil
+	if q.closed {
+		if len(pending) > 0 {
+			log.Errorln("Dropping", len(pending), "messages enqueued while compacting the queue, it is closed")
+		}
+		return nil
+	}
+	for i, msg := range pending {
+		item, err := q.seal(msg)
+		if err == nil {
+			err = q.diskQueue.Enqueue(item)
+		}
+		if err != nil {
+			log.Errorln("Dropping", len(pending)-i, "messages enqueued while compacting the queue:", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Close writes the messages in memory to disk, so they are kept across
+// restarts, closes the on-disk files, and releases the queue directory.
+// Blocked Dequeue calls return ErrClosed.
+func (q *Queue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.waitCompactionLocked()
+	if q.closed {
+		return nil
+	}
+	spillErr := q.spillLocked()
+	q.closed = true
+	// Wake up the blocked Dequeue calls
+	q.emptyCond.Broadcast()
+	if err := q.diskQueue.Close(); err != nil {
+		return err
+	}
+	frontErr := q.writeFrontLocked()
+	if err := q.dirLock.Unlock(); err != nil {
+		return err
+	}
+	if spillErr != nil {
+		return spillErr
+	}
+	return frontErr
+}
+
+// writeFrontLocked writes the messages put back in front of the queue on disk
+// to its first segment, once the queue on disk is closed
+func (q *Queue) writeFrontLocked() error {
+	if len(q.front) == 0 {
+		return nil
+	}
+	front := make([]*messageStruct, 0, len(q.front))
+	for _, msg := range q.front {
+		item, err := q.seal(msg)
+		if err != nil {
+			return err
+		}
+		front = append(front, item)
+	}
+	segments, err := segmentFiles(q.dir)
+	if err == nil && len(segments) == 0 {
+		err = errors.New("no queue segment to write the messages to")
+	}
+	if err == nil {
+		err = prependSegment(segments[0].path, front)
+	}
+	if err != nil {
+		log.Errorln("Dropping", len(q.front), "messages put back in the queue:", err)
+		return err
+	}
+	q.front = nil
+	return nil
+}
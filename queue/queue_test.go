@@ -0,0 +1,145 @@
+package queue
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fill enqueues count messages numbered from start
+func fill(t *testing.T, q *Queue, start int, count int) {
+	for i := start; i < start+count; i++ {
+		assert.NoError(t, q.Enqueue([]byte("test."+strconv.Itoa(i))))
+	}
+}
+
+// iterated returns the messages in the queue, using Iterate
+func iterated(t *testing.T, q *Queue) []string {
+	var messages []string
+	assert.NoError(t, q.Iterate(func(msg []byte) error {
+		messages = append(messages, string(msg))
+		return nil
+	}))
+	return messages
+}
+
+// TestQueueIterate makes sure Iterate returns the messages in order, in memory and on disk
+func TestQueueIterate(t *testing.T) {
+	q, err := Open(path.Join(t.TempDir(), "queue"), Options{MaxInMemory: 10, LowWaterMark: 5})
+	assert.NoError(t, err)
+	defer q.Close()
+
+	fill(t, q, 0, 5)
+	assert.Equal(t, 5, q.Len())
+	assert.Equal(t, []string{"test.0", "test.1", "test.2", "test.3", "test.4"}, iterated(t, q))
+
+	// Spill to disk, and dequeue from the front of the disk queue
+	fill(t, q, 5, 25)
+	for i := 0; i < 3; i++ {
+		msg, err := q.Dequeue(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "test."+strconv.Itoa(i), string(msg))
+	}
+	messages := iterated(t, q)
+	assert.Equal(t, q.Len(), len(messages))
+	for i, msg := range messages {
+		assert.Equal(t, "test."+strconv.Itoa(i+3), msg)
+	}
+
+	msg, err := q.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, "test.3", string(msg))
+	assert.Equal(t, 27, q.Len(), "Peek should not remove the message")
+}
+
+// TestQueueCompact makes sure compacting keeps the messages in order
+func TestQueueCompact(t *testing.T) {
+	dir := path.Join(t.TempDir(), "queue")
+	q, err := Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5})
+	assert.NoError(t, err)
+	fill(t, q, 0, 50)
+	for i := 0; i < 20; i++ {
+		_, err := q.TryDequeue()
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, q.Compact())
+	assert.NoError(t, q.Close())
+
+	q, err = Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5})
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, 30, q.Len())
+	for i := 20; i < 50; i++ {
+		msg, err := q.TryDequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "test."+strconv.Itoa(i), string(msg))
+	}
+	_, err = q.TryDequeue()
+	assert.ErrorIs(t, err, ErrEmpty)
+}
+
+// dequeueAll dequeues the messages left, and checks they are numbered in order from start
+func dequeueAll(t *testing.T, q *Queue, start int, count int) {
+	for i := start; i < start+count; i++ {
+		msg, err := q.TryDequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "test."+strconv.Itoa(i), string(msg))
+	}
+	_, err := q.TryDequeue()
+	assert.ErrorIs(t, err, ErrEmpty)
+}
+
+// TestQueueRequeue makes sure the messages put back are dequeued first, in
+// memory, on disk, and after the queue is opened again
+func TestQueueRequeue(t *testing.T) {
+	for _, count := range []int{5, 30, segmentSize + 20} {
+		dir := path.Join(t.TempDir(), "queue")
+		q, err := Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5})
+		assert.NoError(t, err)
+		fill(t, q, 0, count)
+		var dequeued [][]byte
+		for i := 0; i < 3; i++ {
+			msg, err := q.TryDequeue()
+			assert.NoError(t, err)
+			dequeued = append(dequeued, msg)
+		}
+		fill(t, q, count, 5)
+		assert.NoError(t, q.Requeue(dequeued[1:]...))
+		assert.NoError(t, q.Requeue(dequeued[0]))
+		assert.Equal(t, count+5, q.Len())
+		msg, err := q.Peek()
+		assert.NoError(t, err)
+		assert.Equal(t, "test.0", string(msg))
+		messages := iterated(t, q)
+		assert.Equal(t, "test.0", messages[0])
+		assert.Equal(t, "test."+strconv.Itoa(count+4), messages[count+4])
+		assert.NoError(t, q.Close())
+
+		q, err = Open(dir, Options{MaxInMemory: 10, LowWaterMark: 5})
+		assert.NoError(t, err)
+		assert.Equal(t, count+5, q.Len())
+		dequeueAll(t, q, 0, count+5)
+		assert.NoError(t, q.Close())
+	}
+}
+
+// TestQueueClosed makes sure a closed queue refuses messages, and releases the directory
+func TestQueueClosed(t *testing.T) {
+	dir := path.Join(t.TempDir(), "queue")
+	q, err := Open(dir, Options{})
+	assert.NoError(t, err)
+	_, err = Open(dir, Options{})
+	assert.ErrorIs(t, err, ErrLocked)
+
+	assert.NoError(t, q.Close())
+	assert.ErrorIs(t, q.Enqueue([]byte("test")), ErrClosed)
+	_, err = q.Dequeue(context.Background())
+	assert.ErrorIs(t, err, ErrClosed)
+
+	q, err = Open(dir, Options{})
+	assert.NoError(t, err)
+	assert.NoError(t, q.Close())
+}
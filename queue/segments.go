@@ -0,0 +1,177 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// iterateSegments reads the messages in the dque segment files of the queue
+// directory, in order.  Each segment file is a sequence of a 4 byte little
+// endian length and a gob encoded item.  A length of 0 records the removal of
+// the first item remaining in the segment.
+func iterateSegments(dir string, fn func(item *messageStruct) error) error {
+	segments, err := filepath.Glob(filepath.Join(dir, "*.dque"))
+	if err != nil {
+		return err
+	}
+	// The segment files are named after their zero padded number
+	sort.Strings(segments)
+	for _, segment := range segments {
+		items, _, err := readSegment(segment)
+		if err != nil {
+			return fmt.Errorf("failed to read queue segment %s: %w", segment, err)
+		}
+		for _, item := range items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tornSegmentError is returned by readSegment when the segment file ends in the
+// middle of a record, as left by a crash while the record was written
+type tornSegmentError struct {
+	complete int64 // Bytes of the file up to the end of the last complete record
+}
+
+func (e *tornSegmentError) Error() string {
+	return fmt.Sprintf("the last record is incomplete after %d bytes", e.complete)
+}
+
+func (e *tornSegmentError) Unwrap() error {
+	return io.ErrUnexpectedEOF
+}
+
+// readSegment returns the items remaining in a segment file, and the bytes of
+// the file they use.  The rest of the file is used by the items already
+// dequeued, and the deletion records.  Returns a *tornSegmentError if the file
+// ends with an incomplete record.
+func readSegment(segment string) ([]*messageStruct, int64, error) {
+	items, sizes, _, err := scanSegment(segment)
+	if err != nil {
+		return nil, 0, err
+	}
+	var used int64
+	for _, size := range sizes {
+		used += size
+	}
+	return items, used, nil
+}
+
+// scanSegment returns the items remaining in a segment file, the bytes of
+// their records, and the number of items already dequeued
+func scanSegment(segment string) ([]*messageStruct, []int64, int, error) {
+	if !strings.HasSuffix(segment, ".dque") {
+		return nil, nil, 0, fmt.Errorf("not a queue segment")
+	}
+	file, err := os.Open(segment)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var items []*messageStruct
+	var sizes []int64
+	removed := 0
+	lenBytes := make([]byte, 4)
+	var offset int64
+	for {
+		if _, err := io.ReadFull(reader, lenBytes); err == io.EOF {
+			return items, sizes, removed, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return nil, nil, 0, &tornSegmentError{complete: offset}
+		} else if err != nil {
+			return nil, nil, 0, err
+		}
+		gobLen := binary.LittleEndian.Uint32(lenBytes)
+		if gobLen == 0 {
+			if len(items) == 0 {
+				return nil, nil, 0, fmt.Errorf("excess deletion records")
+			}
+			items = items[1:]
+			sizes = sizes[1:]
+			removed++
+			offset += int64(len(lenBytes))
+			continue
+		}
+		data := make([]byte, gobLen)
+		if _, err := io.ReadFull(reader, data); err == io.ErrUnexpectedEOF || err == io.EOF {
+			return nil, nil, 0, &tornSegmentError{complete: offset}
+		} else if err != nil {
+			return nil, nil, 0, err
+		}
+		item := &messageStruct{}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(item); err != nil {
+			return nil, nil, 0, err
+		}
+		items = append(items, item)
+		sizes = append(sizes, int64(len(lenBytes))+int64(gobLen))
+		offset += int64(len(lenBytes)) + int64(gobLen)
+	}
+}
+
+// prependSegment rewrites a segment file of a closed queue with the items
+// before the items remaining in it.  dque only moves on to the next segment
+// once it has read as many records as a full segment holds, so the records of
+// the items already dequeued are kept, as empty items.
+func prependSegment(segment string, front []*messageStruct) error {
+	items, _, removed, err := scanSegment(segment)
+	if err != nil {
+		return err
+	}
+	tmpPath := segment + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	writeItem := func(item *messageStruct) error {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(item); err != nil {
+			return err
+		}
+		if err := binary.Write(writer, binary.LittleEndian, uint32(buf.Len())); err != nil {
+			return err
+		}
+		_, err := writer.Write(buf.Bytes())
+		return err
+	}
+	for i := 0; i < removed && err == nil; i++ {
+		err = writeItem(&messageStruct{})
+	}
+	for i := 0; i < removed && err == nil; i++ {
+		// A deletion record
+		err = binary.Write(writer, binary.LittleEndian, uint32(0))
+	}
+	for _, items := range [][]*messageStruct{front, items} {
+		for _, item := range items {
+			if err == nil {
+				err = writeItem(item)
+			}
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, segment)
+}
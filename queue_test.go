@@ -1,6 +1,8 @@
 package shoveler
 
 import (
+	"context"
+	"fmt"
 	"path"
 	"strconv"
 	"testing"
@@ -68,6 +70,94 @@ func TestQueueEmptyDequeue(t *testing.T) {
 
 }
 
+// TestQueueDequeueContext Make sure a blocked dequeue returns when the context is cancelled
+func TestQueueDequeueContext(t *testing.T) {
+	queuePath := path.Join(t.TempDir(), "shoveler-queue")
+	config := Config{QueueDir: queuePath}
+	queue := NewConfirmationQueue(&config)
+	defer func(queue *ConfirmationQueue) {
+		err := queue.Close()
+		if err != nil {
+			assert.NoError(t, err)
+		}
+	}(queue)
+	ctx, cancel := context.WithCancel(context.Background())
+	doneChan := make(chan bool)
+	go func() {
+		_, err := queue.DequeueContext(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+		doneChan <- true
+	}()
+	select {
+	case <-doneChan:
+		assert.Fail(t, "Dequeue Returned before expected")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	select {
+	case <-doneChan:
+	case <-time.After(100 * time.Millisecond):
+		assert.Fail(t, "Dequeue did not return after the context was cancelled")
+	}
+}
+
+// TestQueueCloseKeepsMessages Make sure the messages in memory are kept on disk across restarts
+func TestQueueCloseKeepsMessages(t *testing.T) {
+	queuePath := path.Join(t.TempDir(), "shoveler-queue")
+	config := Config{QueueDir: queuePath}
+	queue := NewConfirmationQueue(&config)
+	for i := 0; i < 10; i++ {
+		queue.Enqueue([]byte("test." + strconv.Itoa(i)))
+	}
+	assert.NoError(t, queue.Close())
+
+	queue = NewConfirmationQueue(&config)
+	defer func(queue *ConfirmationQueue) {
+		err := queue.Close()
+		if err != nil {
+			assert.NoError(t, err)
+		}
+	}(queue)
+	assert.Equal(t, 10, queue.Size())
+	for i := 0; i < 10; i++ {
+		msg, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "test."+strconv.Itoa(i), string(msg))
+	}
+}
+
+// TestReadMsgRequeue makes sure the message read but not published when the
+// publisher stops is put back in front of the messages enqueued since
+func TestReadMsgRequeue(t *testing.T) {
+	queuePath := path.Join(t.TempDir(), "shoveler-queue")
+	config := Config{QueueDir: queuePath}
+	queue := NewConfirmationQueue(&config)
+	defer queue.Close()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, queue.Enqueue([]byte("test."+strconv.Itoa(i))))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		// Nothing publishes the message read
+		readMsg(ctx, make(chan []byte), queue)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return queue.Size() == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, queue.Enqueue([]byte("test.3")))
+	cancel()
+	<-done
+
+	assert.Equal(t, 4, queue.Size())
+	for i := 0; i < 4; i++ {
+		msg, err := queue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "test."+strconv.Itoa(i), string(msg))
+	}
+}
+
 // TestQueueLotsEntries adds many, many entries to the queue, and makes sure they are de-queued correctly
 func TestQueueLotsEntries(t *testing.T) {
 
@@ -107,3 +197,57 @@ func TestQueueLotsEntries(t *testing.T) {
 	}
 
 }
+
+// TestQueuePerServerOrder makes sure messages from each server are dequeued in the order
+// they were enqueued, across the transitions between the in-memory and on-disk queues
+func TestQueuePerServerOrder(t *testing.T) {
+	queuePath := path.Join(t.TempDir(), "shoveler-queue")
+	config := Config{QueueDir: queuePath}
+	queue := NewConfirmationQueue(&config)
+	servers := []string{"192.168.0.1", "192.168.0.2", "192.168.0.3"}
+
+	enqueued := 0
+	enqueue := func(count int) {
+		for i := 0; i < count; i++ {
+			server := servers[enqueued%len(servers)]
+			queue.Enqueue([]byte(server + " " + strconv.Itoa(enqueued)))
+			enqueued++
+		}
+	}
+	lastSeen := make(map[string]int)
+	dequeue := func(count int) {
+		for i := 0; i < count; i++ {
+			msg, err := queue.Dequeue()
+			assert.NoError(t, err)
+			var server string
+			var seq int
+			_, err = fmt.Sscanf(string(msg), "%s %d", &server, &seq)
+			assert.NoError(t, err)
+			if last, ok := lastSeen[server]; ok {
+				assert.Greater(t, seq, last, "Message from %s dequeued out of order", server)
+			}
+			lastSeen[server] = seq
+		}
+	}
+
+	// Spill over to disk, drain below the low water mark, and spill again
+	enqueue(MaxInMemory * 3)
+	dequeue(MaxInMemory*3 - LowWaterMark + 1)
+	enqueue(MaxInMemory * 2)
+	dequeue(MaxInMemory)
+	assert.NoError(t, queue.Close())
+
+	// Reopen the queue, the messages on disk should continue where they left off
+	queue = NewConfirmationQueue(&config)
+	defer func(queue *ConfirmationQueue) {
+		err := queue.Close()
+		if err != nil {
+			assert.NoError(t, err)
+		}
+	}(queue)
+	remaining := queue.Size()
+	assert.Greater(t, remaining, 0)
+	enqueue(MaxInMemory)
+	dequeue(remaining + MaxInMemory)
+	assert.Equal(t, 0, queue.Size())
+}
@@ -0,0 +1,64 @@
+package shoveler
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// How often to check whether the output is connected while waiting for it
+const readyCheckInterval = 100 * time.Millisecond
+
+// outputReady is reported by the publisher, other connections to the message
+// bus, such as the self-test's, do not change it
+var outputReady atomic.Bool
+
+// setOutputReady records whether the publisher can publish, also exported as
+// the MQConnected metric
+func setOutputReady(ready bool) {
+	outputReady.Store(ready)
+	if ready {
+		MQConnected.Set(1)
+	} else {
+		MQConnected.Set(0)
+	}
+}
+
+// OutputReady returns whether the publisher is connected to the message bus,
+// or to the relay destination
+func OutputReady() bool {
+	return outputReady.Load()
+}
+
+// WaitForOutput blocks until the output is connected, so packets are not only
+// stored in the queue when the output is misconfigured.  Returns false if the
+// timeout expired, or the context is done, first.  A timeout of 0 waits forever.
+func WaitForOutput(ctx context.Context, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	ticker := time.NewTicker(readyCheckInterval)
+	defer ticker.Stop()
+	for !OutputReady() {
+		select {
+		case <-ticker.C:
+		case <-expired:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// readyHandler answers 200 when the output is connected, and 503 otherwise,
+// for readiness probes
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !OutputReady() {
+		http.Error(w, "not ready: the output is not connected", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ready\n"))
+}
@@ -0,0 +1,32 @@
+package shoveler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestWaitForOutput makes sure the wait returns once the output is connected, or after the timeout
+func TestWaitForOutput(t *testing.T) {
+	setOutputReady(false)
+	defer setOutputReady(false)
+	assert.False(t, WaitForOutput(context.Background(), 200*time.Millisecond))
+
+	recorder := httptest.NewRecorder()
+	readyHandler(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		setOutputReady(true)
+	}()
+	assert.True(t, WaitForOutput(context.Background(), 0))
+
+	recorder = httptest.NewRecorder()
+	readyHandler(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
@@ -0,0 +1,361 @@
+package shoveler
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The relay protocol chains shovelers over TCP, optionally with TLS.  The sending
+// shoveler writes frames of a 4 byte length, an 8 byte sequence number, and the
+// message.  The receiving shoveler enqueues each message and replies with the
+// 8 byte sequence number as the acknowledgement.  Messages not acknowledged when
+// the connection fails are re-sent, so every message is delivered at least once.
+// At most RelayWindow messages are sent without an acknowledgement.
+
+const (
+	// maxRelayMessage is larger than any packaged UDP packet
+	maxRelayMessage = 1024 * 1024
+)
+
+var errRelayMessageSize = errors.New("relay message is too large")
+
+type relayFrame struct {
+	seq uint64
+	msg []byte
+}
+
+// writeRelayFrame writes a message frame to the relay connection
+func writeRelayFrame(w io.Writer, seq uint64, msg []byte) error {
+	if len(msg) > maxRelayMessage {
+		return errRelayMessageSize
+	}
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(msg)))
+	binary.BigEndian.PutUint64(header[4:12], seq)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// readRelayFrame reads a message frame from the relay connection
+func readRelayFrame(r io.Reader) (uint64, []byte, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRelayMessage {
+		return 0, nil, errRelayMessageSize
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint64(header[4:12]), msg, nil
+}
+
+// loadCertPool reads the PEM encoded CA certificates in caFile
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caCerts, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCerts) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// relayClientTLSConfig returns the TLS configuration to connect to the relay destination,
+// nil if TLS is not enabled
+func relayClientTLSConfig(config *Config) (*tls.Config, error) {
+	if !config.RelayTLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.RelayCA != "" {
+		pool, err := loadCertPool(config.RelayCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.RelayCert != "" && config.RelayCertKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.RelayCert, config.RelayCertKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Failures to connect repeat while the relay destination is unavailable
+var relayErrors = NewRateLimitedLog(errorLogInterval)
+
+// StartRelay sends the messages in the queue to another shoveler.
+// This should run in a new go co-routine, it returns once the context is done.
+func StartRelay(ctx context.Context, config *Config, queue *ConfirmationQueue) {
+	tlsConfig, err := relayClientTLSConfig(config)
+	if err != nil {
+		log.Fatalln("Failed to configure TLS for the relay:", err)
+	}
+
+	messagesQueue := make(chan []byte)
+	readerDone := make(chan struct{})
+	go func() {
+		readMsg(ctx, messagesQueue, queue)
+		close(readerDone)
+	}()
+
+	var inFlight []relayFrame
+	var nextSeq uint64
+	for ctx.Err() == nil {
+		conn, err := dialRelay(ctx, config.RelayDestination, tlsConfig)
+		if err != nil {
+			setOutputReady(false)
+			if ctx.Err() != nil {
+				break
+			}
+			relayErrors.Errorln("Failed to connect to the relay destination, retrying:", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(reconnectDelay):
+			}
+			continue
+		}
+		setOutputReady(true)
+		log.Debugln("Connected to relay destination", config.RelayDestination)
+		inFlight, nextSeq = relayMessages(ctx, conn, config.RelayWindow, messagesQueue, inFlight, nextSeq)
+		setOutputReady(false)
+		conn.Close()
+	}
+
+	<-readerDone
+	// Put the messages not acknowledged back, they will be kept on disk until the next start
+	unacknowledged := make([][]byte, 0, len(inFlight))
+	for _, frame := range inFlight {
+		unacknowledged = append(unacknowledged, frame.msg)
+	}
+	queue.Requeue(unacknowledged...)
+}
+
+func dialRelay(ctx context.Context, destination string, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if tlsConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: tlsConfig}
+		return tlsDialer.DialContext(ctx, "tcp", destination)
+	}
+	return dialer.DialContext(ctx, "tcp", destination)
+}
+
+// relayMessages sends messages over the connection until it fails or the context is done,
+// and returns the messages not acknowledged yet, to be re-sent on the next connection
+func relayMessages(ctx context.Context, conn net.Conn, window int, messagesQueue <-chan []byte, inFlight []relayFrame, nextSeq uint64) ([]relayFrame, uint64) {
+	acks := make(chan uint64)
+	connErr := make(chan error, 1)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		ack := make([]byte, 8)
+		for {
+			if _, err := io.ReadFull(conn, ack); err != nil {
+				connErr <- err
+				return
+			}
+			select {
+			case acks <- binary.BigEndian.Uint64(ack):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	writer := bufio.NewWriter(conn)
+	// Re-send the messages that were not acknowledged on the previous connection
+	for _, frame := range inFlight {
+		if err := writeRelayFrame(writer, frame.seq, frame.msg); err != nil {
+			log.Errorln("Failed to re-send message to the relay destination:", err)
+			return inFlight, nextSeq
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		log.Errorln("Failed to re-send messages to the relay destination:", err)
+		return inFlight, nextSeq
+	}
+
+	for {
+		// Stop reading new messages while the window is full
+		incoming := messagesQueue
+		if len(inFlight) >= window {
+			incoming = nil
+		}
+		select {
+		case msg := <-incoming:
+			frame := relayFrame{seq: nextSeq, msg: msg}
+			nextSeq++
+			inFlight = append(inFlight, frame)
+			err := writeRelayFrame(writer, frame.seq, frame.msg)
+			if err == nil {
+				err = writer.Flush()
+			}
+			if err != nil {
+				log.Errorln("Failed to send message to the relay destination:", err)
+				return inFlight, nextSeq
+			}
+		case seq := <-acks:
+			acked := 0
+			for acked < len(inFlight) && inFlight[acked].seq <= seq {
+				JournalMessage(conn.RemoteAddr().String(), "", inFlight[acked].msg)
+				acked++
+			}
+			inFlight = inFlight[acked:]
+		case err := <-connErr:
+			log.Errorln("Connection to the relay destination failed:", err)
+			return inFlight, nextSeq
+		case <-ctx.Done():
+			return inFlight, nextSeq
+		}
+	}
+}
+
+// RelayListener accepts the connections of the shovelers relaying messages
+type RelayListener struct {
+	net.Listener
+	receivers sync.WaitGroup
+}
+
+// Wait returns once the listener is closed and the messages of every
+// connection are enqueued, so the queue can be closed
+func (l *RelayListener) Wait() {
+	l.receivers.Wait()
+}
+
+// ListenRelay accepts messages relayed by other shovelers and adds them to the queue.
+// Once the context is done, the listener and the connections are closed.
+func ListenRelay(ctx context.Context, config *Config, queue *ConfirmationQueue) (*RelayListener, error) {
+	listener, err := net.Listen("tcp", config.RelayListen)
+	if err != nil {
+		return nil, err
+	}
+	if config.RelayListenCert != "" && config.RelayListenCertKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.RelayListenCert, config.RelayListenCertKey)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+		if config.RelayListenCA != "" {
+			pool, err := loadCertPool(config.RelayListenCA)
+			if err != nil {
+				listener.Close()
+				return nil, err
+			}
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	log.Debugln("Listening for relayed messages at:", listener.Addr().String())
+
+	relayListener := &RelayListener{Listener: listener}
+	relayListener.receivers.Add(1)
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	go func() {
+		defer relayListener.receivers.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				log.Errorln("Failed to accept relay connection:", err)
+				continue
+			}
+			relayListener.receivers.Add(1)
+			go func() {
+				defer relayListener.receivers.Done()
+				receiveRelay(ctx, conn, queue, config.Checksum)
+			}()
+		}
+	}()
+	return relayListener, nil
+}
+
+// corruptedMessage returns whether the packet of the message does not match its checksum
+func corruptedMessage(msg []byte) bool {
+	_, _, err := UnpackageUdp(msg)
+	return errors.Is(err, ErrChecksumMismatch)
+}
+
+// Corrupted relayed messages may repeat for every message of a failing relay
+var relayChecksumErrors = NewRateLimitedLog(errorLogInterval)
+
+// receiveRelay enqueues the messages received on a relay connection, acknowledging
+// each one once it is stored.  If a message cannot be enqueued, or with verify
+// does not match its checksum, as it was corrupted in transit, the connection is
+// closed without acknowledging it, so the sender sends it again.
+func receiveRelay(ctx context.Context, conn net.Conn, queue *ConfirmationQueue, verify bool) {
+	done := make(chan struct{})
+	defer close(done)
+	defer conn.Close()
+	// Closing the connection stops the read below once the context is done
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	log.Debugln("Accepted relay connection from", conn.RemoteAddr().String())
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	ack := make([]byte, 8)
+	for {
+		seq, msg, err := readRelayFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Warningln("Relay connection from", conn.RemoteAddr().String(), "failed:", err)
+			}
+			return
+		}
+		RelayMessagesReceived.Inc()
+		if verify && corruptedMessage(msg) {
+			relayChecksumErrors.Warningln("Closing the relay connection from", conn.RemoteAddr().String(), "to receive a corrupted packet again")
+			// The messages before it are stored
+			_ = writer.Flush()
+			return
+		}
+		if err := queue.Enqueue(msg); err != nil {
+			log.Errorln("Closing the relay connection from", conn.RemoteAddr().String(), "without acknowledging a message:", err)
+			_ = writer.Flush()
+			return
+		}
+		binary.BigEndian.PutUint64(ack, seq)
+		if _, err := writer.Write(ack); err != nil {
+			return
+		}
+		// Acknowledge once all the frames already received are enqueued
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
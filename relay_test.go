@@ -0,0 +1,114 @@
+package shoveler
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayFrame(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.NoError(t, writeRelayFrame(buf, 42, []byte("test1")))
+	assert.NoError(t, writeRelayFrame(buf, 43, []byte{}))
+	seq, msg, err := readRelayFrame(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), seq)
+	assert.Equal(t, []byte("test1"), msg)
+	seq, msg, err = readRelayFrame(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(43), seq)
+	assert.Empty(t, msg)
+
+	assert.ErrorIs(t, writeRelayFrame(buf, 44, make([]byte, maxRelayMessage+1)), errRelayMessageSize)
+}
+
+// TestRelay relays messages from one shoveler's queue to another's
+func TestRelay(t *testing.T) {
+	receiverQueue := NewConfirmationQueue(&Config{QueueDir: path.Join(t.TempDir(), "receiver-queue")})
+	defer receiverQueue.Close()
+	listener, err := ListenRelay(context.Background(), &Config{RelayListen: "127.0.0.1:0"}, receiverQueue)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	senderConfig := Config{QueueDir: path.Join(t.TempDir(), "sender-queue"), RelayDestination: listener.Addr().String(), RelayWindow: 10}
+	senderQueue := NewConfirmationQueue(&senderConfig)
+	defer senderQueue.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	relayDone := make(chan bool)
+	go func() {
+		StartRelay(ctx, &senderConfig, senderQueue)
+		close(relayDone)
+	}()
+	defer func() {
+		cancel()
+		<-relayDone
+	}()
+
+	for i := 0; i < 500; i++ {
+		senderQueue.Enqueue([]byte("test." + strconv.Itoa(i)))
+	}
+	for i := 0; i < 500; i++ {
+		msg, err := receiverQueue.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, "test."+strconv.Itoa(i), string(msg))
+	}
+}
+
+// TestRelayChecksum makes sure the relayed messages with a corrupted packet are not acknowledged
+func TestRelayChecksum(t *testing.T) {
+	receiverQueue := NewConfirmationQueue(&Config{QueueDir: path.Join(t.TempDir(), "receiver-queue")})
+	defer receiverQueue.Close()
+	listener, err := ListenRelay(context.Background(), &Config{RelayListen: "127.0.0.1:0", Checksum: true}, receiverQueue)
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	remote := &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: 1234}
+	good := PackageUdp([]byte("asdf"), remote, &Config{Checksum: true})
+	corrupted := bytes.Replace(good, []byte(base64.StdEncoding.EncodeToString([]byte("asdf"))),
+		[]byte(base64.StdEncoding.EncodeToString([]byte("asdg"))), 1)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, writeRelayFrame(conn, 1, good))
+	assert.NoError(t, writeRelayFrame(conn, 2, corrupted))
+	ack := make([]byte, 8)
+	_, err = io.ReadFull(conn, ack)
+	assert.NoError(t, err, "The good message should be acknowledged")
+	assert.Equal(t, uint64(1), binary.BigEndian.Uint64(ack))
+	_, err = io.ReadFull(conn, ack)
+	assert.ErrorIs(t, err, io.EOF, "The corrupted message should not be acknowledged")
+
+	msg, err := receiverQueue.Dequeue()
+	assert.NoError(t, err)
+	assert.Equal(t, good, msg)
+	assert.Equal(t, 0, receiverQueue.Size())
+}
+
+// TestRelayEnqueueFailure makes sure the messages that cannot be enqueued are not acknowledged
+func TestRelayEnqueueFailure(t *testing.T) {
+	receiverQueue := NewConfirmationQueue(&Config{QueueDir: path.Join(t.TempDir(), "receiver-queue")})
+	ctx, cancel := context.WithCancel(context.Background())
+	listener, err := ListenRelay(ctx, &Config{RelayListen: "127.0.0.1:0"}, receiverQueue)
+	assert.NoError(t, err)
+	assert.NoError(t, receiverQueue.Close())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, writeRelayFrame(conn, 1, []byte("test")))
+	_, err = io.ReadFull(conn, make([]byte, 8))
+	assert.ErrorIs(t, err, io.EOF, "The message should not be acknowledged")
+
+	// The listener and the connections are closed once the context is done
+	cancel()
+	listener.Wait()
+}
@@ -0,0 +1,104 @@
+package shoveler
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// InvalidPacketSample is an invalid packet kept for debugging
+type InvalidPacketSample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Remote    string    `json:"remote"`
+	Reason    string    `json:"reason"`
+	Length    int       `json:"length"`
+	Payload   string    `json:"payload"` // Hex encoded, truncated to maxSampledPayload bytes
+}
+
+// Only the beginning of the invalid packets is kept, the header is in the first bytes
+const maxSampledPayload = 512
+
+// PacketSampler keeps a sample of the invalid packets in a bounded buffer.  The
+// first packet of each reason is always kept, then 1 in every rate packets, so
+// a server sending only invalid packets does not flush the others out.
+type PacketSampler struct {
+	rate    int
+	mutex   sync.Mutex
+	counts  map[string]int
+	samples []InvalidPacketSample
+	next    int // Position of the next sample once the buffer is full
+	size    int
+}
+
+// NewPacketSampler keeps 1 in every rate invalid packets, at most size of them
+func NewPacketSampler(rate int, size int) *PacketSampler {
+	if rate < 1 {
+		rate = 1
+	}
+	return &PacketSampler{rate: rate, size: size, counts: make(map[string]int)}
+}
+
+// Sample records the invalid packet if it is selected
+func (ps *PacketSampler) Sample(packet []byte, remote *net.UDPAddr, reason string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	count := ps.counts[reason]
+	ps.counts[reason] = count + 1
+	if count%ps.rate != 0 || ps.size <= 0 {
+		return
+	}
+	payload := packet
+	if len(payload) > maxSampledPayload {
+		payload = payload[:maxSampledPayload]
+	}
+	sample := InvalidPacketSample{
+		Timestamp: time.Now(),
+		Reason:    reason,
+		Length:    len(packet),
+		Payload:   hex.EncodeToString(payload),
+	}
+	if remote != nil {
+		sample.Remote = remote.String()
+	}
+	if len(ps.samples) < ps.size {
+		ps.samples = append(ps.samples, sample)
+		return
+	}
+	ps.samples[ps.next] = sample
+	ps.next = (ps.next + 1) % ps.size
+}
+
+// Samples returns the samples kept, oldest first
+func (ps *PacketSampler) Samples() []InvalidPacketSample {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	samples := make([]InvalidPacketSample, 0, len(ps.samples))
+	samples = append(samples, ps.samples[ps.next:]...)
+	return append(samples, ps.samples[:ps.next]...)
+}
+
+// InvalidPackets is the sample of the invalid packets received, served at /debug/invalid_packets
+var InvalidPackets = NewPacketSampler(100, 50)
+
+// ConfigureInvalidPackets sets the sampling of the invalid packets from the configuration
+func ConfigureInvalidPackets(config *Config) {
+	InvalidPackets = NewPacketSampler(config.InvalidSampleRate, config.InvalidSampleSize)
+}
+
+// RecordInvalidPacket counts the invalid packet, and keeps a sample of them for debugging
+func RecordInvalidPacket(packet []byte, remote *net.UDPAddr, reason string) {
+	ValidationsFailed.Inc()
+	ValidationsFailedReason.WithLabelValues(reason).Inc()
+	InvalidPackets.Sample(packet, remote, reason)
+}
+
+// invalidPacketsHandler serves the sample of the invalid packets as JSON
+func invalidPacketsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(InvalidPackets.Samples()); err != nil {
+		log.Errorln("Failed to write the invalid packets:", err)
+	}
+}
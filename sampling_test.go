@@ -0,0 +1,36 @@
+package shoveler
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPacketSampler makes sure 1 in every rate packets is kept, in a bounded buffer
+func TestPacketSampler(t *testing.T) {
+	sampler := NewPacketSampler(10, 3)
+	remote := &net.UDPAddr{IP: net.ParseIP("192.168.0.4"), Port: 1234}
+	for i := 0; i < 100; i++ {
+		sampler.Sample([]byte("packet."+strconv.Itoa(i)), remote, PacketLengthMismatch)
+	}
+	// The first packet of another reason is always kept
+	sampler.Sample([]byte{1, 2}, remote, PacketTooShort)
+
+	samples := sampler.Samples()
+	if assert.Len(t, samples, 3) {
+		assert.Equal(t, PacketLengthMismatch, samples[0].Reason)
+		assert.Equal(t, "7061636b65742e3830", samples[0].Payload, "packet.80 hex encoded")
+		assert.Equal(t, "7061636b65742e3930", samples[1].Payload, "packet.90 hex encoded")
+		assert.Equal(t, PacketTooShort, samples[2].Reason)
+		assert.Equal(t, "0102", samples[2].Payload)
+		assert.Equal(t, "192.168.0.4:1234", samples[2].Remote)
+	}
+}
+
+func TestPacketError(t *testing.T) {
+	assert.Equal(t, PacketTooShort, PacketError([]byte{1, 2, 3}))
+	assert.Equal(t, PacketLengthMismatch, PacketError([]byte{1, 2, 0, 16, 0, 0, 0, 0}))
+	assert.Equal(t, "", PacketError([]byte{1, 2, 0, 8, 0, 0, 0, 0}))
+}
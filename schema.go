@@ -0,0 +1,19 @@
+package shoveler
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:generate go run ./internal/schemagen -source packageudp.go -o schema/message.schema.json
+
+// MessageSchema is the JSON Schema of the Message envelope, generated from its definition
+//
+//go:embed schema/message.schema.json
+var MessageSchema []byte
+
+// schemaHandler serves the JSON Schema of the Message envelope
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	_, _ = w.Write(MessageSchema)
+}
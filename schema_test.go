@@ -0,0 +1,30 @@
+package shoveler
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMessageSchema makes sure the schema was generated again after the envelope changed
+func TestMessageSchema(t *testing.T) {
+	var schema struct {
+		Properties map[string]interface{} `json:"properties"`
+	}
+	assert.NoError(t, json.Unmarshal(MessageSchema, &schema))
+	messageType := reflect.TypeOf(Message{})
+	assert.Len(t, schema.Properties, messageType.NumField(), "Run go generate to update the schema")
+	for i := 0; i < messageType.NumField(); i++ {
+		name, _, _ := strings.Cut(messageType.Field(i).Tag.Get("json"), ",")
+		assert.Contains(t, schema.Properties, name, "Run go generate to update the schema")
+	}
+
+	recorder := httptest.NewRecorder()
+	schemaHandler(recorder, httptest.NewRequest("GET", "/schema/message.json", nil))
+	assert.Equal(t, "application/schema+json", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, MessageSchema, recorder.Body.Bytes())
+}
@@ -0,0 +1,90 @@
+package shoveler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+)
+
+// XRootD packets mapping a dictionary id to the user's authentication information.
+// After the 8 byte header and the 4 byte dictionary id, the packet holds the
+// user id, a newline, and the information as &key=value pairs.
+const (
+	packetUserLogin = 'u'
+	packetTokenInfo = 'T'
+)
+
+// scrubFields maps the names of the fields that may be scrubbed to their key
+// in the authentication information of 'u' and 'T' packets
+var scrubFields = map[string]string{
+	"dn":      "n", // The DN of the user's certificate, or the user name
+	"subject": "s", // The subject of the user's token
+	"groups":  "g",
+	"org":     "o",
+	"role":    "r",
+	"host":    "h",
+	"info":    "m",
+}
+
+// scrubKeys returns the keys of the named fields, ignoring the unknown ones
+func scrubKeys(names []string) []string {
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		key, ok := scrubFields[name]
+		if !ok {
+			known := make([]string, 0, len(scrubFields))
+			for knownName := range scrubFields {
+				known = append(known, knownName)
+			}
+			sort.Strings(known)
+			log.Warningln("Unknown field to scrub", name, "known fields are:", known)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// ScrubPacket blanks the values of the keys in the authentication information
+// of 'u' and 'T' packets, and returns the packet with the header length
+// updated.  Other packets, and packets that cannot be parsed, are returned
+// unchanged.
+func ScrubPacket(packet []byte, keys []string) []byte {
+	if len(keys) == 0 || len(packet) < 12 || (packet[0] != packetUserLogin && packet[0] != packetTokenInfo) {
+		return packet
+	}
+	newline := bytes.IndexByte(packet[12:], '\n')
+	if newline < 0 {
+		return packet
+	}
+	infoStart := 12 + newline + 1
+
+	scrubbed := make([]byte, infoStart, len(packet))
+	copy(scrubbed, packet[:infoStart])
+	changed := false
+	for i, pair := range bytes.Split(packet[infoStart:], []byte{'&'}) {
+		if i > 0 {
+			scrubbed = append(scrubbed, '&')
+		}
+		if equal := bytes.IndexByte(pair, '='); equal > 0 && equal < len(pair)-1 && containsKey(keys, pair[:equal]) {
+			pair = pair[:equal+1]
+			changed = true
+		}
+		scrubbed = append(scrubbed, pair...)
+	}
+	if !changed {
+		return packet
+	}
+	binary.BigEndian.PutUint16(scrubbed[2:4], uint16(len(scrubbed)))
+	PacketsScrubbed.Inc()
+	return scrubbed
+}
+
+func containsKey(keys []string, key []byte) bool {
+	for _, candidate := range keys {
+		if candidate == string(key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package shoveler
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mapPacket builds a 'u' or 'T' packet with the user id and authentication information
+func mapPacket(code byte, info string) []byte {
+	packet := make([]byte, 12, 12+len(info))
+	packet[0] = code
+	binary.BigEndian.PutUint32(packet[4:8], 1234)
+	binary.BigEndian.PutUint32(packet[8:12], 42)
+	packet = append(packet, info...)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	return packet
+}
+
+func TestScrubPacket(t *testing.T) {
+	keys := scrubKeys([]string{"dn", "subject", "groups", "unknown"})
+	assert.Equal(t, []string{"n", "s", "g"}, keys)
+
+	login := mapPacket('u', "user.1:2@host\n&p=gsi&n=/DC=org/CN=Some User&h=host&o=&r=&g=/cms /cms/ops&m=")
+	scrubbed := ScrubPacket(login, keys)
+	assert.Equal(t, mapPacket('u', "user.1:2@host\n&p=gsi&n=&h=host&o=&r=&g=&m="), scrubbed)
+	assert.Equal(t, "", PacketError(scrubbed), "The scrubbed packet is still valid")
+
+	token := mapPacket('T', "user.1:2@host\n&Uc=7&s=a1b2c3&n=user&o=https://issuer&r=&g=/cms")
+	assert.Equal(t, mapPacket('T', "user.1:2@host\n&Uc=7&s=&n=&o=https://issuer&r=&g="), ScrubPacket(token, keys))
+
+	// Other packets are not changed
+	file := mapPacket('f', "\n&n=name")
+	assert.Equal(t, file, ScrubPacket(file, keys))
+	unchanged := mapPacket('u', "user.1:2@host\n&p=unix&h=host")
+	assert.Equal(t, unchanged, ScrubPacket(unchanged, keys))
+	assert.Equal(t, []byte("u"), ScrubPacket([]byte("u"), keys))
+}
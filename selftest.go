@@ -0,0 +1,210 @@
+package shoveler
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/opensciencegrid/xrootd-monitoring-shoveler/queue"
+)
+
+// Checks of the self-test, the check label of shoveler_self_test_success
+const (
+	SelfTestQueue   = "queue"
+	SelfTestPublish = "publish"
+)
+
+// The server returns an unroutable canary before confirming it, but the return
+// is handed over by another goroutine, so it is waited for after the confirm
+var selfTestReturnWait = 1 * time.Second
+
+// Canary is the message published by the self-test
+type Canary struct {
+	SelfTest  string `json:"self_test"` // Random ID of the self-test run
+	Hostname  string `json:"hostname"`
+	Version   string `json:"version"`
+	Timestamp int64  `json:"timestamp"` // Unix time in milliseconds the self-test started
+}
+
+// selfTestCheck is a check of the self-test
+type selfTestCheck struct {
+	name string
+	run  func() error
+}
+
+func newCanary() ([]byte, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	return json.Marshal(Canary{
+		SelfTest:  hex.EncodeToString(id),
+		Hostname:  hostname,
+		Version:   ShovelerVersion,
+		Timestamp: time.Now().UnixMilli(),
+	})
+}
+
+// RunSelfTest checks that a message can be written to a queue on disk and
+// read back, and that the message bus accepts a canary message published to
+// the self-test routing key.  The result of each check is exported in
+// shoveler_self_test_success.  Returns the error of the first check that
+// failed.
+func RunSelfTest(ctx context.Context, config *Config) error {
+	ctx, cancel := context.WithTimeout(ctx, config.SelfTestTimeout)
+	defer cancel()
+	msg, err := newCanary()
+	if err != nil {
+		return err
+	}
+
+	checks := []selfTestCheck{{SelfTestQueue, func() error { return selfTestQueue(config, msg) }}}
+	switch config.MQ {
+	case "amqp":
+		checks = append(checks, selfTestCheck{SelfTestPublish, func() error { return selfTestAMQP(ctx, config, msg) }})
+	case "stomp":
+		checks = append(checks, selfTestCheck{SelfTestPublish, func() error { return selfTestStomp(ctx, config, msg) }})
+	default:
+		log.Warningln("The self-test does not publish a canary message with", config.MQ)
+	}
+
+	for _, check := range checks {
+		if err := check.run(); err != nil {
+			SelfTestSuccess.WithLabelValues(check.name).Set(0)
+			EmitEvent(EventSelfTest, SeverityError, map[string]interface{}{"check": check.name, "error": err.Error()})
+			return fmt.Errorf("self-test %s check failed: %w", check.name, err)
+		}
+		SelfTestSuccess.WithLabelValues(check.name).Set(1)
+		log.Infoln("Self-test", check.name, "check passed")
+	}
+	EmitEvent(EventSelfTest, SeverityInfo, map[string]interface{}{"mq": config.MQ})
+	return nil
+}
+
+// selfTestQueue writes the message to a queue on disk, next to the queue
+// directory, and reads it back after reopening the queue, as after a restart
+func selfTestQueue(config *Config, msg []byte) error {
+	var key []byte
+	if config.QueueKeyFile != "" {
+		var err error
+		if key, err = queue.ReadKeyFile(config.QueueKeyFile); err != nil {
+			return err
+		}
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(config.QueueDir), filepath.Base(config.QueueDir)+".self-test-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	// Only one message in memory, so the message is written to disk
+	options := queue.Options{MaxInMemory: 1, Key: key}
+	testQueue, err := queue.Open(filepath.Join(dir, "queue"), options)
+	if err != nil {
+		return err
+	}
+	if err := testQueue.Enqueue(msg); err != nil {
+		_ = testQueue.Close()
+		return err
+	}
+	if err := testQueue.Close(); err != nil {
+		return err
+	}
+
+	testQueue, err = queue.Open(filepath.Join(dir, "queue"), options)
+	if err != nil {
+		return err
+	}
+	defer testQueue.Close()
+	read, err := testQueue.TryDequeue()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(read, msg) {
+		return errors.New("the message read back from the queue differs from the one written")
+	}
+	return nil
+}
+
+// selfTestAMQP publishes the message to the exchange with the self-test
+// routing key, and waits for the server to confirm it.  The check fails if the
+// server returns the message, as no queue is bound to the routing key.
+func selfTestAMQP(ctx context.Context, config *Config, msg []byte) error {
+	token, err := readToken(config.TokenLocation(config.AmqpExchange))
+	if err != nil {
+		return err
+	}
+	amqpUrl := *config.AmqpURL
+	amqpUrl.User = url.UserPassword("shoveler", token)
+
+	// Wait for the confirm of the message, and leave the stream to the publisher
+	testConfig := *config
+	testConfig.StrictOrder = true
+	testConfig.AmqpStream = ""
+	session := New(amqpUrl, config.AmqpExchange, &testConfig)
+	session.routingKey = config.SelfTestRoutingKey
+	defer session.Close()
+
+	ticker := time.NewTicker(readyCheckInterval)
+	defer ticker.Stop()
+	for !session.isReady.Load() {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("not connected to %s: %w", amqpUrl.Host, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	pushed := make(chan error, 1)
+	go func() {
+		pushed <- session.Push(config.AmqpExchange, msg)
+	}()
+	select {
+	case err := <-pushed:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return fmt.Errorf("the canary message was not confirmed: %w", ctx.Err())
+	}
+	select {
+	case ret := <-session.returns:
+		return fmt.Errorf("the canary message was returned by the server, no queue is bound to %s: %s",
+			config.SelfTestRoutingKey, ret.ReplyText)
+	case <-time.After(selfTestReturnWait):
+		return nil
+	}
+}
+
+// selfTestStomp sends the message to the self-test topic, and waits for the
+// receipt of the server
+func selfTestStomp(ctx context.Context, config *Config, msg []byte) error {
+	options := stompOptions(config)
+	options.Receipt = true
+	topic := stompDestination(config.SelfTestRoutingKey)
+	session := GetNewStompConnection(ctx, config.StompUser, config.StompPassword,
+		*config.StompURL, topic, options, config.StompCert, config.StompCertKey)
+	if ctx.Err() != nil {
+		return fmt.Errorf("not connected to %s: %w", config.StompURL.Host, ctx.Err())
+	}
+	defer session.disconnect()
+
+	published := make(chan error, 1)
+	go func() {
+		published <- session.publish(msg)
+	}()
+	select {
+	case err := <-published:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("the canary message was not received: %w", ctx.Err())
+	}
+}
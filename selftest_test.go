@@ -0,0 +1,58 @@
+package shoveler
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTestStomp(t *testing.T) {
+	stompUrl, _ := startStompBroker(t)
+	sub := subscribeStomp(t, stompUrl, "/topic/shoveler.self-test")
+	config := Config{
+		MQ:                 "stomp",
+		QueueDir:           path.Join(t.TempDir(), "shoveler-queue"),
+		StompURL:           stompUrl,
+		StompTopic:         "shoveled-xrd",
+		SelfTestTimeout:    10 * time.Second,
+		SelfTestRoutingKey: "shoveler.self-test",
+	}
+	setOutputReady(false)
+	require.NoError(t, RunSelfTest(context.Background(), &config))
+	assert.False(t, OutputReady(), "The self-test does not report the readiness of the output")
+	assert.Equal(t, 1.0, testutil.ToFloat64(SelfTestSuccess.WithLabelValues(SelfTestQueue)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(SelfTestSuccess.WithLabelValues(SelfTestPublish)))
+
+	select {
+	case msg := <-sub.C:
+		require.NoError(t, msg.Err)
+		var canary Canary
+		require.NoError(t, json.Unmarshal(msg.Body, &canary))
+		assert.Len(t, canary.SelfTest, 16)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The canary message was not received")
+	}
+
+	// The queue of the self-test is removed
+	entries, err := os.ReadDir(filepath.Dir(config.QueueDir))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestSelfTestQueueFailure(t *testing.T) {
+	config := Config{
+		MQ:              "relay",
+		QueueDir:        path.Join(t.TempDir(), "missing", "shoveler-queue"),
+		SelfTestTimeout: 10 * time.Second,
+	}
+	assert.Error(t, RunSelfTest(context.Background(), &config))
+	assert.Equal(t, 0.0, testutil.ToFloat64(SelfTestSuccess.WithLabelValues(SelfTestQueue)))
+}
@@ -0,0 +1,100 @@
+package shoveler
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Status is the shoveler status written to the status file, for monitoring
+// systems that cannot scrape the prometheus endpoint
+type Status struct {
+	Timestamp         time.Time `json:"timestamp"`
+	Version           string    `json:"version"`
+	QueueSize         int       `json:"queue_size"`
+	PacketsReceived   int64     `json:"packets_received"`
+	PacketsPerSecond  float64   `json:"packets_per_second"`
+	ValidationsFailed int64     `json:"validations_failed"`
+	Connected         bool      `json:"connected"`
+}
+
+// metricValue returns the current value of a counter or gauge
+func metricValue(metric prometheus.Metric) float64 {
+	m := dto.Metric{}
+	if err := metric.Write(&m); err != nil {
+		log.Errorln("Failed to read metric value:", err)
+		return 0
+	}
+	if m.Counter != nil {
+		return m.Counter.GetValue()
+	}
+	return m.Gauge.GetValue()
+}
+
+// StartStatusFile writes the status of the shoveler to the status file every interval.
+// This should run in a new go co-routine, it returns once the context is done.
+func StartStatusFile(ctx context.Context, config *Config, queue *ConfirmationQueue) {
+	ticker := time.NewTicker(config.StatusFileInterval)
+	defer ticker.Stop()
+	lastPackets := metricValue(PacketsReceived)
+	lastTime := time.Now()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		packets := metricValue(PacketsReceived)
+		status := Status{
+			Timestamp:         now,
+			Version:           ShovelerVersion,
+			QueueSize:         queue.Size(),
+			PacketsReceived:   int64(packets),
+			PacketsPerSecond:  (packets - lastPackets) / now.Sub(lastTime).Seconds(),
+			ValidationsFailed: int64(metricValue(ValidationsFailed)),
+			Connected:         OutputReady(),
+		}
+		lastPackets = packets
+		lastTime = now
+		if err := writeStatusFile(config.StatusFile, &status); err != nil {
+			log.Errorln("Failed to write the status file:", err)
+		}
+	}
+}
+
+// writeStatusFile atomically replaces the status file, so readers never see a partial status
+func writeStatusFile(statusFile string, status *Status) error {
+	contents, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(statusFile, append(contents, '\n'), 0644)
+}
+
+// writeFileAtomic writes the contents to a temporary file in the same directory,
+// then renames it over the file, so the file is always complete
+func writeFileAtomic(fileName string, contents []byte, perm os.FileMode) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err = tmpFile.Write(contents); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Chmod(perm); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), fileName)
+}
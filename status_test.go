@@ -0,0 +1,32 @@
+package shoveler
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestWriteStatusFile makes sure the status file is replaced with the latest status
+func TestWriteStatusFile(t *testing.T) {
+	statusDir := t.TempDir()
+	statusFile := path.Join(statusDir, "status.json")
+	for _, queueSize := range []int{5, 10} {
+		status := Status{Timestamp: time.Now(), QueueSize: queueSize, Connected: true}
+		assert.NoError(t, writeStatusFile(statusFile, &status))
+
+		contents, err := os.ReadFile(statusFile)
+		assert.NoError(t, err)
+		readStatus := Status{}
+		assert.NoError(t, json.Unmarshal(contents, &readStatus))
+		assert.Equal(t, queueSize, readStatus.QueueSize)
+		assert.True(t, readStatus.Connected)
+	}
+	// No temporary files should be left behind
+	entries, err := os.ReadDir(statusDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
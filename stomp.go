@@ -1,81 +1,183 @@
 package shoveler
 
 import (
+	"context"
 	"crypto/tls"
+	"net"
 	"net/url"
 	"strings"
 	"time"
 
 	stomp "github.com/go-stomp/stomp/v3"
+	"github.com/go-stomp/stomp/v3/frame"
 )
 
-func StartStomp(config *Config, queue *ConfirmationQueue) {
+// Failures to publish repeat for every message while the server is unavailable
+var stompErrors = NewRateLimitedLog(errorLogInterval)
+
+// How often to reconnect, to keep the connections balanced between the brokers
+var stompRebalanceInterval = 1 * time.Hour
+
+// StartStomp publishes the queued messages to the stomp server, until the
+// context is done
+func StartStomp(ctx context.Context, config *Config, queue *ConfirmationQueue) {
 
 	// TODO: Get the username, password, server, topic from the config
 	stompUser := config.StompUser
 	stompPassword := config.StompPassword
 	stompUrl := config.StompURL
-	stompTopic := config.StompTopic
+	stompTopic := stompDestination(config.StompTopic)
 	stompCert := config.StompCert
 	stompCertKey := config.StompCertKey
 
-	if !strings.HasPrefix(stompTopic, "/topic/") {
-		stompTopic = "/topic/" + stompTopic
+	summaryTopic := config.SummaryTopic
+	if summaryTopic != "" {
+		summaryTopic = stompDestination(summaryTopic)
 	}
 
-	stompSession := GetNewStompConnection(stompUser, stompPassword,
-		*stompUrl, stompTopic, stompCert, stompCertKey)
+	stompSession := GetNewStompConnection(ctx, stompUser, stompPassword,
+		*stompUrl, stompTopic, stompOptions(config), stompCert, stompCertKey)
+	if ctx.Err() != nil {
+		return
+	}
+	// The publisher's session reports the readiness of the output from now on
+	stompSession.output = true
+	setOutputReady(true)
+	defer func() {
+		stompSession.disconnect()
+		setOutputReady(false)
+	}()
 
-	ticker := time.NewTicker(1 * time.Hour)
+	ticker := time.NewTicker(stompRebalanceInterval)
 	defer ticker.Stop()
 
 	messagesQueue := make(chan []byte)
-	go readMsgStomp(messagesQueue, queue)
+	readerDone := make(chan struct{})
+	go func() {
+		readMsg(ctx, messagesQueue, queue)
+		close(readerDone)
+	}()
+
+	// Wait for the receipts of several messages at once
+	var window *stompWindow
+	if config.StompReceipt && config.StompWindow > 1 {
+		window = &stompWindow{session: stompSession, size: config.StompWindow}
+		defer window.close()
+	}
+	requeue := func(unsent [][]byte) {
+		// Put the messages back in front, they will be kept on disk until the next start
+		queue.Requeue(unsent...)
+	}
 
 	// Message loop, constantly be dequeing and sending the message
 	for {
 		select {
+		case <-ctx.Done():
+			<-readerDone
+			if window != nil {
+				requeue(window.drain())
+			}
+			return
 		// Add reconnection every hour to make sure connection to brokers is kept balanced
 		case <-ticker.C:
-			stompSession.handleReconnect()
+			if window != nil {
+				requeue(window.drain())
+			}
+			// Only fails once the context is done, without a connection to send on
+			if err := stompSession.handleReconnect(); err != nil {
+				<-readerDone
+				return
+			}
+		case <-window.oldest():
+			requeue(window.complete())
 		case msg := <-messagesQueue:
-			stompSession.publish(msg)
+			topic := stompTopic
+			if summaryTopic != "" && IsSummaryMessage(msg) {
+				topic = summaryTopic
+			}
+			if window != nil {
+				requeue(window.send(topic, msg))
+			} else if err := stompSession.publishTo(topic, msg); err != nil {
+				requeue([][]byte{msg})
+			}
 		}
 	}
 }
 
-func GetNewStompConnection(username string, password string,
-	stompUrl url.URL, topic string, stompCert string, stompCertKey string) *StompSession {
+// StompOptions are the options of the STOMP connection
+type StompOptions struct {
+	VirtualHost   string        // Sent as the host header, the server's default virtual host if empty
+	HeartBeatSend time.Duration // Interval of the heart-beats sent to the server, disabled if 0
+	HeartBeatRecv time.Duration // Interval of the heart-beats expected from the server, disabled if 0
+	Receipt       bool          // Wait for the server's receipt of every message
+}
+
+// stompOptions returns the options of the STOMP connection in the config
+func stompOptions(config *Config) StompOptions {
+	return StompOptions{
+		VirtualHost:   config.StompVHost,
+		HeartBeatSend: config.StompHeartBeatSend,
+		HeartBeatRecv: config.StompHeartBeatRecv,
+		Receipt:       config.StompReceipt,
+	}
+}
+
+// stompDestination returns the destination of a topic, adding the /topic/
+// prefix if it is missing
+func stompDestination(topic string) string {
+	if !strings.HasPrefix(topic, "/topic/") {
+		return "/topic/" + topic
+	}
+	return topic
+}
+
+// connOptions returns the options of the CONNECT frame
+func (options *StompOptions) connOptions() []func(*stomp.Conn) error {
+	connOpts := []func(*stomp.Conn) error{stomp.ConnOpt.HeartBeat(options.HeartBeatSend, options.HeartBeatRecv)}
+	if options.VirtualHost != "" {
+		connOpts = append(connOpts, stomp.ConnOpt.Host(options.VirtualHost))
+	}
+	return connOpts
+}
+
+func GetNewStompConnection(ctx context.Context, username string, password string,
+	stompUrl url.URL, topic string, options StompOptions, stompCert string, stompCertKey string) *StompSession {
 	if stompCert != "" && stompCertKey != "" {
 		cert, err := tls.LoadX509KeyPair(stompCert, stompCertKey)
 		if err != nil {
 			log.Errorln("Failed to load certificate:", err)
 		}
 
-		return NewStompConnection(username, password,
-			stompUrl, topic, cert)
+		return NewStompConnection(ctx, username, password,
+			stompUrl, topic, options, cert)
 	} else {
-		return NewStompConnection(username, password,
-			stompUrl, topic)
+		return NewStompConnection(ctx, username, password,
+			stompUrl, topic, options)
 	}
 }
 
 type StompSession struct {
+	ctx      context.Context // Stops the reconnection attempts when done
 	username string
 	password string
 	stompUrl url.URL
 	topic    string
+	options  StompOptions
 	cert     []tls.Certificate
 	conn     *stomp.Conn
+	netConn  net.Conn // Connection under conn, closed to fail the sends waiting for a receipt
+	output   bool     // Report the readiness of the output, for the session of the publisher
 }
 
-func NewStompConnection(username string, password string,
-	stompUrl url.URL, topic string, cert ...tls.Certificate) *StompSession {
+func NewStompConnection(ctx context.Context, username string, password string,
+	stompUrl url.URL, topic string, options StompOptions, cert ...tls.Certificate) *StompSession {
 	session := StompSession{
+		ctx:      ctx,
 		username: username,
 		password: password,
 		stompUrl: stompUrl,
 		topic:    topic,
+		options:  options,
 		cert:     cert,
 	}
 
@@ -84,26 +186,29 @@ func NewStompConnection(username string, password string,
 	return &session
 }
 
-func readMsgStomp(messagesQueue chan<- []byte, queue *ConfirmationQueue) {
-	for {
-		msg, err := queue.Dequeue()
-		if err != nil {
-			log.Errorln("Failed to read from queue:", err)
-			continue
-		}
-		messagesQueue <- msg
-	}
-}
-
-// handleReconnect reconnects to the stomp server
-func (session *StompSession) handleReconnect() {
-	// Close the current session
+// disconnect closes the current session, if any
+func (session *StompSession) disconnect() {
 	if session.conn != nil {
 		err := session.conn.Disconnect()
 		if err != nil {
 			log.Errorln("Error handling the disconnection:", err.Error())
 		}
+		session.conn = nil
+	}
+}
+
+// setReady records whether the session can publish
+func (session *StompSession) setReady(ready bool) {
+	if session.output {
+		setOutputReady(ready)
 	}
+}
+
+// handleReconnect reconnects to the stomp server.  Returns the context's
+// error if the context is done before the connection is established.
+func (session *StompSession) handleReconnect() error {
+	// Close the current session
+	session.disconnect()
 
 reconnectLoop:
 	for {
@@ -111,42 +216,249 @@ reconnectLoop:
 		conn, err := GetStompConnection(session)
 		if err == nil {
 			session.conn = conn
+			session.setReady(true)
+			EmitEvent(EventMQConnected, SeverityInfo, map[string]interface{}{"mq": "stomp", "host": session.stompUrl.Host})
 			break reconnectLoop
 		} else {
-			log.Errorln("Failed to reconnect, retrying:", err.Error())
-			<-time.After(reconnectDelay)
+			session.setReady(false)
+			EmitEvent(EventMQDisconnected, SeverityWarning, map[string]interface{}{"mq": "stomp", "error": err.Error()})
+			stompErrors.Errorln("Failed to reconnect, retrying:", err.Error())
+			select {
+			case <-session.ctx.Done():
+				return session.ctx.Err()
+			case <-time.After(reconnectDelay):
+			}
 		}
 	}
+	return nil
 }
 
+// GetStompConnection connects to the STOMP server of the session, and keeps
+// the network connection in the session
 func GetStompConnection(session *StompSession) (*stomp.Conn, error) {
+	connOpts := session.options.connOptions()
+	var netConn net.Conn
+	var err error
 	if session.cert != nil {
-		netConn, err := tls.Dial("tcp", session.stompUrl.String(), &tls.Config{Certificates: session.cert})
+		netConn, err = tls.Dial("tcp", session.stompUrl.String(), &tls.Config{Certificates: session.cert})
 		if err != nil {
 			log.Errorln("Failed to connect using TLS:", err.Error())
+			return nil, err
+		}
+	} else {
+		netConn, err = net.Dial("tcp", session.stompUrl.String())
+		if err != nil {
+			return nil, err
 		}
-		return stomp.Connect(netConn)
+		connOpts = append(connOpts, stomp.ConnOpt.Login(session.username, session.password))
+	}
+	conn, err := stomp.Connect(netConn, connOpts...)
+	if err != nil {
+		_ = netConn.Close()
+		return nil, err
 	}
-	cfg := stomp.ConnOpt.Login(session.username, session.password)
-	return stomp.Dial("tcp", session.stompUrl.String(), cfg)
+	session.netConn = netConn
+	return conn, nil
 }
 
 // publish will send the message to the stomp message bus
-// It will also handle any error in sending by calling handleReconnect
-func (session *StompSession) publish(msg []byte) {
-sendMessageLoop:
+// It will also handle any error in sending by calling handleReconnect,
+// and only returns an error if the context is done before the message is sent
+func (session *StompSession) publish(msg []byte) error {
+	return session.publishTo(session.topic, msg)
+}
+
+// publishTo sends the message to the topic, which may differ from the
+// session's, such as the topic of the summary packets
+func (session *StompSession) publishTo(topic string, msg []byte) error {
 	for {
+		var sendOpts []func(*frame.Frame) error
+		if session.options.Receipt {
+			sendOpts = append(sendOpts, stomp.SendOpt.Receipt)
+		}
+		if session.conn == nil || injectFault(FaultForceReconnect) {
+			if err := session.handleReconnect(); err != nil {
+				return err
+			}
+		}
 		err := session.conn.Send(
-			session.topic,
+			topic,
 			"text/plain",
 			msg,
-			stomp.SendOpt.Receipt)
+			sendOpts...)
+
+		if err != nil {
+			stompErrors.Errorln("Failed to publish message:", err)
+			if err := session.handleReconnect(); err != nil {
+				return err
+			}
+		} else {
+			JournalMessage(topic, "", msg)
+			return nil
+		}
+	}
+}
+
+// stompReceiptTimeout is how long a message in the window may wait for its
+// receipt before the connection is considered lost
+var stompReceiptTimeout = 1 * time.Minute
+
+// stompSend is a message sent to the STOMP server, waiting for its receipt
+type stompSend struct {
+	topic string
+	msg   []byte
+	done  chan struct{} // Closed once the receipt is received, or the send failed
+	err   error
+}
+
+// stompWindow sends messages with up to size of them waiting for their
+// receipt at once, rather than waiting for the receipt of each message before
+// sending the next.  The messages are sent in order by a single writer, and
+// completed in that order, and the messages without a receipt are resent after
+// reconnecting.
+type stompWindow struct {
+	session  *StompSession
+	size     int
+	inflight []*stompSend
+	pending  chan *stompSend // Messages to send, in order, to the writer
+}
+
+// oldest returns a channel closed once the oldest message in the window is
+// done, nil if the window is empty or nil
+func (w *stompWindow) oldest() <-chan struct{} {
+	if w == nil || len(w.inflight) == 0 {
+		return nil
+	}
+	return w.inflight[0].done
+}
 
+// send sends the message without waiting for its receipt, after completing
+// the oldest message if the window is full.  Returns the messages not sent if
+// the context of the session is done first.
+func (w *stompWindow) send(topic string, msg []byte) [][]byte {
+	if len(w.inflight) >= w.size {
+		if unsent := w.complete(); unsent != nil {
+			return append(unsent, msg)
+		}
+	}
+	// The connection is lost if the reconnection failed when the window was drained
+	if w.session.conn == nil {
+		if err := w.session.handleReconnect(); err != nil {
+			return [][]byte{msg}
+		}
+	}
+	if w.pending == nil {
+		w.pending = make(chan *stompSend, w.size)
+		go w.write(w.pending)
+	}
+	send := &stompSend{topic: topic, msg: msg, done: make(chan struct{})}
+	w.inflight = append(w.inflight, send)
+	w.pending <- send
+	return nil
+}
+
+// write sends the pending messages in order, until the window is closed.  The
+// messages pending at once are sent together, and only the last one requests a
+// receipt: the server receives the frames of a connection in order, so the
+// receipt of a frame acknowledges the frames before it too.  The connection is
+// only changed while the window is empty, when the writer waits.
+func (w *stompWindow) write(pending <-chan *stompSend) {
+	for send := range pending {
+		batch := []*stompSend{send}
+	collect:
+		for len(batch) < w.size {
+			select {
+			case send, ok := <-pending:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, send)
+			default:
+				break collect
+			}
+		}
+
+		conn, netConn := w.session.conn, w.session.netConn
+		var err error
+		for _, send := range batch[:len(batch)-1] {
+			if err = conn.Send(send.topic, "text/plain", send.msg); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			// The stomp connection is locked while the send waits for its
+			// receipt, so the network connection under it is closed to fail it
+			timer := time.AfterFunc(stompReceiptTimeout, func() {
+				stompErrors.Errorln("No receipt from the STOMP server after", stompReceiptTimeout, "reconnecting")
+				_ = netConn.Close()
+			})
+			last := batch[len(batch)-1]
+			err = conn.Send(last.topic, "text/plain", last.msg, stomp.SendOpt.Receipt)
+			timer.Stop()
+		}
 		if err != nil {
-			log.Errorln("Failed to publish message:", err)
-			session.handleReconnect()
+			// Closed before the window is drained and the session reconnects
+			_ = conn.MustDisconnect()
+		}
+		for _, send := range batch {
+			send.err = err
+			close(send.done)
+		}
+	}
+}
+
+// close stops the writer, once the window is drained
+func (w *stompWindow) close() {
+	if w.pending != nil {
+		close(w.pending)
+		w.pending = nil
+	}
+}
+
+// complete waits for the receipt of the oldest message in the window.  If it
+// failed, the whole window is drained.
+func (w *stompWindow) complete() [][]byte {
+	oldest := w.inflight[0]
+	<-oldest.done
+	if oldest.err != nil {
+		return w.drain()
+	}
+	JournalMessage(oldest.topic, "", oldest.msg)
+	w.inflight = w.inflight[1:]
+	return nil
+}
+
+// drain waits for the receipts of all the messages in the window, then
+// resends in order the messages that failed, after reconnecting.  Returns the
+// messages not sent if the context of the session is done first.
+func (w *stompWindow) drain() [][]byte {
+	var failed []*stompSend
+	for _, send := range w.inflight {
+		<-send.done
+		if send.err != nil {
+			failed = append(failed, send)
 		} else {
-			break sendMessageLoop
+			JournalMessage(send.topic, "", send.msg)
+		}
+	}
+	w.inflight = nil
+	if len(failed) == 0 {
+		return nil
+	}
+
+	stompErrors.Errorln("Failed to publish", len(failed), "messages, resending them:", failed[0].err)
+	err := w.session.handleReconnect()
+	for i, send := range failed {
+		if err == nil {
+			err = w.session.publishTo(send.topic, send.msg)
+		}
+		if err != nil {
+			unsent := make([][]byte, 0, len(failed)-i)
+			for _, send := range failed[i:] {
+				unsent = append(unsent, send.msg)
+			}
+			return unsent
 		}
 	}
+	return nil
 }
@@ -0,0 +1,369 @@
+package shoveler
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	stomp "github.com/go-stomp/stomp/v3"
+	"github.com/go-stomp/stomp/v3/frame"
+	"github.com/go-stomp/stomp/v3/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStompConnOptions(t *testing.T) {
+	options := StompOptions{HeartBeatSend: time.Minute, HeartBeatRecv: time.Minute}
+	assert.Len(t, options.connOptions(), 1, "Only the heart-beats without a virtual host")
+
+	options.VirtualHost = "/monitoring"
+	assert.Len(t, options.connOptions(), 2, "The host header is added with a virtual host")
+}
+
+// countingListener counts the connections accepted by the mock broker
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// quietStompLog discards the logs of the mock broker, which reports every
+// disconnection as an error
+type quietStompLog struct{}
+
+func (quietStompLog) Debugf(string, ...interface{})   {}
+func (quietStompLog) Infof(string, ...interface{})    {}
+func (quietStompLog) Warningf(string, ...interface{}) {}
+func (quietStompLog) Errorf(string, ...interface{})   {}
+func (quietStompLog) Debug(string)                    {}
+func (quietStompLog) Info(string)                     {}
+func (quietStompLog) Warning(string)                  {}
+func (quietStompLog) Error(string)                    {}
+
+// startStompBroker starts an in-process STOMP server, stopped at the end of
+// the test, and returns its URL as configured in stomp.url
+func startStompBroker(tb testing.TB) (*url.URL, *countingListener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	counting := &countingListener{Listener: listener}
+	go func() {
+		broker := server.Server{Log: quietStompLog{}}
+		_ = broker.Serve(counting)
+	}()
+	tb.Cleanup(func() { _ = listener.Close() })
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	stompUrl, err := url.Parse("localhost:" + strconv.Itoa(port))
+	require.NoError(tb, err)
+	return stompUrl, counting
+}
+
+// subscribeStomp subscribes to the topic of the broker, and returns once the
+// subscription receives messages.  Messages to a topic are only delivered to
+// the subscriptions existing when they are sent.
+func subscribeStomp(tb testing.TB, stompUrl *url.URL, topic string) *stomp.Subscription {
+	conn, err := stomp.Dial("tcp", stompUrl.String(), stomp.ConnOpt.Logger(quietStompLog{}))
+	require.NoError(tb, err)
+	tb.Cleanup(func() { _ = conn.Disconnect() })
+	sub, err := conn.Subscribe(topic, stomp.AckAuto)
+	require.NoError(tb, err)
+
+	// The broker handles the frames of a connection in order
+	require.NoError(tb, conn.Send(topic, "text/plain", []byte("probe"), stomp.SendOpt.Receipt))
+	select {
+	case msg := <-sub.C:
+		require.NoError(tb, msg.Err)
+		require.Equal(tb, "probe", string(msg.Body))
+	case <-time.After(5 * time.Second):
+		tb.Fatal("The subscription did not receive the probe message")
+	}
+	return sub
+}
+
+// startStompPublisher runs StartStomp with the config, publishing the messages
+// of a new queue, until the end of the test.  Returns the queue, and the
+// function to stop the publisher along with the channel closed once it stopped.
+func startStompPublisher(tb testing.TB, config *Config) (*ConfirmationQueue, context.CancelFunc, <-chan struct{}) {
+	config.QueueDir = path.Join(tb.TempDir(), "shoveler-queue")
+	queue := NewConfirmationQueue(config)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		StartStomp(ctx, config, queue)
+		close(done)
+	}()
+	tb.Cleanup(func() {
+		cancel()
+		<-done
+		_ = queue.Close()
+	})
+	return queue, cancel, done
+}
+
+// startSilentStompBroker starts a STOMP server which never sends the receipts
+// on the first connection, and sends them on the next ones.  Returns its URL,
+// and the channel of the messages received on the next connections.
+func startSilentStompBroker(tb testing.TB) (*url.URL, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	tb.Cleanup(func() { _ = listener.Close() })
+	received := make(chan string, 100)
+	go func() {
+		for silent := true; ; silent = false {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSilentStomp(conn, silent, received)
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	stompUrl, err := url.Parse("localhost:" + strconv.Itoa(port))
+	require.NoError(tb, err)
+	return stompUrl, received
+}
+
+func serveSilentStomp(conn net.Conn, silent bool, received chan<- string) {
+	defer conn.Close()
+	reader := frame.NewReader(conn)
+	writer := frame.NewWriter(conn)
+	for {
+		f, err := reader.Read()
+		if err != nil {
+			return
+		}
+		if f == nil {
+			continue
+		}
+		switch f.Command {
+		case frame.CONNECT:
+			err = writer.Write(frame.New(frame.CONNECTED, frame.Version, "1.2"))
+		case frame.SEND:
+			if silent {
+				continue
+			}
+			received <- string(f.Body)
+			if receipt, ok := f.Header.Contains(frame.Receipt); ok {
+				err = writer.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+			}
+		case frame.DISCONNECT:
+			if receipt, ok := f.Header.Contains(frame.Receipt); ok {
+				_ = writer.Write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// TestStompRebalance makes sure no message is lost or duplicated when the
+// publisher reconnects to keep the connections balanced
+func TestStompRebalance(t *testing.T) {
+	defer func(interval time.Duration) { stompRebalanceInterval = interval }(stompRebalanceInterval)
+	stompRebalanceInterval = 5 * time.Millisecond
+
+	stompUrl, listener := startStompBroker(t)
+	sub := subscribeStomp(t, stompUrl, "/topic/shoveled-xrd")
+	queue, _, _ := startStompPublisher(t, &Config{StompURL: stompUrl, StompTopic: "shoveled-xrd", StompReceipt: true})
+	const count = 2000
+	for i := 0; i < count; i++ {
+		queue.Enqueue([]byte("message." + strconv.Itoa(i)))
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case msg := <-sub.C:
+			require.NoError(t, msg.Err)
+			require.Equal(t, "message."+strconv.Itoa(i), string(msg.Body))
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Received %d messages out of %d", i, count)
+		}
+	}
+	assert.Eventually(t, func() bool { return listener.accepted.Load() >= 3 }, 5*time.Second, 10*time.Millisecond,
+		"The publisher should have reconnected")
+	assert.Equal(t, 0, queue.Size())
+}
+
+// TestStompRebalanceFailure makes sure the publisher stops, rather than sending
+// without a connection, when the broker is down at a rebalance and the
+// shoveler shuts down
+func TestStompRebalanceFailure(t *testing.T) {
+	defer func(interval time.Duration) { stompRebalanceInterval = interval }(stompRebalanceInterval)
+	stompRebalanceInterval = 5 * time.Millisecond
+
+	stompUrl, listener := startStompBroker(t)
+	queue, cancel, done := startStompPublisher(t, &Config{StompURL: stompUrl, StompTopic: "shoveled-xrd", StompReceipt: true})
+	require.Eventually(t, func() bool { return listener.accepted.Load() >= 1 }, 5*time.Second, time.Millisecond)
+	require.NoError(t, listener.Close())
+	time.Sleep(100 * time.Millisecond)
+	// Waiting to be sent while the publisher reconnects
+	queue.Enqueue([]byte("message.0"))
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The publisher did not stop")
+	}
+	assert.Equal(t, 1, queue.Size())
+}
+
+// TestStompWindow makes sure every message is delivered once and in order
+// when several messages wait for their receipt, while the publisher reconnects
+func TestStompWindow(t *testing.T) {
+	defer func(interval time.Duration) { stompRebalanceInterval = interval }(stompRebalanceInterval)
+	stompRebalanceInterval = 5 * time.Millisecond
+
+	stompUrl, _ := startStompBroker(t)
+	sub := subscribeStomp(t, stompUrl, "/topic/shoveled-xrd")
+	queue, _, _ := startStompPublisher(t, &Config{StompURL: stompUrl, StompTopic: "shoveled-xrd", StompReceipt: true, StompWindow: 16})
+	const count = 2000
+	for i := 0; i < count; i++ {
+		queue.Enqueue([]byte("message." + strconv.Itoa(i)))
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case msg := <-sub.C:
+			require.NoError(t, msg.Err)
+			require.Equal(t, "message."+strconv.Itoa(i), string(msg.Body))
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Received %d messages out of %d", i, count)
+		}
+	}
+	select {
+	case msg := <-sub.C:
+		t.Fatalf("Received the duplicate message %s", msg.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, 0, queue.Size())
+}
+
+// TestStompWindowTimeout makes sure the messages without a receipt in time are
+// resent, in order, on a new connection
+func TestStompWindowTimeout(t *testing.T) {
+	// Restored once the publisher is stopped, at the end of the test
+	timeout := stompReceiptTimeout
+	t.Cleanup(func() { stompReceiptTimeout = timeout })
+	stompReceiptTimeout = 100 * time.Millisecond
+
+	stompUrl, received := startSilentStompBroker(t)
+	queue, _, _ := startStompPublisher(t, &Config{StompURL: stompUrl, StompTopic: "shoveled-xrd", StompReceipt: true, StompWindow: 4})
+	const count = 3
+	for i := 0; i < count; i++ {
+		queue.Enqueue([]byte("message." + strconv.Itoa(i)))
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case msg := <-received:
+			require.Equal(t, "message."+strconv.Itoa(i), msg)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Received %d messages out of %d", i, count)
+		}
+	}
+	select {
+	case msg := <-received:
+		t.Fatalf("Received the duplicate message %s", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestStompSummaryTopic makes sure the summary packets are published to
+// their own topic, and the others to the main topic
+func TestStompSummaryTopic(t *testing.T) {
+	stompUrl, _ := startStompBroker(t)
+	sub := subscribeStomp(t, stompUrl, "/topic/shoveled-xrd")
+	summarySub := subscribeStomp(t, stompUrl, "/topic/shoveled-xrd.summary")
+	config := Config{
+		StompURL:     stompUrl,
+		StompTopic:   "shoveled-xrd",
+		SummaryTopic: "shoveled-xrd.summary",
+		StompReceipt: true,
+	}
+	queue, _, _ := startStompPublisher(t, &config)
+	remote := &net.UDPAddr{IP: net.ParseIP("192.168.0.7"), Port: 12345}
+	detailed := PackageUdp([]byte{'u', 1, 0, 8, 0, 0, 0, 5}, remote, &config)
+	summary := PackageUdp([]byte("<statistics></statistics>"), remote, &config)
+	queue.Enqueue(detailed)
+	queue.Enqueue(summary)
+
+	for _, expected := range []struct {
+		sub *stomp.Subscription
+		msg []byte
+	}{{sub, detailed}, {summarySub, summary}} {
+		select {
+		case msg := <-expected.sub.C:
+			require.NoError(t, msg.Err)
+			assert.Equal(t, expected.msg, msg.Body)
+		case <-time.After(10 * time.Second):
+			t.Fatal("The message was not received on", expected.sub.Destination())
+		}
+	}
+}
+
+// BenchmarkStompPublish measures the rate of messages a session publishes to
+// a broker, with and without waiting for a receipt of every message
+func BenchmarkStompPublish(b *testing.B) {
+	msg := make([]byte, 1024)
+	for _, receipt := range []bool{true, false} {
+		b.Run("receipt="+strconv.FormatBool(receipt), func(b *testing.B) {
+			stompUrl, _ := startStompBroker(b)
+			session := NewStompConnection(context.Background(), "", "", *stompUrl, "/topic/shoveled-xrd",
+				StompOptions{Receipt: receipt})
+			defer session.disconnect()
+
+			b.SetBytes(int64(len(msg)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := session.publish(msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
+
+// BenchmarkStompThroughput measures the rate of messages delivered to a
+// subscriber, from the queue through StartStomp and the broker, waiting for
+// the receipt of each message or of a window of messages
+func BenchmarkStompThroughput(b *testing.B) {
+	for _, window := range []int{1, 32} {
+		b.Run("window="+strconv.Itoa(window), func(b *testing.B) {
+			stompUrl, _ := startStompBroker(b)
+			sub := subscribeStomp(b, stompUrl, "/topic/shoveled-xrd")
+			queue, _, _ := startStompPublisher(b, &Config{StompURL: stompUrl, StompTopic: "shoveled-xrd", StompReceipt: true, StompWindow: window})
+
+			msg := make([]byte, 1024)
+			b.SetBytes(int64(len(msg)))
+			b.ResetTimer()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					queue.Enqueue(msg)
+				}
+			}()
+			for i := 0; i < b.N; i++ {
+				if received := <-sub.C; received.Err != nil {
+					b.Fatal(received.Err)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package shoveler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// TokenExpiry returns the expiration time in the exp claim of the token at tokenLocation.
+// The signature of the token is not verified, the message bus does that.
+func TokenExpiry(tokenLocation string) (time.Time, error) {
+	tokenContents, err := readToken(tokenLocation)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return tokenContentsExpiry(tokenContents)
+}
+
+// tokenContentsExpiry returns the expiration time in the exp claim of the token
+func tokenContentsExpiry(tokenContents string) (time.Time, error) {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenContents, claims); err != nil {
+		return time.Time{}, err
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return time.Time{}, errors.New("token does not have an exp claim")
+	}
+	return time.Unix(int64(exp), 0), nil
+}
+
+// tokenNeedsRefresh returns true if the token at tokenLocation expires within
+// the refresh period, or if the token file cannot be read, such as when it is
+// missing.  Tokens without a readable expiration, such as opaque tokens, are
+// not refreshed, as they would be refreshed on every check.
+func tokenNeedsRefresh(tokenLocation string, refreshBefore time.Duration) bool {
+	tokenContents, err := readToken(tokenLocation)
+	if err != nil || tokenContents == "" {
+		return true
+	}
+	expiry, err := tokenContentsExpiry(tokenContents)
+	if err != nil {
+		log.Debugln("Unable to read the expiration of token", tokenLocation+", not refreshing it:", err)
+		return false
+	}
+	return time.Until(expiry) < refreshBefore
+}
+
+// RefreshToken runs the command to get a new token, with SHOVELER_TOKEN_LOCATION
+// set to the token location.  If the command prints a token with an expiration,
+// it atomically replaces the token file, otherwise the command is expected to
+// write the token file itself, such as htgettoken -o, and any output, such as a
+// status line, is ignored.
+func RefreshToken(ctx context.Context, command []string, tokenLocation string) error {
+	if len(command) == 0 {
+		return errors.New("no token refresh command configured")
+	}
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), "SHOVELER_TOKEN_LOCATION="+tokenLocation)
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return err
+	}
+	token := strings.TrimSpace(string(output))
+	if token == "" {
+		return nil
+	}
+	if _, err := tokenContentsExpiry(token); err != nil {
+		log.Warningln("Ignoring the output of the token refresh command, which is not a token with an expiration:", err)
+		return nil
+	}
+	return writeFileAtomic(tokenLocation, []byte(token+"\n"), 0600)
+}
@@ -0,0 +1,77 @@
+package shoveler
+
+import (
+	"context"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenExpiry(t *testing.T) {
+	tokenDir := t.TempDir()
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	// The signature is not verified, so any key will do
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": expiry.Unix()}).SignedString([]byte("key"))
+	assert.NoError(t, err)
+	tokenLocation := path.Join(tokenDir, "token")
+	assert.NoError(t, os.WriteFile(tokenLocation, []byte(token+"\n"), 0600))
+
+	tokenExpiry, err := TokenExpiry(tokenLocation)
+	assert.NoError(t, err)
+	assert.True(t, expiry.Equal(tokenExpiry), "Expiry should match the exp claim")
+
+	// Token without an exp claim
+	token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "shoveler"}).SignedString([]byte("key"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(tokenLocation, []byte(token), 0600))
+	_, err = TokenExpiry(tokenLocation)
+	assert.Error(t, err)
+}
+
+func TestTokenNeedsRefresh(t *testing.T) {
+	tokenLocation := path.Join(t.TempDir(), "token")
+	assert.True(t, tokenNeedsRefresh(tokenLocation, 10*time.Minute), "Missing token")
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte("key"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(tokenLocation, []byte(token), 0600))
+	assert.False(t, tokenNeedsRefresh(tokenLocation, 10*time.Minute))
+	assert.True(t, tokenNeedsRefresh(tokenLocation, 2*time.Hour))
+
+	// Opaque tokens would be refreshed on every check
+	assert.NoError(t, os.WriteFile(tokenLocation, []byte("opaque-token\n"), 0600))
+	assert.False(t, tokenNeedsRefresh(tokenLocation, 2*time.Hour))
+}
+
+func TestRefreshToken(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The refresh commands use sh")
+	}
+	tokenLocation := path.Join(t.TempDir(), "token")
+	token1, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte("key"))
+	assert.NoError(t, err)
+
+	// The command prints the token
+	assert.NoError(t, RefreshToken(context.Background(), []string{"sh", "-c", "echo " + token1}, tokenLocation))
+	contents, err := os.ReadFile(tokenLocation)
+	assert.NoError(t, err)
+	assert.Equal(t, token1+"\n", string(contents))
+
+	// The command writes the token file itself, and prints a status line
+	assert.NoError(t, RefreshToken(context.Background(), []string{"sh", "-c", `echo token2 > "$SHOVELER_TOKEN_LOCATION"; echo Storing token`}, tokenLocation))
+	contents, err = os.ReadFile(tokenLocation)
+	assert.NoError(t, err)
+	assert.Equal(t, "token2\n", string(contents))
+
+	// A failure keeps the token, and reports the error output
+	err = RefreshToken(context.Background(), []string{"sh", "-c", "echo no credentials >&2; exit 1"}, tokenLocation)
+	assert.ErrorContains(t, err, "no credentials")
+	contents, err = os.ReadFile(tokenLocation)
+	assert.NoError(t, err)
+	assert.Equal(t, "token2\n", string(contents))
+}
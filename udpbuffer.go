@@ -0,0 +1,68 @@
+package shoveler
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ConfigureUDPBuffer sets the kernel receive buffer of the UDP connection to the requested
+// size, and warns if the kernel did not allow the requested size.  The effective size is
+// exported as the shoveler_udp_receive_buffer_bytes metric.
+func ConfigureUDPBuffer(conn *net.UDPConn, requested int) {
+	err := conn.SetReadBuffer(requested)
+	if err != nil {
+		log.Warningln("Failed to set read buffer size to", requested, "bytes:", err)
+	}
+
+	effective, err := udpReceiveBuffer(conn)
+	if err != nil {
+		log.Debugln("Unable to read back the UDP receive buffer size:", err)
+		return
+	}
+	if effective < requested {
+		// The kernel caps the buffer, try to override the cap
+		effective, err = forceUDPReceiveBuffer(conn, requested)
+		if err != nil {
+			log.Debugln("Unable to force the UDP receive buffer size:", err)
+		}
+	}
+	UDPReceiveBuffer.Set(float64(effective))
+	if effective < requested {
+		log.Warningln("The UDP receive buffer is", effective, "bytes instead of the requested", requested,
+			"bytes, packets may be dropped at high rates.  Raise the kernel limit, for example with sysctl net.core.rmem_max")
+	} else {
+		log.Debugln("UDP receive buffer size:", effective, "bytes")
+	}
+}
+
+// MonitorUDPDrops periodically checks the number of packets dropped by the kernel on the UDP
+// connection, and warns when packets are dropped.
+// This should run in a new go co-routine, it returns once the context is done.
+func MonitorUDPDrops(ctx context.Context, conn *net.UDPConn) {
+	lastDrops, err := udpDrops(conn)
+	if err != nil {
+		log.Debugln("Unable to monitor the UDP packet drops:", err)
+		return
+	}
+	UDPDrops.Add(float64(lastDrops))
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		drops, err := udpDrops(conn)
+		if err != nil {
+			log.Errorln("Unable to read the UDP packet drops:", err)
+			continue
+		}
+		if drops > lastDrops {
+			UDPDrops.Add(float64(drops - lastDrops))
+			log.Warningln("The kernel dropped", drops-lastDrops, "UDP packets in the last minute, consider increasing listen.read_buffer")
+		}
+		lastDrops = drops
+	}
+}
@@ -0,0 +1,116 @@
+package shoveler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// udpReceiveBuffer returns the receive buffer size set, comparable to the size
+// requested.  Linux reports double the size set, as it includes the bookkeeping
+// overhead, so the reported size is halved.
+func udpReceiveBuffer(conn *net.UDPConn) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var size int
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size / 2, sockErr
+}
+
+// forceUDPReceiveBuffer sets the receive buffer above the net.core.rmem_max limit,
+// which is only allowed with the CAP_NET_ADMIN capability
+func forceUDPReceiveBuffer(conn *net.UDPConn, requested int) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, requested)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	size, sizeErr := udpReceiveBuffer(conn)
+	if sizeErr != nil {
+		return 0, sizeErr
+	}
+	return size, err
+}
+
+// udpSocketInode returns the inode of the socket, which identifies it in /proc/net/udp
+func udpSocketInode(conn *net.UDPConn) (string, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var link string
+	var linkErr error
+	err = rawConn.Control(func(fd uintptr) {
+		link, linkErr = os.Readlink("/proc/self/fd/" + strconv.Itoa(int(fd)))
+	})
+	if err != nil {
+		return "", err
+	}
+	if linkErr != nil {
+		return "", linkErr
+	}
+	// The link is of the form socket:[inode]
+	if !strings.HasPrefix(link, "socket:[") {
+		return "", fmt.Errorf("unexpected socket link: %s", link)
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), nil
+}
+
+// udpDrops returns the number of packets the kernel dropped on the socket, from /proc/net/udp
+func udpDrops(conn *net.UDPConn) (uint64, error) {
+	inode, err := udpSocketInode(conn)
+	if err != nil {
+		return 0, err
+	}
+	for _, procFile := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		drops, err := parseUDPDrops(procFile, inode)
+		if err == nil {
+			return drops, nil
+		}
+	}
+	return 0, errors.New("socket not found in /proc/net/udp")
+}
+
+// parseUDPDrops finds the socket with the inode in a /proc/net/udp formatted file,
+// and returns the drops column
+func parseUDPDrops(procFile string, inode string) (uint64, error) {
+	file, err := os.Open(procFile)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	// Skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ref pointer drops
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 || fields[9] != inode {
+			continue
+		}
+		return strconv.ParseUint(fields[12], 10, 64)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("socket not found in " + procFile)
+}
@@ -0,0 +1,44 @@
+package shoveler
+
+import (
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPReceiveBuffer(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// Small enough to be allowed by the default kernel limits
+	ConfigureUDPBuffer(conn, 64*1024)
+	size, err := udpReceiveBuffer(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, 64*1024, size, "The size set, rather than the doubled size reported by Linux")
+	assert.Equal(t, float64(64*1024), testutil.ToFloat64(UDPReceiveBuffer))
+
+	drops, err := udpDrops(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), drops)
+}
+
+func TestParseUDPDrops(t *testing.T) {
+	procUDP := `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 00000000:2711 00000000:0000 07 00000000:00000000 00:00000000 00000000   995        0 40001 2 0000000000000000 0
+  456: 00000000:2712 00000000:0000 07 00000000:00000000 00:00000000 00000000   995        0 40002 2 0000000000000000 1234
+`
+	procFile := path.Join(t.TempDir(), "udp")
+	assert.NoError(t, os.WriteFile(procFile, []byte(procUDP), 0644))
+
+	drops, err := parseUDPDrops(procFile, "40002")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1234), drops)
+
+	_, err = parseUDPDrops(procFile, "40003")
+	assert.Error(t, err)
+}
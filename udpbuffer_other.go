@@ -0,0 +1,22 @@
+//go:build !linux
+
+package shoveler
+
+import (
+	"errors"
+	"net"
+)
+
+var errUDPBufferUnsupported = errors.New("not supported on this platform")
+
+func udpReceiveBuffer(conn *net.UDPConn) (int, error) {
+	return 0, errUDPBufferUnsupported
+}
+
+func forceUDPReceiveBuffer(conn *net.UDPConn, requested int) (int, error) {
+	return 0, errUDPBufferUnsupported
+}
+
+func udpDrops(conn *net.UDPConn) (uint64, error) {
+	return 0, errUDPBufferUnsupported
+}
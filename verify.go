@@ -1,9 +1,15 @@
 package shoveler
 
 import (
+	"bytes"
 	"encoding/binary"
+	"net"
+	"sync"
 )
 
+// Invalid packets may be sent by a misconfigured server for every transfer
+var verifyErrors = NewRateLimitedLog(errorLogInterval)
+
 // Header is the XRootD structure
 // 1 + 1 + 2 + 4 = 8 bytes
 type Header struct {
@@ -13,31 +19,128 @@ type Header struct {
 	ServerStart int32
 }
 
+// ParseHeader returns the header at the beginning of the packet, or nil if it
+// is too short or is an XML summary packet, which has no header
+func ParseHeader(packet []byte) *Header {
+	if len(packet) < 8 || packet[0] == '<' {
+		return nil
+	}
+	return &Header{
+		Code:        packet[0],
+		Pseq:        packet[1],
+		Plen:        binary.BigEndian.Uint16(packet[2:4]),
+		ServerStart: int32(binary.BigEndian.Uint32(packet[4:8])),
+	}
+}
+
+// Reasons a packet fails verification, used as the metric label
+const (
+	PacketTooShort       = "too_short"
+	PacketLengthMismatch = "length_mismatch"
+)
+
 // verifyPacket will verify the packet matches the expected
 // format from XRootD
 func VerifyPacket(packet []byte) bool {
+	return PacketError(packet) == ""
+}
+
+// PacketError returns the reason the packet does not match the expected
+// format from XRootD, or an empty string if it matches
+func PacketError(packet []byte) string {
 	// Try reading in the header, which is 8 bytes
 	if len(packet) < 8 {
 		// If it is less than 8 bytes, then it can't have the header, and discard it
 		log.Infoln("Packet not large enough for XRootD header of 8 bytes, dropping.")
-		return false
+		return PacketTooShort
 	}
 
 	// XML '<' character indicates a summary packet
 	if len(packet) > 0 && packet[0] == '<' {
-		return true
+		return ""
 	}
 
-	header := Header{}
-	header.Code = packet[0]
-	header.Pseq = packet[1]
-	header.Plen = binary.BigEndian.Uint16(packet[2:4])
-	header.ServerStart = int32(binary.BigEndian.Uint32(packet[4:8]))
+	header := ParseHeader(packet)
 
 	// If the beginning of the packet doesn't match some expectations, then continue
 	if len(packet) != int(header.Plen) {
-		log.Warningln("Packet length does not match header.  Packet:", len(packet), "Header:", int(header.Plen))
-		return false
+		verifyErrors.Warningln("Packet length does not match header.  Packet:", len(packet), "Header:", int(header.Plen))
+		return PacketLengthMismatch
+	}
+	return ""
+}
+
+// TrimPadding truncates a packet to the length in its header, if the packet
+// is longer by at most maxPadding bytes, as some servers pad their packets.
+// Other packets are returned unchanged.  The packets truncated are counted by
+// the version of the server that sent them, so the releases padding their
+// packets can be found.
+func TrimPadding(packet []byte, remote *net.UDPAddr, maxPadding int) []byte {
+	if maxPadding <= 0 || len(packet) < 8 || packet[0] == '<' {
+		return packet
+	}
+	plen := int(binary.BigEndian.Uint16(packet[2:4]))
+	if packet[0] == '=' && plen <= len(packet) {
+		recordServerVersion(packet[:plen], remote)
+	}
+	if plen < 8 || len(packet) <= plen || len(packet)-plen > maxPadding {
+		return packet
+	}
+	PacketsTruncated.WithLabelValues(serverVersion(remote)).Inc()
+	return packet[:plen]
+}
+
+const (
+	// maxServerVersions bounds the number of servers whose version is remembered
+	maxServerVersions = 10000
+	// maxVersionLength bounds the length of a version, used as a metric label
+	maxVersionLength = 32
+	// unknownVersion is the version of the servers not identified yet
+	unknownVersion = "unknown"
+)
+
+// The versions reported by the servers in their identification packets, by address
+var (
+	serverVersionsMutex sync.Mutex
+	serverVersions      = make(map[string]string)
+)
+
+// recordServerVersion remembers the version in a server identification
+// packet, whose 4 byte dictionary ID is followed by
+// "userid\n&site=...&pgm=xrootd&ver=v5.6.0&..."
+func recordServerVersion(packet []byte, remote *net.UDPAddr) {
+	if remote == nil || len(packet) < 12 {
+		return
+	}
+	info := packet[12:]
+	start := bytes.Index(info, []byte("&ver="))
+	if start < 0 {
+		return
+	}
+	version := info[start+len("&ver="):]
+	if end := bytes.IndexAny(version, "&\n\x00"); end >= 0 {
+		version = version[:end]
+	}
+	if len(version) == 0 || len(version) > maxVersionLength {
+		return
+	}
+	serverVersionsMutex.Lock()
+	defer serverVersionsMutex.Unlock()
+	address := remote.IP.String()
+	if _, ok := serverVersions[address]; ok || len(serverVersions) < maxServerVersions {
+		serverVersions[address] = string(version)
+	}
+}
+
+// serverVersion returns the version last reported by the server, or unknownVersion
+func serverVersion(remote *net.UDPAddr) string {
+	if remote == nil {
+		return unknownVersion
+	}
+	serverVersionsMutex.Lock()
+	defer serverVersionsMutex.Unlock()
+	if version, ok := serverVersions[remote.IP.String()]; ok {
+		return version
 	}
-	return true
+	return unknownVersion
 }
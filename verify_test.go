@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"net"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -55,3 +57,43 @@ func TestBadVerify(t *testing.T) {
 
 	assert.False(t, VerifyPacket(buf.Bytes()), "Failed to verify packet")
 }
+
+// TestTrimPadding tests packets padded after their header length are truncated
+func TestTrimPadding(t *testing.T) {
+	packet := make([]byte, 24)
+	binary.BigEndian.PutUint16(packet[2:4], 16)
+
+	assert.Equal(t, PacketLengthMismatch, PacketError(TrimPadding(packet, nil, 0)), "Padding is not accepted by default")
+	assert.Equal(t, PacketLengthMismatch, PacketError(TrimPadding(packet, nil, 4)), "Too much padding")
+	trimmed := TrimPadding(packet, nil, 8)
+	assert.Len(t, trimmed, 16)
+	assert.True(t, VerifyPacket(trimmed))
+
+	// Packets shorter than their header length are not changed
+	assert.Len(t, TrimPadding(packet[:12], nil, 8), 12)
+}
+
+// TestTrimPaddingVersion makes sure the packets truncated are counted by the
+// version the server reported in its identification packet
+func TestTrimPaddingVersion(t *testing.T) {
+	remote := &net.UDPAddr{IP: net.ParseIP("192.0.2.20"), Port: 1094}
+	packet := make([]byte, 24)
+	binary.BigEndian.PutUint16(packet[2:4], 16)
+	unknown := testutil.ToFloat64(PacketsTruncated.WithLabelValues(unknownVersion))
+	TrimPadding(packet, remote, 8)
+	assert.Equal(t, unknown+1, testutil.ToFloat64(PacketsTruncated.WithLabelValues(unknownVersion)))
+
+	info := []byte("xrootd.1234:27@host\n&site=TEST&port=1094&inst=anon&pgm=xrootd&ver=v7.0.1-pelican&flg=ssl")
+	identification := make([]byte, 12, 12+len(info)+4)
+	identification[0] = '='
+	identification = append(identification, info...)
+	binary.BigEndian.PutUint16(identification[2:4], uint16(len(identification)))
+	// Padded like the other packets of the server
+	identification = append(identification, 0, 0, 0, 0)
+	assert.Len(t, TrimPadding(identification, remote, 8), len(identification)-4)
+	assert.Equal(t, "v7.0.1-pelican", serverVersion(remote))
+
+	TrimPadding(packet, remote, 8)
+	assert.Equal(t, 2.0, testutil.ToFloat64(PacketsTruncated.WithLabelValues("v7.0.1-pelican")))
+	assert.Equal(t, unknownVersion, serverVersion(&net.UDPAddr{IP: net.ParseIP("192.0.2.21")}))
+}